@@ -4,19 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
-	"time"
 
 	"github.com/amaurybrisou/ablib"
 	"github.com/amaurybrisou/ablib/jwtlib"
-	"github.com/amaurybrisou/ablib/mailcli"
 	"github.com/amaurybrisou/ablib/store"
 	"github.com/amaurybrisou/gateway/src"
+	"github.com/amaurybrisou/gateway/src/cache"
 	"github.com/amaurybrisou/gateway/src/database"
+	"github.com/amaurybrisou/gateway/src/errorpage"
+	"github.com/amaurybrisou/gateway/src/forwarded"
 	"github.com/amaurybrisou/gateway/src/gwservices"
+	"github.com/amaurybrisou/gateway/src/gwservices/account"
+	"github.com/amaurybrisou/gateway/src/gwservices/identity"
 	"github.com/amaurybrisou/gateway/src/gwservices/payment"
 	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
-	"github.com/google/uuid"
+	"github.com/amaurybrisou/gateway/src/health"
+	"github.com/amaurybrisou/gateway/src/mailer"
+	"github.com/amaurybrisou/gateway/src/oidc"
+	"github.com/amaurybrisou/gateway/src/secrets"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -55,25 +62,45 @@ func main() {
 		ablib.LookupEnv("DB_SSL_MODE", "disable"),
 	)
 
-	db := database.New(postgres)
+	cipher, err := secrets.NewCipher(ablib.LookupEnv("ENCRYPTION_KEY", ""))
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("creating cipher")
+		return
+	}
+
+	db := database.New(postgres, database.WithCipher(cipher))
 
 	domain := ablib.LookupEnv("DOMAIN", "http://localhost:8089")
 
-	mail, err := mailcli.NewMailClient(
-		ctx,
-		mailcli.WithMailClientOptionSenderEmail(ablib.LookupEnv("SENDER_EMAIL", "gateway@gateway.org")),
-		mailcli.WithMailClientOptionSenderPassword(ablib.LookupEnv("SENDER_PASSWORD", "default-password")),
-		mailcli.WithClientOptionSMTPServer(
-			ablib.LookupEnv("SMTP_SERVER", "smtp.gmail.com"),
-			ablib.LookupEnvInt("SMTP_PORT", 587),
-		),
-	)
+	cacheStore, err := cache.NewStore(cache.Config{
+		Backend:    ablib.LookupEnv("CACHE_BACKEND", cache.BackendMemory),
+		MemorySize: int64(ablib.LookupEnvInt("CACHE_MEMORY_SIZE", 64<<20)),
+		DiskPath:   ablib.LookupEnv("CACHE_DISK_PATH", ""),
+	})
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("creating cache store")
+		return
+	}
+
+	errorPages, err := errorpage.New(ablib.LookupEnv("ERROR_PAGES_PATH", ""))
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("loading error pages")
+		return
+	}
+
+	trustedProxies, err := forwarded.ParseProxies(ablib.LookupEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("parsing trusted proxies")
+		return
+	}
+
+	oidcProviders, err := oidc.FromEnv(ablib.LookupEnv("OIDC_PROVIDERS", ""), os.Getenv)
 	if err != nil {
-		log.Ctx(ctx).Fatal().Err(err).Msg("creating mail client")
+		log.Ctx(ctx).Fatal().Err(err).Msg("reading oidc providers")
 		return
 	}
 
-	services := gwservices.NewServices(db, mail, gwservices.ServiceConfig{
+	services := gwservices.NewServices(db, cacheStore, gwservices.ServiceConfig{
 		PaymentConfig: payment.Config{
 			StripeKey:           ablib.LookupEnv("STRIPE_KEY", ""),
 			StripeSuccessURL:    ablib.LookupEnv("STRIPE_SUCCESS_URL", domain+"/login"),
@@ -86,10 +113,49 @@ func main() {
 			Audience:  ablib.LookupEnv("JWT_AUDIENCE", "insecure-key"),
 		},
 		ProxyConfig: proxy.Config{
-			StripPrefix:         "",
-			NotFoundRedirectURL: "/services",
-			NoRoleRedirectURL:   "/pricing",
+			StripPrefix: "",
+			Redirects: proxy.Redirects{
+				NotFoundURL:    ablib.LookupEnv("NOT_FOUND_REDIRECT_URL", "/services"),
+				NotFoundStatus: ablib.LookupEnvInt("NOT_FOUND_REDIRECT_STATUS", http.StatusFound),
+				NoRoleURL:      ablib.LookupEnv("NO_ROLE_REDIRECT_URL", "/pricing"),
+				NoRoleStatus:   ablib.LookupEnvInt("NO_ROLE_REDIRECT_STATUS", http.StatusTemporaryRedirect),
+				DomainStatus:   ablib.LookupEnvInt("DOMAIN_REDIRECT_STATUS", http.StatusTemporaryRedirect),
+			},
+			StreamDrainTimeout: ablib.LookupEnvDuration("STREAM_DRAIN_TIMEOUT", "10s"),
+			MirrorWorkers:      ablib.LookupEnvInt("MIRROR_WORKERS", 4),
+			MirrorQueueSize:    ablib.LookupEnvInt("MIRROR_QUEUE_SIZE", 100),
+			ErrorPages:         errorPages,
+		},
+		HealthConfig: health.Config{
+			SyncInterval: ablib.LookupEnvDuration("HEALTH_SYNC_INTERVAL", "10s"),
+		},
+		IdentityConfig: identity.Config{
+			Providers:       oidcProviders,
+			BaseURL:         ablib.LookupEnv("OIDC_REDIRECT_BASE_URL", domain),
+			DefaultRedirect: ablib.LookupEnv("OIDC_LOGIN_REDIRECT", "/home"),
+			Session: identity.Session{
+				Secret: ablib.LookupEnv("COOKIE_SCRET", "something-secret"),
+				Name:   ablib.LookupEnv("COOKIE_NAME", "cookie-name"),
+				Domain: ablib.LookupEnv("COOKIE_DOMAIN", "cookie-domain"),
+				MaxAge: ablib.LookupEnvInt("COOKIE_MAX_AGE", 3600),
+			},
 		},
+		AccountConfig: account.Config{
+			Secret:      ablib.LookupEnv("ACCOUNT_TOKEN_SECRET", "insecure-key"),
+			ResetURL:    ablib.LookupEnv("PASSWORD_RESET_URL", domain+"/home/reset-password"),
+			VerifyURL:   ablib.LookupEnv("EMAIL_VERIFY_URL", domain+"/home/verify-email"),
+			ActivateURL: ablib.LookupEnv("ACTIVATION_URL", domain+"/home/activate"),
+			ResetTTL:    ablib.LookupEnvDuration("PASSWORD_RESET_TTL", "1h"),
+			VerifyTTL:   ablib.LookupEnvDuration("EMAIL_VERIFY_TTL", "48h"),
+			ActivateTTL: ablib.LookupEnvDuration("ACTIVATION_TTL", "168h"),
+		},
+		Mail: mailer.NewSMTP(mailer.Config{
+			From:     ablib.LookupEnv("SENDER_EMAIL", "gateway@gateway.org"),
+			Password: ablib.LookupEnv("SENDER_PASSWORD", "default-password"),
+			Server:   ablib.LookupEnv("SMTP_SERVER", "smtp.gmail.com"),
+			Port:     ablib.LookupEnvInt("SMTP_PORT", 587),
+		}),
+		TrustedProxies: trustedProxies,
 	})
 
 	r := src.Router(services, db)
@@ -106,30 +172,15 @@ func main() {
 			r,
 		),
 		ablib.WithSignals(),
+		services.Proxy().Routes(),
+		services.Proxy().IPRules(),
+		services.Proxy().Streams(),
+		services.Proxy().Mirrors(),
 		ablib.WithPrometheus(
 			ablib.LookupEnv("HTTP_PROM_ADDR", "0.0.0.0"),
 			ablib.LookupEnvInt("HTTP_PROM_PORT", 2112),
 		),
-		ablib.HeartBeat(
-			ablib.WithRequestPath("/healthcheck"),
-			ablib.WithClientTimeout(5*time.Second),
-			ablib.WithInterval(ablib.LookupEnvDuration("HEARTBEAT_INTERVAL", "10s")),
-			ablib.WithErrorIncrement(ablib.LookupEnvDuration("HEARTBEAT_ERROR_INCREMENT", "5s")),
-			ablib.WithFetchServiceFunction(func(ctx context.Context) ([]ablib.Service, error) {
-				services, err := db.GetServices(ctx)
-				if err != nil {
-					return nil, nil
-				}
-				output := make([]ablib.Service, len(services))
-				for i, s := range services {
-					output[i] = s
-				}
-				return output, nil
-			}),
-			ablib.WithUpdateServiceStatusFunction(func(ctx context.Context, u uuid.UUID, s string) error {
-				return db.UpdateServiceStatus(ctx, u, s)
-			}),
-		),
+		services.Health(),
 	)
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -147,6 +198,11 @@ func main() {
 		if !errors.Is(err, ablib.ErrSignalReceived) {
 			log.Ctx(ctx).Error().Err(err).Msg("error received")
 		}
+		// Streams are drained before the http server closes their
+		// connections, the core stops its components concurrently.
+		if err := services.Proxy().Streams().Drain(ctx); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("drain streams")
+		}
 		err = lcore.Shutdown(ctx)
 		if err != nil {
 			log.Ctx(ctx).Error().Err(err).Msg("shutdown error received")
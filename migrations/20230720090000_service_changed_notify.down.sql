@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS "service_changed_update" ON "service";
+DROP TRIGGER IF EXISTS "service_changed_insert_delete" ON "service";
+DROP FUNCTION IF EXISTS notify_service_changed();
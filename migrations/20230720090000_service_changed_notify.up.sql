@@ -0,0 +1,21 @@
+CREATE OR REPLACE FUNCTION notify_service_changed() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('service_changed', OLD.id::TEXT);
+    ELSE
+        PERFORM pg_notify('service_changed', NEW.id::TEXT);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "service_changed_insert_delete"
+AFTER INSERT OR DELETE ON "service"
+FOR EACH ROW EXECUTE FUNCTION notify_service_changed();
+
+-- Status updates come from the health checks and do not change routing.
+CREATE TRIGGER "service_changed_update"
+AFTER UPDATE ON "service"
+FOR EACH ROW
+WHEN ((to_jsonb(OLD) - 'status' - 'updated_at') IS DISTINCT FROM (to_jsonb(NEW) - 'status' - 'updated_at'))
+EXECUTE FUNCTION notify_service_changed();
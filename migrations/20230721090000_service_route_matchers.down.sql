@@ -0,0 +1,6 @@
+ALTER TABLE "service"
+DROP COLUMN "headers",
+DROP COLUMN "methods";
+
+ALTER TABLE "service" ADD CONSTRAINT "service_domain_key" UNIQUE ("domain");
+ALTER TABLE "service" ADD CONSTRAINT "service_prefix_key" UNIQUE ("prefix");
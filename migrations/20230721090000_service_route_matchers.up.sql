@@ -0,0 +1,8 @@
+-- Services may now share a prefix or a domain when their matchers differ,
+-- conflicts are detected by the gateway when a service is created.
+ALTER TABLE "service" DROP CONSTRAINT IF EXISTS "service_prefix_key";
+ALTER TABLE "service" DROP CONSTRAINT IF EXISTS "service_domain_key";
+
+ALTER TABLE "service"
+ADD COLUMN "methods" TEXT[] DEFAULT '{}',
+ADD COLUMN "headers" JSONB;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS "service_target_status";
+
+ALTER TABLE "service"
+DROP COLUMN "load_balancing",
+DROP COLUMN "targets";
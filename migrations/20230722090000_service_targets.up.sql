@@ -0,0 +1,11 @@
+ALTER TABLE "service"
+ADD COLUMN "targets" JSONB,
+ADD COLUMN "load_balancing" TEXT NOT NULL DEFAULT 'round_robin';
+
+CREATE TABLE "service_target_status" (
+    "service_id" UUID REFERENCES "service" ("id") ON DELETE CASCADE,
+    "url" TEXT NOT NULL,
+    "status" TEXT NOT NULL,
+    "checked_at" TIMESTAMP DEFAULT NOW() NOT NULL,
+    PRIMARY KEY ("service_id", "url")
+);
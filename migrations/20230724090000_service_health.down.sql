@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS "service_health_event";
+
+ALTER TABLE "service"
+DROP COLUMN "health_check";
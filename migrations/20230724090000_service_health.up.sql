@@ -0,0 +1,14 @@
+ALTER TABLE "service"
+ADD COLUMN "health_check" JSONB;
+
+CREATE TABLE "service_health_event" (
+    "id" BIGSERIAL PRIMARY KEY,
+    "service_id" UUID NOT NULL REFERENCES "service" ("id") ON DELETE CASCADE,
+    "target_url" TEXT NOT NULL,
+    "status" TEXT NOT NULL,
+    "detail" TEXT NOT NULL DEFAULT '',
+    "created_at" TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX "service_health_event_service_id_created_at_idx"
+ON "service_health_event" ("service_id", "created_at" DESC);
@@ -0,0 +1,3 @@
+ALTER TABLE "service"
+DROP COLUMN "retry_policy",
+DROP COLUMN "circuit_breaker";
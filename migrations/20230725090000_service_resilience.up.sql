@@ -0,0 +1,3 @@
+ALTER TABLE "service"
+ADD COLUMN "retry_policy" JSONB,
+ADD COLUMN "circuit_breaker" JSONB;
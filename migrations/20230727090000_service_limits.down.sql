@@ -0,0 +1,4 @@
+ALTER TABLE "service"
+DROP COLUMN "limits",
+DROP COLUMN "request_headers",
+DROP COLUMN "response_headers";
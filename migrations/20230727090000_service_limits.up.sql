@@ -0,0 +1,4 @@
+ALTER TABLE "service"
+ADD COLUMN "limits" JSONB,
+ADD COLUMN "request_headers" JSONB,
+ADD COLUMN "response_headers" JSONB;
@@ -0,0 +1,2 @@
+ALTER TABLE "service"
+DROP COLUMN "canary";
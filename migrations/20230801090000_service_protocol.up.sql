@@ -0,0 +1,2 @@
+ALTER TABLE "service"
+ADD COLUMN "protocol" TEXT NOT NULL DEFAULT 'http1';
@@ -0,0 +1,2 @@
+ALTER TABLE "service"
+ADD COLUMN "compression" JSONB;
@@ -0,0 +1,3 @@
+ALTER TABLE "service"
+DROP COLUMN IF EXISTS "maintenance",
+DROP COLUMN IF EXISTS "error_pages";
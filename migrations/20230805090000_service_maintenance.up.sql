@@ -0,0 +1,3 @@
+ALTER TABLE "service"
+ADD COLUMN "maintenance" JSONB,
+ADD COLUMN "error_pages" JSONB;
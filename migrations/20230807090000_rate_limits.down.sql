@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS "quota_usage";
+
+ALTER TABLE "service"
+DROP COLUMN IF EXISTS "rate_limit";
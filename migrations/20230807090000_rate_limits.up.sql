@@ -0,0 +1,11 @@
+ALTER TABLE "service"
+ADD COLUMN "rate_limit" JSONB;
+
+CREATE TABLE "quota_usage" (
+    "user_id" UUID NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "service_id" UUID NOT NULL REFERENCES "service" ("id") ON DELETE CASCADE,
+    "period" DATE NOT NULL,
+    "used" BIGINT NOT NULL DEFAULT 0,
+    "updated_at" TIMESTAMP DEFAULT NOW() NOT NULL,
+    PRIMARY KEY ("user_id", "service_id", "period")
+);
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS "ip_rules_changed" ON "ip_rule";
+DROP FUNCTION IF EXISTS notify_ip_rules_changed();
+DROP TABLE IF EXISTS "ip_rule";
+
+ALTER TABLE "service"
+DROP COLUMN IF EXISTS "ip_rules";
@@ -0,0 +1,20 @@
+ALTER TABLE "service"
+ADD COLUMN "ip_rules" JSONB;
+
+CREATE TABLE "ip_rule" (
+    "id" UUID PRIMARY KEY,
+    "cidr" TEXT NOT NULL UNIQUE,
+    "comment" TEXT NOT NULL DEFAULT '',
+    "created_at" TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION notify_ip_rules_changed() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('ip_rules_changed', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "ip_rules_changed"
+AFTER INSERT OR UPDATE OR DELETE ON "ip_rule"
+FOR EACH STATEMENT EXECUTE FUNCTION notify_ip_rules_changed();
@@ -0,0 +1,12 @@
+CREATE TABLE "api_key" (
+    "id" UUID PRIMARY KEY,
+    "user_id" UUID NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "name" TEXT NOT NULL DEFAULT '',
+    "prefix" TEXT NOT NULL UNIQUE,
+    "hash" TEXT NOT NULL,
+    "service_ids" UUID[] NOT NULL DEFAULT '{}',
+    "expires_at" TIMESTAMP,
+    "created_at" TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX "api_key_user_id_idx" ON "api_key" ("user_id");
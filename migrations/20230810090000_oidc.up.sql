@@ -0,0 +1,24 @@
+CREATE TABLE "oidc_provider" (
+    "name" TEXT PRIMARY KEY,
+    "kind" TEXT NOT NULL,
+    "issuer" TEXT NOT NULL DEFAULT '',
+    "auth_url" TEXT NOT NULL DEFAULT '',
+    "token_url" TEXT NOT NULL DEFAULT '',
+    "userinfo_url" TEXT NOT NULL DEFAULT '',
+    "client_id" TEXT NOT NULL,
+    "client_secret" TEXT NOT NULL,
+    "scopes" TEXT[] NOT NULL DEFAULT '{}',
+    "created_at" TIMESTAMP DEFAULT NOW() NOT NULL,
+    "updated_at" TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE "user_identity" (
+    "provider" TEXT NOT NULL,
+    "subject" TEXT NOT NULL,
+    "user_id" UUID NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "email" TEXT NOT NULL,
+    "created_at" TIMESTAMP DEFAULT NOW() NOT NULL,
+    PRIMARY KEY ("provider", "subject")
+);
+
+CREATE INDEX "user_identity_user_id_idx" ON "user_identity" ("user_id");
@@ -0,0 +1,13 @@
+ALTER TABLE "user" ADD COLUMN "email_verified_at" TIMESTAMP;
+
+CREATE TABLE "user_token" (
+    "hash" TEXT PRIMARY KEY,
+    "user_id" UUID NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+    "purpose" TEXT NOT NULL,
+    "email" TEXT NOT NULL,
+    "expires_at" TIMESTAMP NOT NULL,
+    "used_at" TIMESTAMP,
+    "created_at" TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX "user_token_user_id_idx" ON "user_token" ("user_id", "purpose");
@@ -0,0 +1 @@
+ALTER TABLE "user" ALTER COLUMN "is_new" DROP NOT NULL;
@@ -0,0 +1,6 @@
+-- The users created before the activation links got their password by
+-- email, they are active.
+UPDATE "user" SET "is_new" = false WHERE "password" <> '';
+
+UPDATE "user" SET "is_new" = true WHERE "is_new" IS NULL;
+ALTER TABLE "user" ALTER COLUMN "is_new" SET NOT NULL;
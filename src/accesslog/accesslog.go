@@ -0,0 +1,85 @@
+// Package accesslog logs one line per request, along with the fields the
+// handlers annotate it with such as the routing decisions of the proxy.
+package accesslog
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+type ctxKey struct{}
+
+type fields struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// Annotate adds a field to the access log line of the request of ctx. It is
+// a no-op outside of Middleware.
+func Annotate(ctx context.Context, key string, value interface{}) {
+	f, ok := ctx.Value(ctxKey{}).(*fields)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	f.values[key] = value
+	f.mu.Unlock()
+}
+
+// Middleware logs the requests once served, and the panics they raised.
+func Middleware(logger *zerolog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.With().Logger()
+
+			f := &fields{values: make(map[string]interface{})}
+			r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, f))
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			start := time.Now()
+			defer func() {
+				if rec := recover(); rec != nil {
+					log.Error().
+						Str("type", "error").
+						Timestamp().
+						Interface("recover_info", rec).
+						Bytes("debug_stack", debug.Stack()).
+						Msg("log system error")
+					http.Error(ww, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+
+				f.mu.Lock()
+				defer f.mu.Unlock()
+
+				log.Info().
+					Str("type", "access").
+					Timestamp().
+					Fields(map[string]interface{}{
+						"request_id": middleware.GetReqID(r.Context()),
+						"remote_ip":  forwarded.ClientIP(r),
+						"url":        r.URL.Path,
+						"proto":      r.Proto,
+						"method":     r.Method,
+						"user_agent": r.Header.Get("User-Agent"),
+						"status":     ww.Status(),
+						"latency_ms": float64(time.Since(start).Nanoseconds()) / 1000000.0,
+						"bytes_in":   r.Header.Get("Content-Length"),
+						"bytes_out":  ww.BytesWritten(),
+					}).
+					Fields(f.values).
+					Msg("incoming_request")
+			}()
+
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
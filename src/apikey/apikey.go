@@ -0,0 +1,208 @@
+// Package apikey authenticates the machine clients of the proxied services
+// with the API keys of their users.
+//
+// A key reads gw_<prefix>_<secret>: the prefix finds the key in the
+// database, which only stores the SHA-256 hash of the whole key.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/accesslog"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Scheme starts every key.
+const Scheme = "gw_"
+
+// HeaderAPIKey carries a key, as does an Authorization bearer token.
+const HeaderAPIKey = "X-API-Key"
+
+var (
+	// ErrMalformed is returned for the keys not generated by the gateway.
+	ErrMalformed = errors.New("malformed api key")
+	// ErrInvalid is returned for the unknown and expired keys.
+	ErrInvalid = errors.New("invalid api key")
+)
+
+// Generate returns a new key, its prefix and its hash.
+func Generate() (key, prefix, hash string, err error) {
+	b := make([]byte, 4+32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+
+	prefix = Scheme + hex.EncodeToString(b[:4])
+	key = prefix + "_" + base64.RawURLEncoding.EncodeToString(b[4:])
+	return key, prefix, Hash(key), nil
+}
+
+// Hash returns the hash stored for key.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Prefix returns the prefix of key.
+func Prefix(key string) (string, error) {
+	rest, ok := strings.CutPrefix(key, Scheme)
+	if !ok {
+		return "", ErrMalformed
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(id) != 8 || secret == "" {
+		return "", ErrMalformed
+	}
+	return Scheme + id, nil
+}
+
+// FromRequest returns the key sent with r, in X-API-Key or as a bearer
+// token starting with gw_.
+func FromRequest(r *http.Request) (string, bool) {
+	if key := strings.TrimSpace(r.Header.Get(HeaderAPIKey)); key != "" {
+		return key, true
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		token = strings.TrimSpace(token)
+		if strings.HasPrefix(token, Scheme) {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// Strip removes the key sent in h, in X-API-Key or as a bearer token
+// starting with gw_. Other Authorization headers are left to the services.
+func Strip(h http.Header) {
+	h.Del(HeaderAPIKey)
+
+	scheme, token, ok := strings.Cut(h.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") && strings.HasPrefix(strings.TrimSpace(token), Scheme) {
+		h.Del("Authorization")
+	}
+}
+
+// Store finds the keys and their users.
+type Store interface {
+	GetAPIKeyByPrefix(ctx context.Context, prefix string) (models.APIKey, error)
+	GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error)
+}
+
+// Authenticator authenticates the requests carrying an API key.
+type Authenticator struct {
+	store Store
+	now   func() time.Time
+}
+
+func New(store Store) *Authenticator {
+	return &Authenticator{store: store, now: time.Now}
+}
+
+// Authenticate returns the key and the user of key.
+func (a *Authenticator) Authenticate(ctx context.Context, key string) (models.APIKey, models.User, error) {
+	prefix, err := Prefix(key)
+	if err != nil {
+		return models.APIKey{}, models.User{}, err
+	}
+
+	k, err := a.store.GetAPIKeyByPrefix(ctx, prefix)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.APIKey{}, models.User{}, ErrInvalid
+	}
+	if err != nil {
+		return models.APIKey{}, models.User{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(Hash(key)), []byte(k.Hash)) != 1 {
+		return models.APIKey{}, models.User{}, ErrInvalid
+	}
+	if k.Expired(a.now()) {
+		return models.APIKey{}, models.User{}, fmt.Errorf("%w: expired", ErrInvalid)
+	}
+
+	// The keys of deleted users are left behind, they no longer authenticate.
+	user, err := a.store.GetUserByID(ctx, k.UserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.APIKey{}, models.User{}, ErrInvalid
+	}
+	if err != nil {
+		return models.APIKey{}, models.User{}, fmt.Errorf("failed to get api key user: %w", err)
+	}
+
+	return k, user, nil
+}
+
+// Middleware authenticates the requests carrying an API key and hands the
+// other ones to fallback. The key is removed from the request so that it
+// never reaches the services.
+func (a *Authenticator) Middleware(fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		otherwise := fallback(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := FromRequest(r)
+			if !ok {
+				otherwise.ServeHTTP(w, r)
+				return
+			}
+			r.Header.Del(HeaderAPIKey)
+			r.Header.Del("Authorization")
+
+			k, user, err := a.Authenticate(r.Context(), key)
+			if errors.Is(err, ErrMalformed) || errors.Is(err, ErrInvalid) {
+				log.Ctx(r.Context()).Error().Err(err).Msg("Unauthorized")
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid api key", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Ctx(r.Context()).Err(err).Send()
+				http.Error(w, "server error", http.StatusInternalServerError)
+				return
+			}
+
+			accesslog.Annotate(r.Context(), "api_key", k.Prefix)
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), k, user)))
+		})
+	}
+}
+
+type ctxKey struct{}
+
+// NewContext returns ctx authenticated as user with k, as the cookie
+// authentication would.
+func NewContext(ctx context.Context, k models.APIKey, user models.User) context.Context {
+	ctx = context.WithValue(ctx, ctxKey{}, k)
+	ctx = context.WithValue(ctx, ablibhttp.UserIDCtxKey, user.GetID())
+	ctx = context.WithValue(ctx, ablibhttp.ExternalIDCtxKey, user.GetExternalID())
+	ctx = context.WithValue(ctx, ablibhttp.UserEmail, user.GetEmail())
+	ctx = context.WithValue(ctx, ablibhttp.UserFirstname, user.GetFirstname())
+	ctx = context.WithValue(ctx, ablibhttp.UserLastname, user.GetLastname())
+	ctx = context.WithValue(ctx, ablibhttp.UserRole, user.GetRole())
+	ctx = context.WithValue(ctx, ablibhttp.UserCreatedAt, user.GetCreatedAt())
+	ctx = context.WithValue(ctx, ablibhttp.UserUpdatedAt, user.GetUpdatedAt())
+	ctx = context.WithValue(ctx, ablibhttp.UserDeletedAt, user.GetDeletedAt())
+	return ctx
+}
+
+// FromContext returns the key authenticating the request of ctx.
+func FromContext(ctx context.Context) (models.APIKey, bool) {
+	k, ok := ctx.Value(ctxKey{}).(models.APIKey)
+	return k, ok
+}
@@ -0,0 +1,8 @@
+package apikey
+
+import "time"
+
+// SetNow replaces the clock of the authenticator.
+func (a *Authenticator) SetNow(now func() time.Time) {
+	a.now = now
+}
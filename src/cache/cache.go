@@ -0,0 +1,310 @@
+// Package cache stores the responses of the proxied services, following
+// their Cache-Control, Expires and Vary headers, and revalidates stale
+// entries with their ETag or Last-Modified validators.
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	BackendMemory = "memory"
+	BackendDisk   = "disk"
+)
+
+const (
+	resultHit         = "HIT"
+	resultMiss        = "MISS"
+	resultRevalidated = "REVALIDATED"
+	resultBypass      = "BYPASS"
+)
+
+type Config struct {
+	// Backend is either memory or disk.
+	Backend string
+	// MemorySize bounds the memory backend, in bytes.
+	MemorySize int64
+	// DiskPath is the directory of the disk backend.
+	DiskPath string
+}
+
+// NewStore returns the store of the configured backend.
+func NewStore(cfg Config) (Store, error) {
+	switch cfg.Backend {
+	case BackendMemory, "":
+		return NewMemoryStore(cfg.MemorySize), nil
+	case BackendDisk:
+		if cfg.DiskPath == "" {
+			return nil, fmt.Errorf("disk cache requires a path")
+		}
+		return NewDiskStore(cfg.DiskPath), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Backend)
+	}
+}
+
+type Cache struct {
+	store Store
+	now   func() time.Time
+}
+
+func New(store Store) *Cache {
+	return &Cache{store: store, now: time.Now}
+}
+
+// Purge removes the entries of a service.
+func (c *Cache) Purge(serviceID string) error {
+	return c.store.Purge(serviceID)
+}
+
+// Handler serves the requests of service from the cache when possible and
+// stores the responses of next otherwise. variant further partitions the
+// entries, as the backend version serving the request. It is a no-op when
+// the cache of the service is disabled.
+func (c *Cache) Handler(service models.Service, variant string, next http.Handler) http.Handler {
+	if c == nil || service.Cache == nil || !service.Cache.Enabled {
+		return next
+	}
+
+	cfg := service.Cache.WithDefaults()
+	partition := service.ID.String()
+	// Responses to authenticated requests are only stored when they allow
+	// shared caches explicitly.
+	authenticated := len(service.RequiredRoles) > 0
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqCC := cacheControl(r.Header)
+		if _, ok := reqCC["no-store"]; ok {
+			c.count(service.Name, resultBypass)
+			w.Header().Set("X-Cache", resultBypass)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := variant + "\x00" + r.Host + r.URL.RequestURI()
+		if cfg.VaryByPlan {
+			key += "\x00" + r.Header.Get("X-Plan-Metadata")
+		}
+
+		entry, entryKey := c.lookup(r, partition, key)
+
+		_, noCache := reqCC["no-cache"]
+		maxAge, hasMaxAge := seconds(reqCC["max-age"])
+		forceRevalidate := noCache || (hasMaxAge && maxAge == 0)
+
+		now := c.now()
+		if entry != nil && !forceRevalidate && now.Before(entry.Expires) {
+			c.count(service.Name, resultHit)
+			c.serve(w, r, entry, resultHit)
+			return
+		}
+
+		shared := authenticated || r.Header.Get("Authorization") != ""
+		cw := newCaptureWriter(w, cfg.MaxEntrySize)
+
+		upstreamReq := r
+		revalidating := entry != nil && hasValidator(entry)
+		if revalidating {
+			cw.interceptNotModified = true
+			upstreamReq = conditional(r, entry)
+		}
+
+		next.ServeHTTP(cw, upstreamReq)
+
+		if revalidating && cw.status == http.StatusNotModified {
+			updated := c.refresh(entry, cw.header, shared)
+			if updated != nil {
+				c.set(r, partition, entryKey, updated)
+				entry = updated
+			}
+			c.count(service.Name, resultRevalidated)
+			c.serve(w, r, entry, resultRevalidated)
+			return
+		}
+
+		c.count(service.Name, resultMiss)
+
+		if r.Method != http.MethodGet || cw.overflow || !cacheableStatus(cw.status) {
+			return
+		}
+
+		ttl, ok := freshness(cw.header, now, shared)
+		if !ok {
+			return
+		}
+
+		stored := &Entry{
+			Status:   cw.status,
+			Header:   storedHeader(cw.header),
+			Body:     cw.body.Bytes(),
+			StoredAt: now,
+			Expires:  now.Add(ttl),
+		}
+
+		vary := varyHeaders(cw.header)
+		if len(vary) == 0 {
+			c.set(r, partition, key, stored)
+			return
+		}
+
+		c.set(r, partition, key, &Entry{Vary: vary, StoredAt: now, Expires: stored.Expires})
+		c.set(r, partition, variantKey(key, vary, r.Header), stored)
+	})
+}
+
+// lookup returns the entry matching r and its key, following the Vary
+// marker stored at key.
+func (c *Cache) lookup(r *http.Request, partition, key string) (*Entry, string) {
+	entry, err := c.store.Get(partition, key)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to read cache")
+		return nil, key
+	}
+	if entry == nil || len(entry.Vary) == 0 {
+		return entry, key
+	}
+
+	key = variantKey(key, entry.Vary, r.Header)
+	entry, err = c.store.Get(partition, key)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to read cache")
+		return nil, key
+	}
+
+	return entry, key
+}
+
+func (c *Cache) set(r *http.Request, partition, key string, e *Entry) {
+	if err := c.store.Set(partition, key, e); err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to write cache")
+	}
+}
+
+// refresh returns entry updated with the headers of a 304 response, nil
+// when it can no longer be stored.
+func (c *Cache) refresh(entry *Entry, h http.Header, shared bool) *Entry {
+	header := entry.Header.Clone()
+	for name, values := range storedHeader(h) {
+		if name == "Content-Length" {
+			continue
+		}
+		header[name] = values
+	}
+
+	now := c.now()
+	ttl, ok := freshness(header, now, shared)
+	if !ok {
+		return nil
+	}
+
+	return &Entry{
+		Status:   entry.Status,
+		Header:   header,
+		Body:     entry.Body,
+		StoredAt: now,
+		Expires:  now.Add(ttl),
+	}
+}
+
+// serve writes the stored response, or 304 when the conditional headers of
+// r match it.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *Entry, result string) {
+	h := w.Header()
+	for name, values := range e.Header {
+		h[name] = append([]string(nil), values...)
+	}
+
+	age := c.now().Sub(e.StoredAt)
+	if age < 0 {
+		age = 0
+	}
+	h.Set("Age", strconv.Itoa(int(age.Seconds())))
+	h.Set("X-Cache", result)
+
+	if notModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body) //nolint
+	}
+}
+
+func (c *Cache) count(service, result string) {
+	requestsCounter.WithLabelValues(service, strings.ToLower(result)).Inc()
+}
+
+func hasValidator(e *Entry) bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// conditional returns r asking the upstream to revalidate e, the client
+// conditional headers are answered from the entry.
+func conditional(r *http.Request, e *Entry) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.Header.Del("If-None-Match")
+	r2.Header.Del("If-Modified-Since")
+	r2.Header.Del("Cache-Control")
+
+	if etag := e.Header.Get("ETag"); etag != "" {
+		r2.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		r2.Header.Set("If-Modified-Since", lm)
+	}
+
+	return r2
+}
+
+// storedHeader returns the response headers kept in an entry.
+func storedHeader(h http.Header) http.Header {
+	stored := h.Clone()
+	stored.Del("Age")
+	stored.Del("X-Cache")
+	return stored
+}
+
+// varyHeaders returns the canonical request header names of the Vary
+// header of a response.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func variantKey(key string, vary []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,241 @@
+package cache_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/cache"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// cached serves the requests with a cache in front of upstream, the clock
+// is moved with the returned pointer.
+func cached(t *testing.T, service models.Service, upstream http.HandlerFunc) (func(*http.Request) *httptest.ResponseRecorder, *time.Time) {
+	t.Helper()
+
+	if service.ID == uuid.Nil {
+		service.ID = uuid.New()
+	}
+	if service.Cache == nil {
+		service.Cache = &models.CacheConfig{Enabled: true}
+	}
+
+	now := time.Date(2023, 7, 29, 9, 0, 0, 0, time.UTC)
+	c := cache.New(cache.NewMemoryStore(1 << 20))
+	c.SetClock(func() time.Time { return now })
+	h := c.Handler(service, "", upstream)
+
+	return func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}, &now
+}
+
+func get(path string, header ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func TestCacheFreshness(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		hits   bool
+	}{
+		{name: "max-age", header: map[string]string{"Cache-Control": "max-age=60"}, hits: true},
+		{name: "s-maxage", header: map[string]string{"Cache-Control": "max-age=0, s-maxage=60"}, hits: true},
+		{name: "expires", header: map[string]string{"Date": "Sat, 29 Jul 2023 09:00:00 GMT", "Expires": "Sat, 29 Jul 2023 09:01:00 GMT"}, hits: true},
+		{name: "age", header: map[string]string{"Cache-Control": "max-age=60", "Age": "60"}},
+		{name: "no freshness", header: map[string]string{}},
+		{name: "no-store", header: map[string]string{"Cache-Control": "no-store, max-age=60"}},
+		{name: "private", header: map[string]string{"Cache-Control": "private, max-age=60"}},
+		{name: "set-cookie", header: map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "session=1"}},
+		{name: "vary all", header: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			serve, _ := cached(t, models.Service{}, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				io.WriteString(w, "body") //nolint
+			})
+
+			w := serve(get("/resource"))
+			require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+			require.Equal(t, "body", w.Body.String())
+
+			w = serve(get("/resource"))
+			require.Equal(t, "body", w.Body.String())
+			if tt.hits {
+				require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+				require.Equal(t, int32(1), calls)
+			} else {
+				require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+				require.Equal(t, int32(2), calls)
+			}
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	var calls int32
+	serve, now := cached(t, models.Service{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "body") //nolint
+	})
+
+	serve(get("/resource"))
+
+	*now = now.Add(30 * time.Second)
+	w := serve(get("/resource"))
+	require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	require.Equal(t, "30", w.Header().Get("Age"))
+
+	w = serve(get("/resource", "Cache-Control", "no-store"))
+	require.Equal(t, "BYPASS", w.Header().Get("X-Cache"))
+	require.Equal(t, int32(2), calls)
+
+	*now = now.Add(time.Minute)
+	w = serve(get("/resource"))
+	require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	require.Equal(t, int32(3), calls)
+
+	head := httptest.NewRequest(http.MethodHead, "/resource", nil)
+	w = serve(head)
+	require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	require.Equal(t, "4", w.Header().Get("Content-Length"))
+	require.Empty(t, w.Body.String())
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var calls, notModified int32
+	serve, now := cached(t, models.Service{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "body") //nolint
+	})
+
+	serve(get("/resource"))
+
+	// A client holding the entry gets a 304 from the cache.
+	w := serve(get("/resource", "If-None-Match", `"v1"`))
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	require.Empty(t, w.Body.String())
+
+	// Stale entries are revalidated and served from the cache.
+	*now = now.Add(time.Minute)
+	w = serve(get("/resource"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "REVALIDATED", w.Header().Get("X-Cache"))
+	require.Equal(t, "body", w.Body.String())
+	require.Equal(t, int32(1), notModified)
+
+	// The revalidation made the entry fresh again.
+	w = serve(get("/resource"))
+	require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+
+	// no-cache forces the revalidation of a fresh entry.
+	w = serve(get("/resource", "Cache-Control", "no-cache"))
+	require.Equal(t, "REVALIDATED", w.Header().Get("X-Cache"))
+	require.Equal(t, "body", w.Body.String())
+	require.Equal(t, int32(3), calls)
+}
+
+func TestCacheVary(t *testing.T) {
+	var calls int32
+	serve, _ := cached(t, models.Service{Cache: &models.CacheConfig{Enabled: true, VaryByPlan: true}}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, r.Header.Get("Accept-Language")+r.Header.Get("X-Plan-Metadata")) //nolint
+	})
+
+	requests := []*http.Request{
+		get("/resource", "Accept-Language", "en"),
+		get("/resource", "Accept-Language", "fr"),
+		get("/resource", "Accept-Language", "en", "X-Plan-Metadata", `{"tier":"pro"}`),
+	}
+
+	for _, r := range requests {
+		w := serve(r)
+		require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	}
+
+	for _, r := range requests {
+		w := serve(r)
+		require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+		require.Equal(t, r.Header.Get("Accept-Language")+r.Header.Get("X-Plan-Metadata"), w.Body.String())
+	}
+
+	require.Equal(t, int32(3), calls)
+}
+
+func TestCacheSharedResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		hits         bool
+	}{
+		{name: "max-age", cacheControl: "max-age=60"},
+		{name: "public", cacheControl: "public, max-age=60", hits: true},
+		{name: "s-maxage", cacheControl: "s-maxage=60", hits: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serve, _ := cached(t, models.Service{RequiredRoles: []models.Role{"user"}}, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				io.WriteString(w, "body") //nolint
+			})
+
+			serve(get("/resource"))
+			w := serve(get("/resource"))
+			if tt.hits {
+				require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+			} else {
+				require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
+
+func TestCacheEntrySize(t *testing.T) {
+	var calls int32
+	serve, _ := cached(t, models.Service{Cache: &models.CacheConfig{Enabled: true, MaxEntrySize: 4}}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.URL.Query().Get("body")) //nolint
+	})
+
+	serve(get("/?body=small"))
+	w := serve(get("/?body=small"))
+	require.Equal(t, "MISS", w.Header().Get("X-Cache"))
+	require.Equal(t, "small", w.Body.String())
+
+	serve(get("/?body=tiny"))
+	w = serve(get("/?body=tiny"))
+	require.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	require.Equal(t, int32(3), calls)
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl returns the directives of the Cache-Control headers of h.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+func seconds(v string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus lists the statuses stored when the response allows it.
+func cacheableStatus(code int) bool {
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+		http.StatusPermanentRedirect, http.StatusNotFound, http.StatusGone:
+		return true
+	default:
+		return false
+	}
+}
+
+// freshness returns how long a response with the header h can be served
+// without revalidation and whether it can be stored at all. Responses
+// without explicit freshness are only stored to be revalidated when they
+// carry a validator. shared reports whether the response must explicitly
+// allow shared caches, as responses to authenticated requests.
+func freshness(h http.Header, now time.Time, shared bool) (time.Duration, bool) {
+	cc := cacheControl(h)
+
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return 0, false
+	}
+
+	_, public := cc["public"]
+	sMaxAge, hasSMaxAge := seconds(cc["s-maxage"])
+	if shared && !public && !hasSMaxAge {
+		return 0, false
+	}
+
+	validator := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return 0, validator
+	}
+
+	var ttl time.Duration
+	switch maxAge, hasMaxAge := seconds(cc["max-age"]); {
+	case hasSMaxAge:
+		ttl = sMaxAge
+	case hasMaxAge:
+		ttl = maxAge
+	default:
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0, validator
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	}
+
+	if age, ok := seconds(h.Get("Age")); ok {
+		ttl -= age
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return ttl, ttl > 0 || validator
+}
+
+// notModified reports whether the conditional headers of r match the stored
+// response.
+func notModified(r *http.Request, e *Entry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := e.Header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DiskStore is a Store keeping each entry in a file, grouped in a directory
+// per service.
+type DiskStore struct {
+	dir string
+}
+
+func NewDiskStore(dir string) *DiskStore {
+	return &DiskStore{dir: dir}
+}
+
+func (s *DiskStore) path(service, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, filepath.Base(service), hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *DiskStore) Get(service, key string) (*Entry, error) {
+	b, err := os.ReadFile(s.path(service, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache entry: %w", err)
+	}
+
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("failed to decode cache entry: %w", err)
+	}
+
+	return &e, nil
+}
+
+func (s *DiskStore) Set(service, key string, e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+
+	path := s.path(service, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// Write then rename so readers never see a partial entry.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entry-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store cache entry: %w", err)
+	}
+
+	return nil
+}
+
+func (s *DiskStore) Purge(service string) error {
+	if err := os.RemoveAll(filepath.Join(s.dir, filepath.Base(service))); err != nil {
+		return fmt.Errorf("failed to purge cache: %w", err)
+	}
+	return nil
+}
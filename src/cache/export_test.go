@@ -0,0 +1,8 @@
+package cache
+
+import "time"
+
+// SetClock replaces the clock of the cache in the tests.
+func (c *Cache) SetClock(now func() time.Time) {
+	c.now = now
+}
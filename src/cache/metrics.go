@@ -0,0 +1,16 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "gateway",
+	Subsystem: "cache",
+	Name:      "requests_total",
+	Help:      "Total number of cacheable requests by result: hit, miss, revalidated or bypass",
+}, []string{"service", "result"})
+
+func init() {
+	prometheus.MustRegister(requestsCounter)
+}
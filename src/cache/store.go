@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a stored response. An entry with Vary only records the request
+// headers the responses of its key vary on, the responses themselves are
+// stored under the variant keys.
+type Entry struct {
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	Vary     []string    `json:"vary,omitempty"`
+	StoredAt time.Time   `json:"stored_at"`
+	Expires  time.Time   `json:"expires"`
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body)) + 64
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	for _, v := range e.Vary {
+		n += int64(len(v))
+	}
+	return n
+}
+
+// Store keeps the entries of the services.
+type Store interface {
+	// Get returns the entry of key, nil when missing.
+	Get(service, key string) (*Entry, error)
+	Set(service, key string, e *Entry) error
+	// Purge removes every entry of service.
+	Purge(service string) error
+}
+
+// MemoryStore is a Store bounded in size, evicting the least recently used
+// entries first.
+type MemoryStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	service string
+	key     string
+	entry   *Entry
+	size    int64
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) Get(service, key string) (*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[service+"\x00"+key]
+	if !ok {
+		return nil, nil
+	}
+	s.ll.MoveToFront(el)
+
+	return el.Value.(*memoryItem).entry, nil
+}
+
+func (s *MemoryStore) Set(service, key string, e *Entry) error {
+	item := &memoryItem{service: service, key: key, entry: e, size: e.size()}
+	if item.size > s.maxBytes {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := service + "\x00" + key
+	if el, ok := s.items[id]; ok {
+		s.remove(el)
+	}
+
+	s.items[id] = s.ll.PushFront(item)
+	s.size += item.size
+
+	for s.size > s.maxBytes {
+		s.remove(s.ll.Back())
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Purge(service string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for el := s.ll.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*memoryItem).service == service {
+			s.remove(el)
+		}
+		el = next
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) remove(el *list.Element) {
+	item := s.ll.Remove(el).(*memoryItem)
+	delete(s.items, item.service+"\x00"+item.key)
+	s.size -= item.size
+}
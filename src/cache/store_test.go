@@ -0,0 +1,74 @@
+package cache_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/cache"
+	"github.com/stretchr/testify/require"
+)
+
+func entry(body string) *cache.Entry {
+	return &cache.Entry{Status: http.StatusOK, Header: http.Header{}, Body: []byte(body), Expires: time.Now().Add(time.Minute)}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	// Each entry weighs its body plus a fixed overhead of 64 bytes.
+	s := cache.NewMemoryStore(200)
+
+	require.NoError(t, s.Set("svc", "a", entry("aaaa")))
+	require.NoError(t, s.Set("svc", "b", entry("bbbb")))
+
+	// Reading a makes b the least recently used entry.
+	e, err := s.Get("svc", "a")
+	require.NoError(t, err)
+	require.NotNil(t, e)
+
+	require.NoError(t, s.Set("svc", "c", entry("cccc")))
+
+	e, err = s.Get("svc", "b")
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	for _, key := range []string{"a", "c"} {
+		e, err = s.Get("svc", key)
+		require.NoError(t, err)
+		require.NotNil(t, e, key)
+	}
+
+	// Entries larger than the store are not kept.
+	require.NoError(t, s.Set("svc", "big", entry(string(make([]byte, 300)))))
+	e, err = s.Get("svc", "big")
+	require.NoError(t, err)
+	require.Nil(t, e)
+}
+
+func TestStorePurge(t *testing.T) {
+	stores := map[string]cache.Store{
+		"memory": cache.NewMemoryStore(1 << 20),
+		"disk":   cache.NewDiskStore(t.TempDir()),
+	}
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, s.Set("one", "key", entry("1")))
+			require.NoError(t, s.Set("two", "key", entry("2")))
+
+			e, err := s.Get("one", "key")
+			require.NoError(t, err)
+			require.Equal(t, "1", string(e.Body))
+			require.Equal(t, http.StatusOK, e.Status)
+
+			require.NoError(t, s.Purge("one"))
+
+			e, err = s.Get("one", "key")
+			require.NoError(t, err)
+			require.Nil(t, e)
+
+			e, err = s.Get("two", "key")
+			require.NoError(t, err)
+			require.Equal(t, "2", string(e.Body))
+		})
+	}
+}
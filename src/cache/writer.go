@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// captureWriter forwards a response to the client while keeping a copy of
+// its body, up to max bytes. When interceptNotModified is set a 304 response
+// is kept from the client, which is answered from the revalidated entry.
+type captureWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	max    int64
+
+	interceptNotModified bool
+
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func newCaptureWriter(w http.ResponseWriter, max int64) *captureWriter {
+	return &captureWriter{w: w, header: make(http.Header), max: max}
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) intercepted() bool {
+	return cw.interceptNotModified && cw.status == http.StatusNotModified
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	// Informational responses are forwarded as they are.
+	if code >= 100 && code < 200 {
+		copyHeader(cw.w.Header(), cw.header)
+		cw.w.WriteHeader(code)
+		return
+	}
+
+	cw.wroteHeader = true
+	cw.status = code
+	if cw.intercepted() {
+		return
+	}
+
+	copyHeader(cw.w.Header(), cw.header)
+	cw.w.Header().Set("X-Cache", resultMiss)
+	cw.w.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted() {
+		return len(b), nil
+	}
+
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.max {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+
+	return cw.w.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted() {
+		return
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.w
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = values
+	}
+}
@@ -0,0 +1,303 @@
+// Package compression compresses the responses of the gateway with the
+// encoding negotiated from the Accept-Encoding header of the client.
+package compression
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported encodings, in order of preference.
+const (
+	Brotli = "br"
+	Zstd   = "zstd"
+	Gzip   = "gzip"
+)
+
+var preference = []string{Brotli, Zstd, Gzip}
+
+// encoder is implemented by the writers of every encoding.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	Brotli: {New: func() any { return brotli.NewWriterLevel(io.Discard, 4) }},
+	Gzip:   {New: func() any { return gzip.NewWriter(io.Discard) }},
+	Zstd: {New: func() any {
+		// Browsers decode windows of at most 8MB.
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20)) //nolint
+		return w
+	}},
+}
+
+// Middleware compresses the responses of next according to cfg.
+func Middleware(cfg models.Compression) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Handler(cfg, next)
+	}
+}
+
+// Handler compresses the responses of next according to cfg. Responses
+// already encoded, event streams and responses smaller than the minimum
+// size go through unchanged.
+func Handler(cfg models.Compression, next http.Handler) http.Handler {
+	if cfg.Disabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &responseWriter{
+			ResponseWriter: w,
+			cfg:            cfg,
+			encoding:       negotiate(r.Header.Get("Accept-Encoding")),
+			head:           r.Method == http.MethodHead,
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiate returns the preferred encoding among the ones accepted by the
+// client, "" when it accepts none.
+func negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range preference {
+		q, ok := accepted[encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// allowed reports whether responses of contentType are compressed.
+func allowed(contentTypes []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+
+	// Structured syntax suffixes, e.g. application/problem+json, match
+	// their base type.
+	candidates := []string{mediaType}
+	if i := strings.LastIndex(mediaType, "+"); i >= 0 {
+		candidates = append(candidates, "application/"+mediaType[i+1:])
+	}
+
+	for _, t := range contentTypes {
+		for _, c := range candidates {
+			if t == c || (strings.HasSuffix(t, "/*") && strings.HasPrefix(c, strings.TrimSuffix(t, "*"))) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// responseWriter holds the start of the body back until it knows whether
+// to compress it, that is once the body reaches the minimum size.
+type responseWriter struct {
+	http.ResponseWriter
+	cfg      models.Compression
+	encoding string
+	head     bool
+
+	status  int
+	decided bool
+	buf     []byte
+	enc     encoder
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status != 0 || w.decided {
+		return
+	}
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+
+	if !w.eligible() {
+		w.decide(false)
+		return
+	}
+
+	if cl, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+		w.decide(cl >= w.cfg.MinSize)
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.decided {
+		return w.write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if int64(len(w.buf)) < w.cfg.MinSize {
+		return len(p), nil
+	}
+
+	w.decide(true)
+	if err := w.flushBuffer(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *responseWriter) write(p []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// eligible reports whether the response may be compressed, Vary is set on
+// the responses whose encoding depends on the client.
+func (w *responseWriter) eligible() bool {
+	h := w.Header()
+
+	switch {
+	case w.head,
+		w.status == http.StatusNoContent,
+		w.status == http.StatusPartialContent,
+		w.status == http.StatusNotModified,
+		h.Get("Content-Encoding") != "",
+		strings.Contains(h.Get("Cache-Control"), "no-transform"),
+		!allowed(w.cfg.ContentTypes, h.Get("Content-Type")):
+		return false
+	}
+
+	vary(h)
+	return w.encoding != ""
+}
+
+// decide sends the header, with the encoding when compressing.
+func (w *responseWriter) decide(compress bool) {
+	w.decided = true
+
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// The compressed body is another representation.
+		if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("Etag", "W/"+etag)
+		}
+
+		w.enc = encoders[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *responseWriter) flushBuffer() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.write(buf)
+	return err
+}
+
+// Flush sends the body written so far. A body flushed before reaching the
+// minimum size is not compressed, flushing the header alone is deferred to
+// the first write as the reverse proxy does it for every chunked response.
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		if len(w.buf) == 0 {
+			return
+		}
+		w.decide(false)
+	}
+	if err := w.flushBuffer(); err != nil {
+		return
+	}
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(w.ResponseWriter).Flush() //nolint
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close writes the end of the body once the handler returned.
+func (w *responseWriter) close() {
+	if w.status == 0 {
+		return
+	}
+	if !w.decided {
+		w.decide(false)
+	}
+	w.flushBuffer() //nolint
+
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(io.Discard)
+		encoders[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// vary adds Accept-Encoding to the Vary header of h.
+func vary(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
@@ -0,0 +1,164 @@
+package compression_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/compression"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+var body = strings.Repeat("compressible ", 200)
+
+func serve(cfg *models.Compression, h http.HandlerFunc, method, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	w := httptest.NewRecorder()
+	compression.Handler(cfg.WithDefaults(), h).ServeHTTP(w, r)
+	return w
+}
+
+func text(header ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		io.WriteString(w, body) //nolint
+	}
+}
+
+func decode(t *testing.T, encoding string, r io.Reader) string {
+	t.Helper()
+
+	var dec io.Reader
+	switch encoding {
+	case compression.Gzip:
+		gz, err := gzip.NewReader(r)
+		require.NoError(t, err)
+		dec = gz
+	case compression.Brotli:
+		dec = brotli.NewReader(r)
+	case compression.Zstd:
+		zr, err := zstd.NewReader(r)
+		require.NoError(t, err)
+		defer zr.Close()
+		dec = zr
+	default:
+		dec = r
+	}
+
+	b, err := io.ReadAll(dec)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestNegotiation(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{acceptEncoding: "gzip", encoding: compression.Gzip},
+		{acceptEncoding: "gzip, deflate, br", encoding: compression.Brotli},
+		{acceptEncoding: "gzip, zstd", encoding: compression.Zstd},
+		{acceptEncoding: "br;q=0.5, gzip;q=0.8", encoding: compression.Gzip},
+		{acceptEncoding: "*", encoding: compression.Brotli},
+		{acceptEncoding: "*;q=0.1, br;q=0", encoding: compression.Zstd},
+		{acceptEncoding: "deflate", encoding: ""},
+		{acceptEncoding: "gzip;q=0", encoding: ""},
+		{acceptEncoding: "", encoding: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			w := serve(nil, text(), http.MethodGet, tt.acceptEncoding)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.encoding, w.Header().Get("Content-Encoding"))
+			require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			require.Equal(t, body, decode(t, tt.encoding, w.Body))
+			if tt.encoding != "" {
+				require.Less(t, w.Body.Len(), len(body))
+			}
+		})
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *models.Compression
+		handler http.HandlerFunc
+		method  string
+	}{
+		{name: "disabled", cfg: &models.Compression{Disabled: true}, handler: text()},
+		{name: "below min size", cfg: &models.Compression{MinSize: int64(len(body)) + 1}, handler: text()},
+		{name: "content type not allowed", cfg: &models.Compression{ContentTypes: []string{"application/json"}}, handler: text()},
+		{name: "already encoded", handler: text("Content-Encoding", "gzip")},
+		{name: "no-transform", handler: text("Cache-Control", "no-transform")},
+		{name: "event stream", handler: text("Content-Type", "text/event-stream")},
+		{name: "image", handler: text("Content-Type", "image/png")},
+		{name: "head", handler: text(), method: http.MethodHead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			w := serve(tt.cfg, tt.handler, method, "gzip, br")
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NotEqual(t, compression.Brotli, w.Header().Get("Content-Encoding"))
+			if method == http.MethodGet {
+				require.Equal(t, body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCompressedHeaders(t *testing.T) {
+	w := serve(nil, text("Content-Length", "2600", "Etag", `"v1"`, "Vary", "Origin"), http.MethodGet, "gzip")
+
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Empty(t, w.Header().Get("Content-Length"))
+	require.Equal(t, `W/"v1"`, w.Header().Get("Etag"))
+	require.Equal(t, []string{"Origin", "Accept-Encoding"}, w.Header().Values("Vary"))
+	require.Equal(t, body, decode(t, "gzip", w.Body))
+
+	// Structured suffixes match their base type.
+	w = serve(nil, text("Content-Type", "application/problem+json"), http.MethodGet, "gzip")
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+}
+
+func TestFlush(t *testing.T) {
+	// A body flushed before the minimum size is sent uncompressed.
+	w := serve(nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "[") //nolint
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body) //nolint
+	}, http.MethodGet, "gzip")
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Equal(t, "["+body, w.Body.String())
+
+	// Once compressing, every flush sends the data compressed so far.
+	w = serve(nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body) //nolint
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "]") //nolint
+	}, http.MethodGet, "gzip")
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Equal(t, body+"]", decode(t, "gzip", w.Body))
+}
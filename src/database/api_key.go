@@ -0,0 +1,99 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+const apiKeySelectFields = "id, user_id, name, prefix, hash, service_ids, expires_at, created_at"
+
+// CreateAPIKey stores a new API key.
+func (d Database) CreateAPIKey(ctx context.Context, k models.APIKey) (models.APIKey, error) {
+	if k.ServiceIDs == nil {
+		k.ServiceIDs = []uuid.UUID{}
+	}
+
+	query := `
+		INSERT INTO api_key (id, user_id, name, prefix, hash, service_ids, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + apiKeySelectFields
+
+	row := d.db.QueryRow(ctx, query, k.ID, k.UserID, k.Name, k.Prefix, k.Hash, k.ServiceIDs, k.ExpiresAt)
+	created, err := scanAPIKey(row)
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to create api key: %w", err)
+	}
+
+	return created, nil
+}
+
+// GetAPIKeyByPrefix returns the API key starting with prefix, pgx.ErrNoRows
+// when there is none.
+func (d Database) GetAPIKeyByPrefix(ctx context.Context, prefix string) (models.APIKey, error) {
+	query := `
+		SELECT ` + apiKeySelectFields + `
+		FROM api_key
+		WHERE prefix = $1`
+
+	k, err := scanAPIKey(d.db.QueryRow(ctx, query, prefix))
+	if err != nil {
+		return models.APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	return k, nil
+}
+
+// GetUserAPIKeys returns the API keys of a user, most recent first.
+func (d Database) GetUserAPIKeys(ctx context.Context, userID uuid.UUID) ([]models.APIKey, error) {
+	query := `
+		SELECT ` + apiKeySelectFields + `
+		FROM api_key
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id`
+
+	rows, err := d.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over api keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey revokes an API key of a user, it returns false when the user
+// has no such key.
+func (d Database) DeleteAPIKey(ctx context.Context, userID, keyID uuid.UUID) (bool, error) {
+	query := `
+		DELETE FROM api_key
+		WHERE id = $1 AND user_id = $2`
+
+	result, err := d.db.Exec(ctx, query, keyID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete api key: %w", err)
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+func scanAPIKey(row pgx.Row) (models.APIKey, error) {
+	var k models.APIKey
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Hash, &k.ServiceIDs, &k.ExpiresAt, &k.CreatedAt)
+	return k, err
+}
@@ -1,15 +1,31 @@
 package database
 
 import (
+	"github.com/amaurybrisou/gateway/src/secrets"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Database struct {
-	db *pgxpool.Pool
+	db     *pgxpool.Pool
+	cipher *secrets.Cipher
 }
 
-func New(db *pgxpool.Pool) *Database {
-	return &Database{db: db}
+type Option func(*Database)
+
+// WithCipher encrypts the secrets of the services, such as their TLS
+// certificates, with c.
+func WithCipher(c *secrets.Cipher) Option {
+	return func(d *Database) {
+		d.cipher = c
+	}
+}
+
+func New(db *pgxpool.Pool, opts ...Option) *Database {
+	d := &Database{db: db}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
 type localRow interface {
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+)
+
+// AddServiceHealthEvent records a health status change of a service target.
+func (d Database) AddServiceHealthEvent(ctx context.Context, e models.ServiceHealthEvent) error {
+	query := `
+		INSERT INTO service_health_event (service_id, target_url, status, detail)
+		VALUES ($1, $2, $3, $4)`
+
+	if _, err := d.db.Exec(ctx, query, e.ServiceID, e.TargetURL, e.Status, e.Detail); err != nil {
+		return fmt.Errorf("failed to add service health event: %w", err)
+	}
+
+	return nil
+}
+
+// GetServiceHealthEvents returns the latest health events of a service, most
+// recent first.
+func (d Database) GetServiceHealthEvents(ctx context.Context, serviceID uuid.UUID, limit int) ([]models.ServiceHealthEvent, error) {
+	query := `
+		SELECT id, service_id, target_url, status, detail, created_at
+		FROM service_health_event
+		WHERE service_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`
+
+	rows, err := d.db.Query(ctx, query, serviceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query service health events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.ServiceHealthEvent{}
+	for rows.Next() {
+		var e models.ServiceHealthEvent
+		if err := rows.Scan(&e.ID, &e.ServiceID, &e.TargetURL, &e.Status, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan service health event: %w", err)
+		}
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over service health events: %w", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/jackc/pgx/v5"
+)
+
+const oidcProviderSelectFields = "name, kind, issuer, auth_url, token_url, userinfo_url, client_id, client_secret, scopes, created_at, updated_at"
+
+// GetOIDCProviders returns the identity providers configured in the
+// database, their client secrets decrypted.
+func (d Database) GetOIDCProviders(ctx context.Context) ([]models.OIDCProvider, error) {
+	query := `
+		SELECT ` + oidcProviderSelectFields + `
+		FROM oidc_provider
+		ORDER BY name`
+
+	rows, err := d.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query oidc providers: %w", err)
+	}
+	defer rows.Close()
+
+	providers := []models.OIDCProvider{}
+	for rows.Next() {
+		p, err := d.scanOIDCProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over oidc providers: %w", err)
+	}
+
+	return providers, nil
+}
+
+// UpsertOIDCProvider creates or replaces an identity provider, its client
+// secret is encrypted.
+func (d Database) UpsertOIDCProvider(ctx context.Context, p models.OIDCProvider) (models.OIDCProvider, error) {
+	secret, err := d.cipher.Encrypt(p.ClientSecret)
+	if err != nil {
+		return models.OIDCProvider{}, fmt.Errorf("failed to encrypt oidc client secret: %w", err)
+	}
+	if p.Scopes == nil {
+		p.Scopes = []string{}
+	}
+
+	query := `
+		INSERT INTO oidc_provider (name, kind, issuer, auth_url, token_url, userinfo_url, client_id, client_secret, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (name) DO UPDATE SET
+			kind = excluded.kind,
+			issuer = excluded.issuer,
+			auth_url = excluded.auth_url,
+			token_url = excluded.token_url,
+			userinfo_url = excluded.userinfo_url,
+			client_id = excluded.client_id,
+			client_secret = excluded.client_secret,
+			scopes = excluded.scopes,
+			updated_at = now()
+		RETURNING ` + oidcProviderSelectFields
+
+	row := d.db.QueryRow(ctx, query, p.Name, p.Kind, p.Issuer, p.AuthURL, p.TokenURL, p.UserInfoURL, p.ClientID, secret, p.Scopes)
+	return d.scanOIDCProvider(row)
+}
+
+// DeleteOIDCProvider removes an identity provider, it returns false when
+// it does not exist. The identities linked with it are kept.
+func (d Database) DeleteOIDCProvider(ctx context.Context, name string) (bool, error) {
+	result, err := d.db.Exec(ctx, `DELETE FROM oidc_provider WHERE name = $1`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete oidc provider: %w", err)
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+func (d Database) scanOIDCProvider(row pgx.Row) (models.OIDCProvider, error) {
+	var p models.OIDCProvider
+	err := row.Scan(&p.Name, &p.Kind, &p.Issuer, &p.AuthURL, &p.TokenURL, &p.UserInfoURL, &p.ClientID, &p.ClientSecret, &p.Scopes, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return models.OIDCProvider{}, fmt.Errorf("failed to scan oidc provider: %w", err)
+	}
+
+	if p.ClientSecret, err = d.cipher.Decrypt(p.ClientSecret); err != nil {
+		return models.OIDCProvider{}, fmt.Errorf("failed to decrypt oidc client secret: %w", err)
+	}
+
+	return p, nil
+}
+
+// GetUserIdentity returns the identity of subject at provider, a zero
+// identity when it is not linked to a user.
+func (d Database) GetUserIdentity(ctx context.Context, provider, subject string) (models.UserIdentity, error) {
+	query := `
+		SELECT provider, subject, user_id, email, created_at
+		FROM user_identity
+		WHERE provider = $1 AND subject = $2`
+
+	var i models.UserIdentity
+	err := d.db.QueryRow(ctx, query, provider, subject).Scan(&i.Provider, &i.Subject, &i.UserID, &i.Email, &i.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.UserIdentity{}, nil
+	}
+	if err != nil {
+		return models.UserIdentity{}, fmt.Errorf("failed to get user identity: %w", err)
+	}
+
+	return i, nil
+}
+
+// CreateUserIdentity links an identity to its user.
+func (d Database) CreateUserIdentity(ctx context.Context, i models.UserIdentity) error {
+	query := `
+		INSERT INTO user_identity (provider, subject, user_id, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, subject) DO UPDATE SET email = excluded.email`
+
+	if _, err := d.db.Exec(ctx, query, i.Provider, i.Subject, i.UserID, i.Email); err != nil {
+		return fmt.Errorf("failed to create user identity: %w", err)
+	}
+
+	return nil
+}
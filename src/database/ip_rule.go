@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+)
+
+// GetIPRules returns the global deny list, oldest first.
+func (d Database) GetIPRules(ctx context.Context) ([]models.IPRule, error) {
+	query := `
+		SELECT id, cidr, comment, created_at
+		FROM ip_rule
+		ORDER BY created_at, id`
+
+	rows, err := d.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ip rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []models.IPRule{}
+	for rows.Next() {
+		var rule models.IPRule
+		if err := rows.Scan(&rule.ID, &rule.CIDR, &rule.Comment, &rule.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan ip rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over ip rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// CreateIPRule adds rule to the global deny list, the comment of an
+// existing rule for the same CIDR is updated.
+func (d Database) CreateIPRule(ctx context.Context, rule models.IPRule) (models.IPRule, error) {
+	query := `
+		INSERT INTO ip_rule (id, cidr, comment)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (cidr) DO UPDATE SET comment = excluded.comment
+		RETURNING id, cidr, comment, created_at`
+
+	var created models.IPRule
+	err := d.db.QueryRow(ctx, query, rule.ID, rule.CIDR, rule.Comment).
+		Scan(&created.ID, &created.CIDR, &created.Comment, &created.CreatedAt)
+	if err != nil {
+		return models.IPRule{}, fmt.Errorf("failed to create ip rule: %w", err)
+	}
+
+	return created, nil
+}
+
+// DeleteIPRule removes a rule of the global deny list, it returns false when
+// the rule does not exist.
+func (d Database) DeleteIPRule(ctx context.Context, ruleID uuid.UUID) (bool, error) {
+	query := `
+		DELETE FROM ip_rule
+		WHERE id = $1`
+
+	result, err := d.db.Exec(ctx, query, ruleID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete ip rule: %w", err)
+	}
+
+	return result.RowsAffected() == 1, nil
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	ablibmodels "github.com/amaurybrisou/ablib/models"
@@ -27,6 +28,556 @@ const (
 	ServiceStatusOK = "OK"
 )
 
+const (
+	LoadBalancingRoundRobin       = "round_robin"
+	LoadBalancingLeastConnections = "least_connections"
+	LoadBalancingConsistentHash   = "consistent_hash"
+)
+
+// Protocols spoken to the upstream targets.
+const (
+	ProtocolHTTP1 = "http1"
+	// ProtocolH2C is HTTP/2 over cleartext with prior knowledge.
+	ProtocolH2C = "h2c"
+	// ProtocolH2 is HTTP/2 over TLS.
+	ProtocolH2 = "h2"
+	// ProtocolGRPC is HTTP/2, over TLS for the https targets and cleartext
+	// otherwise, keeping the trailers and the streams of the gRPC calls.
+	ProtocolGRPC = "grpc"
+)
+
+// Target is one upstream instance of a service.
+type Target struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusUnhealthy = "unhealthy"
+)
+
+// HealthCheck configures the active health checks of the service targets.
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	ExpectedStatuses   []int    `json:"expected_statuses"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+// WithDefaults returns the health check with its unset fields defaulted.
+func (h *HealthCheck) WithDefaults() HealthCheck {
+	c := HealthCheck{}
+	if h != nil {
+		c = *h
+	}
+	if c.Path == "" {
+		c.Path = "/healthcheck"
+	}
+	if c.Interval <= 0 {
+		c.Interval = Duration(10 * time.Second)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(5 * time.Second)
+	}
+	if len(c.ExpectedStatuses) == 0 {
+		c.ExpectedStatuses = []int{200}
+	}
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = 2
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 3
+	}
+	return c
+}
+
+// RetryPolicy configures how failed idempotent requests are retried on
+// another target.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt, requests are not retried when it
+	// is 1 or less.
+	MaxAttempts int      `json:"max_attempts"`
+	Backoff     Duration `json:"backoff"`
+	MaxBackoff  Duration `json:"max_backoff"`
+	// Budget is the ratio of retries to requests allowed over time, it keeps
+	// retries from piling up on a failing service.
+	Budget float64 `json:"budget"`
+}
+
+// WithDefaults returns the retry policy with its unset fields defaulted.
+func (p *RetryPolicy) WithDefaults() RetryPolicy {
+	c := RetryPolicy{}
+	if p != nil {
+		c = *p
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 1
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = Duration(50 * time.Millisecond)
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = Duration(time.Second)
+	}
+	if c.Budget <= 0 {
+		c.Budget = 0.2
+	}
+	return c
+}
+
+// CircuitBreaker configures the breaker guarding each target of a service.
+type CircuitBreaker struct {
+	// FailureThreshold consecutive failures open the breaker.
+	FailureThreshold int `json:"failure_threshold"`
+	// OpenDuration is how long the target receives no traffic before being
+	// probed again.
+	OpenDuration Duration `json:"open_duration"`
+	// HalfOpenRequests is the number of probe requests let through once the
+	// breaker is half-open.
+	HalfOpenRequests int `json:"half_open_requests"`
+}
+
+// WithDefaults returns the circuit breaker with its unset fields defaulted.
+func (b *CircuitBreaker) WithDefaults() CircuitBreaker {
+	c := CircuitBreaker{}
+	if b != nil {
+		c = *b
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 3
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = Duration(30 * time.Second)
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	return c
+}
+
+// StreamLimits bounds the WebSocket and Server-Sent Events connections of a
+// service.
+type StreamLimits struct {
+	// IdleTimeout ends a stream without traffic in either direction.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// MaxLifetime ends a stream regardless of its traffic, never when zero.
+	MaxLifetime Duration `json:"max_lifetime"`
+}
+
+// WithDefaults returns the stream limits with their unset fields defaulted.
+func (l *StreamLimits) WithDefaults() StreamLimits {
+	c := StreamLimits{}
+	if l != nil {
+		c = *l
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = Duration(5 * time.Minute)
+	}
+	return c
+}
+
+// ServiceLimits bounds the requests proxied to a service. Sizes are in bytes,
+// unlimited when zero.
+type ServiceLimits struct {
+	ConnectTimeout        Duration `json:"connect_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	// Timeout bounds the whole request, streams excepted.
+	Timeout             Duration `json:"timeout"`
+	MaxRequestBodySize  int64    `json:"max_request_body_size"`
+	MaxResponseBodySize int64    `json:"max_response_body_size"`
+}
+
+// WithDefaults returns the limits with their unset timeouts defaulted.
+func (l *ServiceLimits) WithDefaults() ServiceLimits {
+	c := ServiceLimits{}
+	if l != nil {
+		c = *l
+	}
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = Duration(5 * time.Second)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(10 * time.Second)
+	}
+	return c
+}
+
+// Metadata of the plans overriding the rate limits of the services.
+const (
+	MetadataRateLimit    = "rate_limit"
+	MetadataMonthlyQuota = "monthly_quota"
+)
+
+// RateLimit bounds the requests of each user of a service, or of each
+// client address for the services open to anonymous users. The plans
+// override Rate and MonthlyQuota with their rate_limit and monthly_quota
+// metadata.
+type RateLimit struct {
+	// Rate is the limit of each user, as "100/m", unlimited when empty.
+	Rate string `json:"rate"`
+	// AnonymousRate is the limit of each client address of the services
+	// without required roles.
+	AnonymousRate string `json:"anonymous_rate"`
+	// MonthlyQuota is the number of requests of each user per calendar
+	// month, unlimited when zero.
+	MonthlyQuota int64 `json:"monthly_quota"`
+}
+
+const (
+	RewriteStrip   = "strip"
+	RewriteKeep    = "keep"
+	RewriteReplace = "replace"
+	RewriteRegex   = "regex"
+)
+
+// Rewrite configures how the request path is rewritten for the upstream, the
+// prefix is stripped by default.
+type Rewrite struct {
+	Mode string `json:"mode"`
+	// BasePath replaces the prefix in replace mode.
+	BasePath string `json:"base_path"`
+	// Rules rewrite the request path in regex mode, the first matching rule
+	// applies.
+	Rules []RewriteRule `json:"rules"`
+	// ResponseRules rewrite the Location and Set-Cookie paths in regex mode.
+	ResponseRules []RewriteRule `json:"response_rules"`
+}
+
+// RewriteRule replaces a path matching the Match regular expression with
+// Replace, which can refer to the capture groups as $1 or ${name}.
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// HeaderRules edits the headers of a request or a response. Remove is
+// applied first, then Set which replaces the values and Add which appends
+// them.
+type HeaderRules struct {
+	Add    map[string]string `json:"add"`
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+// CacheConfig enables the response cache of a service. Responses are stored
+// according to their Cache-Control, Expires and Vary headers.
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// VaryByPlan keys the entries by the plan metadata of the user as well.
+	VaryByPlan bool `json:"vary_by_plan"`
+	// MaxEntrySize is the largest response body stored, in bytes.
+	MaxEntrySize int64 `json:"max_entry_size"`
+}
+
+// WithDefaults returns the cache configuration with its unset fields
+// defaulted, a nil configuration disables the cache.
+func (c *CacheConfig) WithDefaults() CacheConfig {
+	cfg := CacheConfig{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.MaxEntrySize <= 0 {
+		cfg.MaxEntrySize = 1 << 20
+	}
+	return cfg
+}
+
+// Mirror copies a share of the traffic of a service to a shadow upstream,
+// whose responses are discarded.
+type Mirror struct {
+	Host string `json:"host"`
+	// Percentage of the requests mirrored, from 0 to 100.
+	Percentage float64  `json:"percentage"`
+	Timeout    Duration `json:"timeout"`
+	// MaxBodySize is the largest request body mirrored, in bytes.
+	MaxBodySize int64 `json:"max_body_size"`
+}
+
+// WithDefaults returns the mirror with its unset fields defaulted.
+func (m *Mirror) WithDefaults() Mirror {
+	c := Mirror{}
+	if m != nil {
+		c = *m
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = Duration(5 * time.Second)
+	}
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = 1 << 20
+	}
+	return c
+}
+
+const (
+	StickyUser   = "user"
+	StickyCookie = "cookie"
+)
+
+// Canary splits the traffic of a service between several backend versions
+// according to their weights.
+type Canary struct {
+	Versions []Version `json:"versions"`
+	// Sticky keeps the users on the version they were first sent to, by
+	// user id or by a cookie set by the gateway. Requests are split at
+	// random when empty.
+	Sticky string `json:"sticky"`
+	// Cookie names the cookie of the cookie stickiness.
+	Cookie string `json:"cookie"`
+}
+
+// CookieName returns the name of the stickiness cookie.
+func (c Canary) CookieName() string {
+	if c.Cookie == "" {
+		return "gw_backend_version"
+	}
+	return c.Cookie
+}
+
+// Version is a named backend of a service, its targets replace the targets
+// of the service for the requests routed to it.
+type Version struct {
+	Name    string   `json:"name"`
+	Weight  int      `json:"weight"`
+	Host    string   `json:"host"`
+	Targets []Target `json:"targets"`
+}
+
+func (v Version) Upstreams() []Target {
+	if len(v.Targets) > 0 {
+		return v.Targets
+	}
+	return []Target{{URL: v.Host, Weight: 1}}
+}
+
+// Maintenance takes a service out of service, the gateway answers its
+// requests with a 503 page without calling the upstream.
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+	// RetryAfter is sent to the clients when set.
+	RetryAfter Duration `json:"retry_after"`
+}
+
+// Compression configures the compression of the responses of a service by
+// the gateway, it is enabled unless disabled.
+type Compression struct {
+	Disabled bool `json:"disabled"`
+	// ContentTypes are the media types compressed, "text/*" matches every
+	// text type.
+	ContentTypes []string `json:"content_types"`
+	// MinSize is the smallest body compressed, in bytes.
+	MinSize int64 `json:"min_size"`
+}
+
+// WithDefaults returns the compression with its unset fields defaulted.
+func (c *Compression) WithDefaults() Compression {
+	cfg := Compression{}
+	if c != nil {
+		cfg = *c
+	}
+	if len(cfg.ContentTypes) == 0 {
+		cfg.ContentTypes = []string{
+			"text/*",
+			"application/json",
+			"application/javascript",
+			"application/xml",
+			"application/wasm",
+			"image/svg+xml",
+		}
+	}
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = 1024
+	}
+	return cfg
+}
+
+// Patch operations of a PatchRule.
+const (
+	PatchAdd     = "add"
+	PatchReplace = "replace"
+	PatchRemove  = "remove"
+)
+
+// Variables a PatchRule can take its value from.
+const (
+	VariableUserID    = "user_id"
+	VariablePlan      = "plan"
+	VariableRequestID = "request_id"
+)
+
+// Transform edits the JSON bodies of the requests and responses of a service.
+type Transform struct {
+	Request  []PatchRule `json:"request"`
+	Response []PatchRule `json:"response"`
+	// Transformers names the transformers compiled in the gateway that are
+	// applied after the rules, in order.
+	Transformers []string `json:"transformers"`
+	// MaxBodySize is the largest JSON body patched, in bytes. Larger bodies
+	// go through unchanged.
+	MaxBodySize int64 `json:"max_body_size"`
+}
+
+// WithDefaults returns the transform with its unset fields defaulted.
+func (t *Transform) WithDefaults() Transform {
+	c := Transform{}
+	if t != nil {
+		c = *t
+	}
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = 1 << 20
+	}
+	return c
+}
+
+// PatchRule is a JSON patch operation on the member at Path, a JSON pointer.
+// Rules that do not apply to a body are skipped.
+type PatchRule struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// Variable takes the value from the request in place of Value, the rule
+	// is skipped when the request has none.
+	Variable string `json:"variable,omitempty"`
+}
+
+// UpstreamTLS configures the connections to the https targets of a service,
+// the certificates and the key are PEM encoded and stored encrypted.
+type UpstreamTLS struct {
+	// CACert verifies the targets in place of the system roots.
+	CACert string `json:"ca_cert"`
+	// ClientCert and ClientKey authenticate the gateway for mutual TLS.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	// ServerName overrides the name sent with SNI and verified against the
+	// certificate of the targets.
+	ServerName string `json:"server_name"`
+	// InsecureSkipVerify disables the verification of the targets.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// Signing makes the gateway sign the identity headers it forwards to a
+// service, so the service can tell them from headers forged by the clients
+// reaching it directly. The secret is stored encrypted.
+type Signing struct {
+	Secret string `json:"secret"`
+}
+
+// IPRules restricts the clients of a service by address. Deny takes
+// precedence over Allow, and every client is allowed when Allow is empty.
+type IPRules struct {
+	// Allow lists the CIDRs and addresses allowed to reach the service.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists the CIDRs and addresses denied.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// IPRule is an entry of the global deny list, applied to every service.
+type IPRule struct {
+	ID        uuid.UUID `json:"id"`
+	CIDR      string    `json:"cidr"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey authenticates the scripts of a user. Only the hash of the key is
+// stored, the prefix finds it.
+type APIKey struct {
+	ID     uuid.UUID `json:"id"`
+	UserID uuid.UUID `json:"user_id"`
+	Name   string    `json:"name"`
+	Prefix string    `json:"prefix"`
+	Hash   string    `json:"-"`
+	// ServiceIDs restricts the key to these services, any service when
+	// empty.
+	ServiceIDs []uuid.UUID `json:"service_ids"`
+	ExpiresAt  *time.Time  `json:"expires_at"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// Allows reports whether the key may reach the service.
+func (k APIKey) Allows(serviceID uuid.UUID) bool {
+	if len(k.ServiceIDs) == 0 {
+		return true
+	}
+	for _, id := range k.ServiceIDs {
+		if id == serviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key has expired at now.
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// Kinds of identity providers.
+const (
+	OIDCKindOIDC   = "oidc"
+	OIDCKindGoogle = "google"
+	OIDCKindGitHub = "github"
+)
+
+// OIDCProvider is an identity provider users log in with. The endpoints of
+// the OpenID Connect providers are discovered from their issuer when empty.
+type OIDCProvider struct {
+	Name         string     `json:"name"`
+	Kind         string     `json:"kind"`
+	Issuer       string     `json:"issuer,omitempty"`
+	AuthURL      string     `json:"auth_url,omitempty"`
+	TokenURL     string     `json:"token_url,omitempty"`
+	UserInfoURL  string     `json:"userinfo_url,omitempty"`
+	ClientID     string     `json:"client_id"`
+	ClientSecret string     `json:"client_secret,omitempty"`
+	Scopes       []string   `json:"scopes,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    *time.Time `json:"updated_at"`
+}
+
+// UserIdentity links the account of a user at an identity provider to the
+// user.
+type UserIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Purposes of the user tokens.
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposeActivation        = "activation"
+)
+
+// UserToken is a single use token emailed to a user, for instance to reset
+// the password. Only its hash is stored, it is only valid for the email it
+// was sent to.
+type UserToken struct {
+	Hash      string     `json:"-"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Purpose   string     `json:"purpose"`
+	Email     string     `json:"email"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ServiceHealthEvent records a target becoming healthy or unhealthy.
+type ServiceHealthEvent struct {
+	ID        int64     `json:"id"`
+	ServiceID uuid.UUID `json:"service_id"`
+	TargetURL string    `json:"target_url"`
+	Status    string    `json:"status"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 type Service struct {
 	ID                         uuid.UUID `json:"id"`
 	Name                       string    `json:"name"`
@@ -38,6 +589,43 @@ type Service struct {
 	PricingTableKey            string    `json:"pricing_table_key"`
 	PricingTablePublishableKey string    `json:"pricing_table_publishable_key"`
 
+	// Methods restricts the service to these HTTP methods, any method when empty.
+	Methods []string `json:"methods"`
+	// Headers restricts the service to requests carrying these headers, an
+	// empty value only requires the header to be present.
+	Headers map[string]string `json:"headers"`
+
+	// Targets are the upstream instances of the service, Host is used when
+	// empty.
+	Targets       []Target          `json:"targets"`
+	LoadBalancing string            `json:"load_balancing"`
+	Protocol      string            `json:"protocol"`
+	TLS           *UpstreamTLS      `json:"tls"`
+	TargetStatus  map[string]string `json:"target_status"`
+	// Signing signs the identity headers forwarded to the service.
+	Signing *Signing `json:"signing"`
+
+	HealthCheck    *HealthCheck    `json:"health_check"`
+	RetryPolicy    *RetryPolicy    `json:"retry_policy"`
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker"`
+	Streaming      *StreamLimits   `json:"streaming"`
+
+	Rewrite         *Rewrite       `json:"rewrite"`
+	Limits          *ServiceLimits `json:"limits"`
+	RateLimit       *RateLimit     `json:"rate_limit"`
+	IPRules         *IPRules       `json:"ip_rules"`
+	RequestHeaders  *HeaderRules   `json:"request_headers"`
+	ResponseHeaders *HeaderRules   `json:"response_headers"`
+	Cache           *CacheConfig   `json:"cache"`
+	Mirror          *Mirror        `json:"mirror"`
+	Canary          *Canary        `json:"canary"`
+	Transform       *Transform     `json:"transform"`
+	Compression     *Compression   `json:"compression"`
+	Maintenance     *Maintenance   `json:"maintenance"`
+	// ErrorPages are the html/template sources of the error pages of the
+	// service, keyed by status.
+	ErrorPages map[string]string `json:"error_pages"`
+
 	RetryCount int `json:"-"`
 
 	RequiredRoles []Role     `json:"required_roles"`
@@ -53,6 +641,35 @@ func (s Service) GetHost() string {
 	return s.Host
 }
 
+// Upstreams returns the targets of the service, falling back to Host.
+func (s Service) Upstreams() []Target {
+	if len(s.Targets) > 0 {
+		return s.Targets
+	}
+	return []Target{{URL: s.Host, Weight: 1}}
+}
+
+// AllUpstreams returns the targets of the service and of its versions.
+func (s Service) AllUpstreams() []Target {
+	var targets []Target
+	if s.Host != "" || len(s.Targets) > 0 {
+		targets = append(targets, s.Upstreams()...)
+	}
+	if s.Canary != nil {
+		for _, v := range s.Canary.Versions {
+			targets = append(targets, v.Upstreams()...)
+		}
+	}
+	return targets
+}
+
+// ForVersion returns the service routed to the targets of version v.
+func (s Service) ForVersion(v Version) Service {
+	s.Host = v.Host
+	s.Targets = v.Targets
+	return s
+}
+
 func (s Service) GetRetryCount() int {
 	return s.RetryCount
 }
@@ -83,19 +700,20 @@ func (s Service) HasRole(r Role) bool {
 }
 
 type User struct {
-	ID         uuid.UUID               `json:"id"`
-	ExternalID string                  `json:"external_id"`
-	Email      string                  `json:"email"`
-	AvatarURL  string                  `json:"avatar"`
-	Firstname  string                  `json:"firstname"`
-	Lastname   string                  `json:"lastname"`
-	Password   string                  `json:"-"`
-	Role       ablibmodels.GatewayRole `json:"role"`
-	StripeKey  *string                 `json:"-"`
-	IsNew      string                  `json:"-"`
-	CreatedAt  time.Time               `json:"created_at"`
-	UpdatedAt  *time.Time              `json:"updated_at"`
-	DeletedAt  *time.Time              `json:"deleted_at"`
+	ID              uuid.UUID               `json:"id"`
+	ExternalID      string                  `json:"external_id"`
+	Email           string                  `json:"email"`
+	AvatarURL       string                  `json:"avatar"`
+	Firstname       string                  `json:"firstname"`
+	Lastname        string                  `json:"lastname"`
+	Password        string                  `json:"-"`
+	Role            ablibmodels.GatewayRole `json:"role"`
+	StripeKey       *string                 `json:"-"`
+	IsNew           bool                    `json:"-"`
+	EmailVerifiedAt *time.Time              `json:"email_verified_at"`
+	CreatedAt       time.Time               `json:"created_at"`
+	UpdatedAt       *time.Time              `json:"updated_at"`
+	DeletedAt       *time.Time              `json:"deleted_at"`
 }
 
 func (u User) GetID() uuid.UUID {
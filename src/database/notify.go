@@ -0,0 +1,44 @@
+package database
+
+import (
+	"context"
+	"fmt"
+)
+
+// ServiceChangedChannel is the channel the service table trigger notifies on.
+const ServiceChangedChannel = "service_changed"
+
+// IPRulesChangedChannel is the channel the ip_rule table trigger notifies on.
+const IPRulesChangedChannel = "ip_rules_changed"
+
+// ListenServiceChanges blocks until ctx is done or the connection fails,
+// calling onChange every time a service is created, updated or deleted.
+func (d Database) ListenServiceChanges(ctx context.Context, onChange func(ctx context.Context)) error {
+	return d.listen(ctx, ServiceChangedChannel, onChange)
+}
+
+// ListenIPRuleChanges blocks until ctx is done or the connection fails,
+// calling onChange every time the global deny list is modified.
+func (d Database) ListenIPRuleChanges(ctx context.Context, onChange func(ctx context.Context)) error {
+	return d.listen(ctx, IPRulesChangedChannel, onChange)
+}
+
+func (d Database) listen(ctx context.Context, channel string, onChange func(ctx context.Context)) error {
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire listen connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+
+	for {
+		if _, err := conn.Conn().WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+
+		onChange(ctx)
+	}
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// IncrementQuotaUsage counts a request of userID to serviceID in the month
+// starting at period, unless quota requests were already counted. It returns
+// the requests counted and whether the quota was already exhausted.
+func (d Database) IncrementQuotaUsage(ctx context.Context, userID, serviceID uuid.UUID, period time.Time, quota int64) (int64, bool, error) {
+	query := `
+		INSERT INTO quota_usage (user_id, service_id, period, used)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (user_id, service_id, period) DO UPDATE
+		SET used = quota_usage.used + 1, updated_at = NOW()
+		WHERE quota_usage.used < $4
+		RETURNING used`
+
+	var used int64
+	err := d.db.QueryRow(ctx, query, userID, serviceID, period, quota).Scan(&used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return quota, true, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to increment quota usage: %w", err)
+	}
+
+	return used, false, nil
+}
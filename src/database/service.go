@@ -15,14 +15,24 @@ import (
 
 const (
 	serviceSelectFields     = "id, name, description, prefix, domain, host, image_url, status, required_roles"
-	serviceSelectFieldsFull = "id, name, description, prefix, domain, host, image_url, status, required_roles, pricing_table_key, pricing_table_publishable_key, created_at, updated_at, deleted_at, required_roles = '{}' as has_access"
-	serviceInsertFields     = "id, name, description, prefix, domain, host, image_url, status, required_roles, pricing_table_key, pricing_table_publishable_key, created_at"
+	serviceSelectFieldsFull = "id, name, description, prefix, domain, host, image_url, status, required_roles, pricing_table_key, pricing_table_publishable_key, created_at, updated_at, deleted_at, required_roles = '{}' as has_access, methods, headers, targets, load_balancing, (SELECT jsonb_object_agg(url, status) FROM service_target_status WHERE service_id = service.id) as target_status, health_check, retry_policy, circuit_breaker, streaming, limits, request_headers, response_headers, rewrite, cache, mirror, canary, protocol, tls, transform, compression, maintenance, error_pages, signing, rate_limit, ip_rules"
+	serviceInsertFields     = "id, name, description, prefix, domain, host, image_url, status, required_roles, pricing_table_key, pricing_table_publishable_key, created_at, methods, headers, targets, load_balancing, health_check, retry_policy, circuit_breaker, streaming, limits, request_headers, response_headers, rewrite, cache, mirror, canary, protocol, tls, transform, compression, maintenance, error_pages, signing, rate_limit, ip_rules"
 )
 
 func (d Database) CreateService(ctx context.Context, s models.Service) (models.Service, error) {
+	upstreamTLS, err := d.encryptTLS(s.TLS)
+	if err != nil {
+		return models.Service{}, err
+	}
+
+	signing, err := d.encryptSigning(s.Signing)
+	if err != nil {
+		return models.Service{}, err
+	}
+
 	query := `
 	INSERT INTO service (` + serviceInsertFields + `)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36)
 	ON CONFLICT (name) DO UPDATE
 	SET domain = excluded.domain,
 		prefix = excluded.prefix,
@@ -31,7 +41,31 @@ func (d Database) CreateService(ctx context.Context, s models.Service) (models.S
 		image_url = excluded.image_url,
 		description = excluded.description,
 		pricing_table_key = excluded.pricing_table_key,
-		pricing_table_publishable_key = excluded.pricing_table_publishable_key
+		pricing_table_publishable_key = excluded.pricing_table_publishable_key,
+		methods = excluded.methods,
+		headers = excluded.headers,
+		targets = excluded.targets,
+		load_balancing = excluded.load_balancing,
+		health_check = excluded.health_check,
+		retry_policy = excluded.retry_policy,
+		circuit_breaker = excluded.circuit_breaker,
+		streaming = excluded.streaming,
+		limits = excluded.limits,
+		request_headers = excluded.request_headers,
+		response_headers = excluded.response_headers,
+		rewrite = excluded.rewrite,
+		cache = excluded.cache,
+		mirror = excluded.mirror,
+		canary = excluded.canary,
+		protocol = excluded.protocol,
+		tls = excluded.tls,
+		transform = excluded.transform,
+		compression = excluded.compression,
+		maintenance = excluded.maintenance,
+		error_pages = excluded.error_pages,
+		signing = excluded.signing,
+		rate_limit = excluded.rate_limit,
+		ip_rules = excluded.ip_rules
 	RETURNING ` + serviceSelectFieldsFull
 
 	row := d.db.QueryRow(
@@ -49,13 +83,48 @@ func (d Database) CreateService(ctx context.Context, s models.Service) (models.S
 		s.PricingTableKey,
 		s.PricingTablePublishableKey,
 		time.Now(),
+		pq.Array(s.Methods),
+		s.Headers,
+		s.Targets,
+		s.LoadBalancing,
+		s.HealthCheck,
+		s.RetryPolicy,
+		s.CircuitBreaker,
+		s.Streaming,
+		s.Limits,
+		s.RequestHeaders,
+		s.ResponseHeaders,
+		s.Rewrite,
+		s.Cache,
+		s.Mirror,
+		s.Canary,
+		s.Protocol,
+		upstreamTLS,
+		s.Transform,
+		s.Compression,
+		s.Maintenance,
+		s.ErrorPages,
+		signing,
+		s.RateLimit,
+		s.IPRules,
 	)
 
-	s, err := scanServiceFull(row)
+	s, err = d.scanServiceFull(row)
 	if err != nil {
 		return models.Service{}, fmt.Errorf("failed to create service: %w", err)
 	}
 
+	upstreams := s.AllUpstreams()
+	urls := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		urls[i] = u.URL
+	}
+
+	_, err = d.db.Exec(ctx, `DELETE FROM service_target_status WHERE service_id = $1 AND url <> ALL($2)`, s.ID, urls)
+	if err != nil {
+		return models.Service{}, fmt.Errorf("failed to clean service target status: %w", err)
+	}
+
 	return s, nil
 }
 
@@ -82,7 +151,7 @@ func (d *Database) GetServiceByID(ctx context.Context, serviceID uuid.UUID) (mod
 
 	row := d.db.QueryRow(ctx, query, serviceID)
 
-	service, err := scanServiceFull(row)
+	service, err := d.scanServiceFull(row)
 	if err != nil {
 		// Handle the error (e.g., return an error response, log the error)
 		return models.Service{}, err
@@ -100,7 +169,7 @@ func (d *Database) GetServiceByName(ctx context.Context, serviceName string) (mo
 
 	row := d.db.QueryRow(ctx, query, serviceName)
 
-	service, err := scanServiceFull(row)
+	service, err := d.scanServiceFull(row)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return models.Service{}, nil
@@ -122,7 +191,7 @@ func (d Database) GetServices(ctx context.Context) ([]*models.Service, error) {
 
 	var services []*models.Service
 	for rows.Next() {
-		service, err := scanServiceFull(rows)
+		service, err := d.scanServiceFull(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan service row: %w", err)
 		}
@@ -157,6 +226,38 @@ func (d *Database) GetServiceByPrefixOrDomain(ctx context.Context, prefix, domai
 	return service, nil
 }
 
+// UpdateServiceCanary replaces the backend versions of a service.
+func (d *Database) UpdateServiceCanary(ctx context.Context, serviceID uuid.UUID, canary *models.Canary) (models.Service, error) {
+	query := `
+		UPDATE service
+		SET canary = $2, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING ` + serviceSelectFieldsFull
+
+	s, err := d.scanServiceFull(d.db.QueryRow(ctx, query, serviceID, canary))
+	if err != nil {
+		return models.Service{}, fmt.Errorf("failed to update service canary: %w", err)
+	}
+
+	return s, nil
+}
+
+// UpdateServiceMaintenance sets the maintenance mode of a service.
+func (d *Database) UpdateServiceMaintenance(ctx context.Context, serviceID uuid.UUID, maintenance *models.Maintenance) (models.Service, error) {
+	query := `
+		UPDATE service
+		SET maintenance = $2, updated_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING ` + serviceSelectFieldsFull
+
+	s, err := d.scanServiceFull(d.db.QueryRow(ctx, query, serviceID, maintenance))
+	if err != nil {
+		return models.Service{}, fmt.Errorf("failed to update service maintenance: %w", err)
+	}
+
+	return s, nil
+}
+
 func (d *Database) UpdateServiceStatus(ctx context.Context, serviceID uuid.UUID, status string) error {
 	query := `
         UPDATE service
@@ -172,6 +273,35 @@ func (d *Database) UpdateServiceStatus(ctx context.Context, serviceID uuid.UUID,
 	return nil
 }
 
+// UpdateServiceTargetStatus records the status of one target and sets the
+// service status to OK as long as one of its targets is healthy.
+func (d *Database) UpdateServiceTargetStatus(ctx context.Context, serviceID uuid.UUID, targetURL, status string) error {
+	query := `
+		INSERT INTO service_target_status (service_id, url, status, checked_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (service_id, url) DO UPDATE
+		SET status = excluded.status, checked_at = excluded.checked_at
+	`
+
+	if _, err := d.db.Exec(ctx, query, serviceID, targetURL, status); err != nil {
+		return fmt.Errorf("failed to update service target status: %w", err)
+	}
+
+	query = `
+		UPDATE service
+		SET status = CASE WHEN EXISTS (
+			SELECT 1 FROM service_target_status WHERE service_id = $1 AND status = $2
+		) THEN $2 ELSE $3 END
+		WHERE id = $1
+	`
+
+	if _, err := d.db.Exec(ctx, query, serviceID, models.ServiceStatusOK, status); err != nil {
+		return fmt.Errorf("failed to update service status: %w", err)
+	}
+
+	return nil
+}
+
 func scanService(row localRow) (models.Service, error) {
 	var service models.Service
 	var nullImage sql.NullString
@@ -198,7 +328,7 @@ func scanService(row localRow) (models.Service, error) {
 	return service, nil
 }
 
-func scanServiceFull(row localRow) (models.Service, error) {
+func (d Database) scanServiceFull(row localRow) (models.Service, error) {
 	var service models.Service
 	var nullImage sql.NullString
 	err := row.Scan(
@@ -217,6 +347,31 @@ func scanServiceFull(row localRow) (models.Service, error) {
 		&service.UpdatedAt,
 		&service.DeletedAt,
 		&service.HasAccess,
+		&service.Methods,
+		&service.Headers,
+		&service.Targets,
+		&service.LoadBalancing,
+		&service.TargetStatus,
+		&service.HealthCheck,
+		&service.RetryPolicy,
+		&service.CircuitBreaker,
+		&service.Streaming,
+		&service.Limits,
+		&service.RequestHeaders,
+		&service.ResponseHeaders,
+		&service.Rewrite,
+		&service.Cache,
+		&service.Mirror,
+		&service.Canary,
+		&service.Protocol,
+		&service.TLS,
+		&service.Transform,
+		&service.Compression,
+		&service.Maintenance,
+		&service.ErrorPages,
+		&service.Signing,
+		&service.RateLimit,
+		&service.IPRules,
 	)
 	if err != nil {
 		return models.Service{}, fmt.Errorf("failed to scan service row: %w", err)
@@ -225,5 +380,77 @@ func scanServiceFull(row localRow) (models.Service, error) {
 	if nullImage.Valid {
 		service.ImageURL = &nullImage.String
 	}
+
+	service.TLS, err = d.decryptTLS(service.TLS)
+	if err != nil {
+		return models.Service{}, err
+	}
+
+	service.Signing, err = d.decryptSigning(service.Signing)
+	if err != nil {
+		return models.Service{}, err
+	}
+
 	return service, nil
 }
+
+// encryptTLS returns a copy of t with its certificates and key encrypted.
+func (d Database) encryptTLS(t *models.UpstreamTLS) (*models.UpstreamTLS, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	out := *t
+	for _, v := range []*string{&out.CACert, &out.ClientCert, &out.ClientKey} {
+		var err error
+		if *v, err = d.cipher.Encrypt(*v); err != nil {
+			return nil, fmt.Errorf("failed to encrypt service tls: %w", err)
+		}
+	}
+
+	return &out, nil
+}
+
+// decryptTLS decrypts in place the certificates and key of t.
+func (d Database) decryptTLS(t *models.UpstreamTLS) (*models.UpstreamTLS, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	for _, v := range []*string{&t.CACert, &t.ClientCert, &t.ClientKey} {
+		var err error
+		if *v, err = d.cipher.Decrypt(*v); err != nil {
+			return nil, fmt.Errorf("failed to decrypt service tls: %w", err)
+		}
+	}
+
+	return t, nil
+}
+
+// encryptSigning returns a copy of s with its secret encrypted.
+func (d Database) encryptSigning(s *models.Signing) (*models.Signing, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	secret, err := d.cipher.Encrypt(s.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt service signing secret: %w", err)
+	}
+
+	return &models.Signing{Secret: secret}, nil
+}
+
+// decryptSigning decrypts in place the secret of s.
+func (d Database) decryptSigning(s *models.Signing) (*models.Signing, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	var err error
+	if s.Secret, err = d.cipher.Decrypt(s.Secret); err != nil {
+		return nil, fmt.Errorf("failed to decrypt service signing secret: %w", err)
+	}
+
+	return s, nil
+}
@@ -13,7 +13,7 @@ import (
 
 const (
 	userSelectFields     = "id, external_id, email, avatar, firstname, lastname, role, stripe_key, created_at"
-	userSelectFieldsFull = "id, external_id, email, avatar, firstname, lastname, role, stripe_key, created_at, updated_at, deleted_at"
+	userSelectFieldsFull = "id, external_id, email, avatar, firstname, lastname, role, stripe_key, created_at, updated_at, deleted_at, email_verified_at, is_new"
 )
 
 func (d Database) CreateUser(ctx context.Context, u models.User) (models.User, error) {
@@ -163,7 +163,7 @@ var (
 )
 
 func (d *Database) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
-	row := d.db.QueryRow(ctx, `SELECT `+userSelectFields+`, password FROM "user" WHERE email = $1 AND deleted_at IS NULL`, email)
+	row := d.db.QueryRow(ctx, `SELECT `+userSelectFields+`, password, is_new FROM "user" WHERE email = $1 AND deleted_at IS NULL`, email)
 	user, err := scanUserWithPassword(row)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -206,6 +206,7 @@ func scanUserWithPassword(row localRow) (u models.User, err error) {
 		&u.StripeKey,
 		&u.CreatedAt,
 		&u.Password,
+		&u.IsNew,
 	)
 	return u, err
 }
@@ -223,6 +224,8 @@ func scanUserFull(row localRow) (u models.User, err error) {
 		&u.CreatedAt,
 		&u.UpdatedAt,
 		&u.DeletedAt,
+		&u.EmailVerifiedAt,
+		&u.IsNew,
 	)
 
 	return u, err
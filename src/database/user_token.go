@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrTokenInvalid is returned for unknown, used or expired user tokens.
+var ErrTokenInvalid = errors.New("invalid or expired token")
+
+// CreateUserToken stores the hash of a token emailed to a user.
+func (d Database) CreateUserToken(ctx context.Context, t models.UserToken) error {
+	query := `
+		INSERT INTO user_token (hash, user_id, purpose, email, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	if _, err := d.db.Exec(ctx, query, t.Hash, t.UserID, t.Purpose, t.Email, t.ExpiresAt); err != nil {
+		return fmt.Errorf("failed to create user token: %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword uses the token of the given purpose to set the password of
+// its user. The other tokens of the purpose are revoked, and the email is
+// verified since the user received the token. ErrTokenInvalid is returned
+// when the token is unknown, used, expired or sent to a former email.
+func (d Database) ResetPassword(ctx context.Context, purpose, hash, password string) (models.User, error) {
+	query := `
+		WITH token AS (
+			UPDATE user_token SET used_at = now()
+			WHERE hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+			RETURNING user_id AS token_user_id, email AS token_email
+		), revoked AS (
+			UPDATE user_token t SET used_at = now()
+			FROM token
+			WHERE t.user_id = token.token_user_id AND t.purpose = $2 AND t.used_at IS NULL AND t.hash <> $1
+		)
+		UPDATE "user" u
+		SET password = $3, is_new = false, email_verified_at = COALESCE(u.email_verified_at, now()), updated_at = now()
+		FROM token
+		WHERE u.id = token.token_user_id AND u.email = token.token_email AND u.deleted_at IS NULL
+		RETURNING ` + userSelectFieldsFull
+
+	user, err := scanUserFull(d.db.QueryRow(ctx, query, hash, purpose, password))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.User{}, ErrTokenInvalid
+		}
+		return models.User{}, fmt.Errorf("failed to reset password: %w", err)
+	}
+
+	return user, nil
+}
+
+// VerifyEmail uses an email verification token to mark the email of its
+// user as verified. ErrTokenInvalid is returned when the token is unknown,
+// used, expired or sent to a former email.
+func (d Database) VerifyEmail(ctx context.Context, hash string) (models.User, error) {
+	query := `
+		WITH token AS (
+			UPDATE user_token SET used_at = now()
+			WHERE hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+			RETURNING user_id AS token_user_id, email AS token_email
+		)
+		UPDATE "user" u
+		SET email_verified_at = COALESCE(u.email_verified_at, now()), updated_at = now()
+		FROM token
+		WHERE u.id = token.token_user_id AND u.email = token.token_email AND u.deleted_at IS NULL
+		RETURNING ` + userSelectFieldsFull
+
+	user, err := scanUserFull(d.db.QueryRow(ctx, query, hash, models.TokenPurposeEmailVerification))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return models.User{}, ErrTokenInvalid
+		}
+		return models.User{}, fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	return user, nil
+}
@@ -0,0 +1,250 @@
+// Package errorpage renders the errors of the gateway as HTML pages for the
+// browsers, as JSON for the API clients and as plain text otherwise.
+package errorpage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// Statuses are the statuses rendered with a page, the other errors are
+// written as text.
+var Statuses = []int{
+	http.StatusNotFound,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+//go:embed default.html
+var defaultPage string
+
+var defaultTemplate = template.Must(template.New("default").Parse(defaultPage))
+
+// Data is passed to the templates.
+type Data struct {
+	Status    int
+	Title     string
+	Message   string
+	Service   string
+	RequestID string
+}
+
+// Pages holds the global error pages, a nil Pages renders the built-in page.
+type Pages struct {
+	global map[int]*template.Template
+
+	mu       sync.Mutex
+	services map[[sha256.Size]byte]*template.Template
+}
+
+// New loads the global pages from the <status>.html files of dir, the
+// statuses without a file use the built-in page.
+func New(dir string) (*Pages, error) {
+	p := &Pages{
+		global:   make(map[int]*template.Template),
+		services: make(map[[sha256.Size]byte]*template.Template),
+	}
+	if dir == "" {
+		return p, nil
+	}
+
+	for _, status := range Statuses {
+		path := filepath.Join(dir, strconv.Itoa(status)+".html")
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read error page: %w", err)
+		}
+
+		t, err := template.New(path).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse error page %s: %w", path, err)
+		}
+		p.global[status] = t
+	}
+
+	return p, nil
+}
+
+// Validate checks the error page templates of a service.
+func Validate(pages map[string]string) error {
+	for status, src := range pages {
+		code, err := strconv.Atoi(status)
+		if err != nil || !rendered(code) {
+			return fmt.Errorf("no error page for status %q", status)
+		}
+		if _, err := template.New(status).Parse(src); err != nil {
+			return fmt.Errorf("invalid error page %s: %w", status, err)
+		}
+	}
+	return nil
+}
+
+// Write answers r with status and message, as the page of service when it
+// has one for status.
+func (p *Pages) Write(w http.ResponseWriter, r *http.Request, service *models.Service, status int, message string) {
+	data := Data{
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   message,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+	if service != nil {
+		data.Service = service.Name
+	}
+
+	switch accepted(r) {
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{ //nolint
+			"status":     status,
+			"error":      data.Title,
+			"message":    message,
+			"request_id": data.RequestID,
+		})
+		return
+	case "text/html":
+		if t := p.template(service, status); t != nil {
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				log.Ctx(r.Context()).Error().Err(err).Int("status", status).Msg("render error page")
+				break
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(status)
+			w.Write(buf.Bytes()) //nolint
+			return
+		}
+	}
+
+	if message == "" {
+		message = data.Title
+	}
+	http.Error(w, message, status)
+}
+
+// template returns the template of status, nil when status has no page.
+func (p *Pages) template(service *models.Service, status int) *template.Template {
+	if !rendered(status) {
+		return nil
+	}
+
+	if service != nil {
+		if src, ok := service.ErrorPages[strconv.Itoa(status)]; ok {
+			if t := p.parse(src); t != nil {
+				return t
+			}
+		}
+	}
+
+	if p != nil {
+		if t, ok := p.global[status]; ok {
+			return t
+		}
+	}
+
+	return defaultTemplate
+}
+
+// parse returns the template of src, parsed once.
+func (p *Pages) parse(src string) *template.Template {
+	if p == nil {
+		t, err := template.New("service").Parse(src)
+		if err != nil {
+			return nil
+		}
+		return t
+	}
+
+	key := sha256.Sum256([]byte(src))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.services[key]; ok {
+		return t
+	}
+
+	t, err := template.New("service").Parse(src)
+	if err != nil {
+		t = nil
+	}
+	p.services[key] = t
+
+	return t
+}
+
+// PrefersHTML reports whether the client of r prefers an HTML page, that is
+// whether it is a browser.
+func PrefersHTML(r *http.Request) bool {
+	return accepted(r) == "text/html"
+}
+
+func rendered(status int) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// accepted returns the media type of the error answered to r: JSON for the
+// clients preferring it, HTML for the browsers and "" for the others.
+func accepted(r *http.Request) string {
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch {
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case mediaType == "text/html":
+			htmlQ = q
+		}
+	}
+
+	switch {
+	case jsonQ > 0 && jsonQ >= htmlQ:
+		return "application/json"
+	case htmlQ > 0:
+		return "text/html"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,94 @@
+package errorpage_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/errorpage"
+	"github.com/stretchr/testify/require"
+)
+
+func write(p *errorpage.Pages, service *models.Service, accept string, status int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+
+	w := httptest.NewRecorder()
+	p.Write(w, r, service, status, "down for upgrade")
+	return w
+}
+
+func TestNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{name: "json", accept: "application/json", status: http.StatusServiceUnavailable, contentType: "application/json"},
+		{name: "problem json", accept: "application/problem+json", status: http.StatusBadGateway, contentType: "application/json"},
+		{name: "browser", accept: "text/html,application/xhtml+xml,*/*;q=0.8", status: http.StatusNotFound, contentType: "text/html; charset=utf-8"},
+		{name: "json preferred", accept: "text/html;q=0.5, application/json", status: http.StatusServiceUnavailable, contentType: "application/json"},
+		{name: "html without page", accept: "text/html", status: http.StatusRequestEntityTooLarge, contentType: "text/plain; charset=utf-8"},
+		{name: "curl", accept: "*/*", status: http.StatusGatewayTimeout, contentType: "text/plain; charset=utf-8"},
+		{name: "no accept", status: http.StatusServiceUnavailable, contentType: "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := write(nil, nil, tt.accept, tt.status)
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	w := write(nil, nil, "application/json", http.StatusServiceUnavailable)
+
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	require.Equal(t, float64(http.StatusServiceUnavailable), body["status"])
+	require.Equal(t, "Service Unavailable", body["error"])
+	require.Equal(t, "down for upgrade", body["message"])
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "503.html"), []byte(`global {{.Status}}`), 0o600))
+
+	p, err := errorpage.New(dir)
+	require.NoError(t, err)
+
+	// The built-in page is used for the statuses without a file.
+	w := write(p, nil, "text/html", http.StatusBadGateway)
+	require.Contains(t, w.Body.String(), "Bad Gateway")
+
+	w = write(p, nil, "text/html", http.StatusServiceUnavailable)
+	require.Equal(t, "global 503", w.Body.String())
+
+	// The pages of the service take precedence and are escaped.
+	service := &models.Service{Name: "api", ErrorPages: map[string]string{"503": `{{.Service}}: {{.Message}} <b>`}}
+	w = write(p, service, "text/html", http.StatusServiceUnavailable)
+	require.Equal(t, "api: down for upgrade <b>", w.Body.String())
+
+	_, err = errorpage.New(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "404.html"), []byte(`{{.Status`), 0o600))
+	_, err = errorpage.New(dir)
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, errorpage.Validate(map[string]string{"503": "<p>{{.Message}}</p>"}))
+	require.Error(t, errorpage.Validate(map[string]string{"500": "<p></p>"}))
+	require.Error(t, errorpage.Validate(map[string]string{"abc": "<p></p>"}))
+	require.Error(t, errorpage.Validate(map[string]string{"404": "{{.Message"}))
+}
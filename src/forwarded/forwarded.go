@@ -0,0 +1,227 @@
+// Package forwarded resolves the client of the requests received through
+// trusted proxies, and writes the forwarding headers sent to the services.
+//
+// The X-Forwarded-*, X-Real-IP and RFC 7239 Forwarded headers are only
+// read when the request comes from a trusted proxy, and only the hops added
+// by trusted proxies are kept: the client is the first hop, from the right,
+// that is not a trusted proxy, whatever the hops on its left claim.
+package forwarded
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers read and written.
+const (
+	HeaderForwarded = "Forwarded"
+	HeaderFor       = "X-Forwarded-For"
+	HeaderHost      = "X-Forwarded-Host"
+	HeaderProto     = "X-Forwarded-Proto"
+	HeaderRealIP    = "X-Real-IP"
+)
+
+// Proxies are the trusted proxies, a nil list trusts none.
+type Proxies struct {
+	nets []*net.IPNet
+}
+
+// ParseProxies parses a comma separated list of CIDRs and IP addresses.
+func ParseProxies(list string) (*Proxies, error) {
+	p := &Proxies{}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		p.nets = append(p.nets, n)
+	}
+
+	return p, nil
+}
+
+// Trusts reports whether addr is a trusted proxy.
+func (p *Proxies) Trusts(addr string) bool {
+	if p == nil {
+		return false
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Info describes how a request reached the gateway.
+type Info struct {
+	// Client is the address of the client.
+	Client string
+	// For are the addresses of the client and of the trusted proxies in
+	// front of the peer of the gateway, the X-Forwarded-For sent to the
+	// services before the peer is appended.
+	For []string
+	// Forwarded are the Forwarded elements sent to the services, the one
+	// of the gateway last.
+	Forwarded []string
+	// Proto and Host are the scheme and the host requested by the client.
+	Proto string
+	Host  string
+}
+
+type ctxKey struct{}
+
+// Middleware resolves the client of the requests, it replaces
+// middleware.RealIP which trusts the headers of any client.
+func (p *Proxies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := p.Resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, info)))
+	})
+}
+
+// FromRequest returns the Info resolved by the middleware, or resolved
+// without trusting any proxy when r did not go through it.
+func FromRequest(r *http.Request) Info {
+	if info, ok := r.Context().Value(ctxKey{}).(Info); ok {
+		return info
+	}
+	return (*Proxies)(nil).Resolve(r)
+}
+
+// ClientIP returns the address of the client of r.
+func ClientIP(r *http.Request) string {
+	return FromRequest(r).Client
+}
+
+// Resolve returns how r reached the gateway.
+func (p *Proxies) Resolve(r *http.Request) Info {
+	peer := hostOnly(r.RemoteAddr)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	own := element{addr: peer, host: r.Host, proto: proto}
+	info := Info{Client: peer, Proto: proto, Host: r.Host}
+
+	var hops []element
+	if p.Trusts(peer) {
+		hops = incoming(r.Header)
+	}
+
+	// Walk the hops from the right while they are trusted proxies.
+	i := len(hops)
+	for i > 0 && p.Trusts(hops[i-1].addr) {
+		i--
+	}
+	if i > 0 {
+		i--
+	}
+	hops = hops[i:]
+
+	for _, h := range hops {
+		info.For = append(info.For, h.addr)
+		info.Forwarded = append(info.Forwarded, h.String())
+	}
+	info.Forwarded = append(info.Forwarded, own.String())
+
+	if len(hops) > 0 {
+		client := hops[0]
+		info.Client = client.addr
+		switch {
+		case client.proto != "":
+			info.Proto = client.proto
+		case validProto(first(r.Header.Get(HeaderProto))):
+			info.Proto = strings.ToLower(first(r.Header.Get(HeaderProto)))
+		}
+		switch {
+		case client.host != "":
+			info.Host = client.host
+		case validHost(first(r.Header.Get(HeaderHost))):
+			info.Host = first(r.Header.Get(HeaderHost))
+		}
+	}
+
+	return info
+}
+
+// SetHeaders replaces the forwarding headers of the request sent to the
+// service with the ones of info. The reverse proxy appends the peer of the
+// gateway to X-Forwarded-For.
+func SetHeaders(h http.Header, info Info) {
+	if len(info.For) > 0 {
+		h.Set(HeaderFor, strings.Join(info.For, ", "))
+	} else {
+		h.Del(HeaderFor)
+	}
+	h.Set(HeaderForwarded, strings.Join(info.Forwarded, ", "))
+	h.Set(HeaderHost, info.Host)
+	h.Set(HeaderProto, info.Proto)
+	h.Set(HeaderRealIP, info.Client)
+}
+
+// incoming returns the hops of the Forwarded header, or of X-Forwarded-For
+// when there is none.
+func incoming(h http.Header) []element {
+	if values := h.Values(HeaderForwarded); len(values) > 0 {
+		return parseForwarded(strings.Join(values, ","))
+	}
+
+	var hops []element
+	for _, v := range h.Values(HeaderFor) {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				hops = append(hops, element{addr: hostOnly(addr)})
+			}
+		}
+	}
+	return hops
+}
+
+func first(v string) string {
+	v, _, _ = strings.Cut(v, ",")
+	return strings.TrimSpace(v)
+}
+
+func validProto(proto string) bool {
+	return strings.EqualFold(proto, "http") || strings.EqualFold(proto, "https")
+}
+
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t\"/\\,;@")
+}
+
+// hostOnly returns the address of addr without its port and brackets.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,245 @@
+package forwarded_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProxies(t *testing.T) {
+	p, err := forwarded.ParseProxies(" 10.0.0.0/8, 192.0.2.1 ,2001:db8::/32,::1")
+	require.NoError(t, err)
+
+	require.True(t, p.Trusts("10.1.2.3"))
+	require.True(t, p.Trusts("192.0.2.1"))
+	require.False(t, p.Trusts("192.0.2.2"))
+	require.True(t, p.Trusts("2001:db8::7"))
+	require.True(t, p.Trusts("::1"))
+	require.False(t, p.Trusts("unknown"))
+
+	_, err = forwarded.ParseProxies("10.0.0.0/33")
+	require.Error(t, err)
+	_, err = forwarded.ParseProxies("proxy.local")
+	require.Error(t, err)
+
+	var none *forwarded.Proxies
+	require.False(t, none.Trusts("10.1.2.3"))
+}
+
+func TestResolve(t *testing.T) {
+	proxies, err := forwarded.ParseProxies("10.0.0.0/8, 2001:db8::/32")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		remote    string
+		tls       bool
+		headers   map[string]string
+		client    string
+		chain     []string
+		forwarded []string
+		proto     string
+		host      string
+	}{
+		{
+			name:      "direct",
+			remote:    "203.0.113.7:51000",
+			client:    "203.0.113.7",
+			forwarded: []string{"for=203.0.113.7;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "gateway.test",
+		},
+		{
+			name:      "direct tls",
+			remote:    "203.0.113.7:51000",
+			tls:       true,
+			client:    "203.0.113.7",
+			forwarded: []string{"for=203.0.113.7;host=gateway.test;proto=https"},
+			proto:     "https",
+			host:      "gateway.test",
+		},
+		{
+			name:   "spoofed headers from a client",
+			remote: "203.0.113.7:51000",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "admin.test",
+				"X-Real-IP":         "1.1.1.1",
+				"Forwarded":         "for=1.1.1.1;proto=https",
+			},
+			client:    "203.0.113.7",
+			forwarded: []string{"for=203.0.113.7;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "gateway.test",
+		},
+		{
+			name:   "trusted proxy",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "api.test",
+			},
+			client:    "203.0.113.7",
+			chain:     []string{"203.0.113.7"},
+			forwarded: []string{"for=203.0.113.7", "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "https",
+			host:      "api.test",
+		},
+		{
+			name:   "spoofed hops before the client",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"X-Forwarded-For": "1.1.1.1, 10.9.9.9, 203.0.113.7, 10.0.0.3",
+			},
+			client:    "203.0.113.7",
+			chain:     []string{"203.0.113.7", "10.0.0.3"},
+			forwarded: []string{"for=203.0.113.7", "for=10.0.0.3", "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "gateway.test",
+		},
+		{
+			name:   "only trusted hops",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"X-Forwarded-For": "10.0.0.4, 10.0.0.3",
+			},
+			client:    "10.0.0.4",
+			chain:     []string{"10.0.0.4", "10.0.0.3"},
+			forwarded: []string{"for=10.0.0.4", "for=10.0.0.3", "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "gateway.test",
+		},
+		{
+			name:   "invalid forwarded proto",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "javascript",
+				"X-Forwarded-Host":  "evil.test/path",
+			},
+			client:    "203.0.113.7",
+			chain:     []string{"203.0.113.7"},
+			forwarded: []string{"for=203.0.113.7", "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "gateway.test",
+		},
+		{
+			name:   "rfc 7239",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"Forwarded":       `for=1.1.1.1, for="[2606:4700::17]:4711";host=api.test;proto=https, for=10.0.0.3`,
+				"X-Forwarded-For": "9.9.9.9",
+			},
+			client:    "2606:4700::17",
+			chain:     []string{"2606:4700::17", "10.0.0.3"},
+			forwarded: []string{`for="[2606:4700::17]";host=api.test;proto=https`, "for=10.0.0.3", "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "https",
+			host:      "api.test",
+		},
+		{
+			name:   "rfc 7239 untrusted hop",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"Forwarded": `for=192.0.2.60;proto=http, For="198.51.100.17";HOST="api.test:8443"`,
+			},
+			client:    "198.51.100.17",
+			chain:     []string{"198.51.100.17"},
+			forwarded: []string{`for=198.51.100.17;host="api.test:8443"`, "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "api.test:8443",
+		},
+		{
+			name:   "rfc 7239 malformed element",
+			remote: "10.0.0.2:443",
+			headers: map[string]string{
+				"Forwarded": `for=203.0.113.7, for="10.0.0.3;proto=https, for=10.0.0.4`,
+			},
+			client:    "unknown",
+			chain:     []string{"unknown"},
+			forwarded: []string{"for=unknown", "for=10.0.0.2;host=gateway.test;proto=http"},
+			proto:     "http",
+			host:      "gateway.test",
+		},
+		{
+			name:   "rfc 7239 obfuscated",
+			remote: "[2001:db8::1]:443",
+			headers: map[string]string{
+				"Forwarded": `for=_hidden;proto=https`,
+			},
+			client:    "_hidden",
+			chain:     []string{"_hidden"},
+			forwarded: []string{"for=_hidden;proto=https", `for="[2001:db8::1]";host=gateway.test;proto=http`},
+			proto:     "https",
+			host:      "gateway.test",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://gateway.test/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			info := proxies.Resolve(r)
+			require.Equal(t, tt.client, info.Client)
+			require.Equal(t, tt.chain, info.For)
+			require.Equal(t, tt.forwarded, info.Forwarded)
+			require.Equal(t, tt.proto, info.Proto)
+			require.Equal(t, tt.host, info.Host)
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	proxies, err := forwarded.ParseProxies("10.0.0.0/8")
+	require.NoError(t, err)
+
+	var info forwarded.Info
+	var clientIP string
+	h := proxies.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info = forwarded.FromRequest(r)
+		clientIP = forwarded.ClientIP(r)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.2:443"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(t, "203.0.113.7", info.Client)
+	require.Equal(t, "203.0.113.7", clientIP)
+
+	// Without the middleware no proxy is trusted.
+	require.Equal(t, "10.0.0.2", forwarded.ClientIP(r))
+}
+
+func TestSetHeaders(t *testing.T) {
+	h := http.Header{"X-Forwarded-For": {"1.1.1.1"}, "X-Real-Ip": {"1.1.1.1"}}
+	forwarded.SetHeaders(h, forwarded.Info{
+		Client:    "203.0.113.7",
+		For:       []string{"203.0.113.7", "10.0.0.3"},
+		Forwarded: []string{"for=203.0.113.7", "for=10.0.0.3", "for=10.0.0.2;host=api.test;proto=https"},
+		Proto:     "https",
+		Host:      "api.test",
+	})
+
+	require.Equal(t, []string{"203.0.113.7, 10.0.0.3"}, h.Values("X-Forwarded-For"))
+	require.Equal(t, "for=203.0.113.7, for=10.0.0.3, for=10.0.0.2;host=api.test;proto=https", h.Get("Forwarded"))
+	require.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+	require.Equal(t, "api.test", h.Get("X-Forwarded-Host"))
+	require.Equal(t, "203.0.113.7", h.Get("X-Real-IP"))
+
+	// Direct clients are appended by the reverse proxy.
+	forwarded.SetHeaders(h, forwarded.Info{Client: "203.0.113.7", Forwarded: []string{"for=203.0.113.7"}, Proto: "http", Host: "api.test"})
+	require.Empty(t, h.Values("X-Forwarded-For"))
+}
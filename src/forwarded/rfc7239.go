@@ -0,0 +1,142 @@
+package forwarded
+
+import (
+	"net"
+	"strings"
+)
+
+// unknown is the RFC 7239 identifier of the hops not identified.
+const unknown = "unknown"
+
+// element is a hop of the Forwarded header.
+type element struct {
+	addr  string
+	host  string
+	proto string
+}
+
+// String returns the element in the Forwarded syntax.
+func (e element) String() string {
+	addr := e.addr
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		addr = "[" + addr + "]"
+	}
+
+	s := "for=" + quote(addr)
+	if e.host != "" {
+		s += ";host=" + quote(e.host)
+	}
+	if e.proto != "" {
+		s += ";proto=" + e.proto
+	}
+	return s
+}
+
+// parseForwarded parses the elements of a Forwarded header. An element
+// that cannot be parsed is an unknown hop, so it stops the walk of the
+// trusted proxies.
+func parseForwarded(v string) []element {
+	var elements []element
+	for _, raw := range split(v, ',') {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		elements = append(elements, parseElement(raw))
+	}
+	return elements
+}
+
+func parseElement(raw string) element {
+	e := element{}
+	for _, pair := range split(raw, ';') {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return element{addr: unknown}
+		}
+		value, ok = unquote(value)
+		if !ok {
+			return element{addr: unknown}
+		}
+
+		switch strings.ToLower(name) {
+		case "for":
+			e.addr = hostOnly(value)
+		case "host":
+			if !validHost(value) {
+				return element{addr: unknown}
+			}
+			e.host = value
+		case "proto":
+			if !validProto(value) {
+				return element{addr: unknown}
+			}
+			e.proto = strings.ToLower(value)
+		}
+	}
+
+	if e.addr == "" {
+		e.addr = unknown
+	}
+	return e
+}
+
+// split splits s on sep outside of the quoted strings.
+func split(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the value of a token or of a quoted string.
+func unquote(v string) (string, bool) {
+	if !strings.HasPrefix(v, `"`) {
+		return v, isToken(v)
+	}
+	if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+		return "", false
+	}
+
+	var b strings.Builder
+	v = v[1 : len(v)-1]
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String(), true
+}
+
+func quote(v string) string {
+	if isToken(v) {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// isToken reports whether v is an RFC 7230 token.
+func isToken(v string) bool {
+	if v == "" {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
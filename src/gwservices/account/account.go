@@ -0,0 +1,367 @@
+// Package account lets the users activate their account, recover their
+// password and verify their email address with single use tokens sent by
+// email.
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amaurybrisou/ablib/cryptlib"
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/mailer"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores the bytes after the 72nd.
+	maxPasswordLength = 72
+)
+
+// ValidatePassword checks the passwords chosen by the users.
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes long", maxPasswordLength)
+	}
+	return nil
+}
+
+// Store keeps the users and their tokens.
+type Store interface {
+	GetFullUserByEmail(ctx context.Context, email string) (models.User, error)
+	GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error)
+	CreateUserToken(ctx context.Context, t models.UserToken) error
+	ResetPassword(ctx context.Context, purpose, hash, password string) (models.User, error)
+	VerifyEmail(ctx context.Context, hash string) (models.User, error)
+	RemoveRefreshToken(ctx context.Context, userID string) error
+}
+
+type Config struct {
+	// Secret signs the tokens.
+	Secret string
+	// ResetURL is the page the password reset links point to, the token is
+	// added to its query.
+	ResetURL string
+	// VerifyURL is the page the email verification links point to.
+	VerifyURL string
+	// ActivateURL is the page the new users choose their password on.
+	ActivateURL string
+	ResetTTL    time.Duration
+	VerifyTTL   time.Duration
+	ActivateTTL time.Duration
+}
+
+type Service struct {
+	store Store
+	mail  mailer.Sender
+	cfg   Config
+}
+
+func New(store Store, mail mailer.Sender, cfg Config) Service {
+	if cfg.ResetTTL <= 0 {
+		cfg.ResetTTL = time.Hour
+	}
+	if cfg.VerifyTTL <= 0 {
+		cfg.VerifyTTL = 48 * time.Hour
+	}
+	if cfg.ActivateTTL <= 0 {
+		cfg.ActivateTTL = 7 * 24 * time.Hour
+	}
+
+	return Service{store: store, mail: mail, cfg: cfg}
+}
+
+const resetEmail = `Hello,
+
+Someone asked to reset the password of your account. Follow this link to choose a new one:
+
+%s
+
+The link can only be used once and expires in %s. If you did not ask for it, ignore this email, your password is unchanged.
+`
+
+const verifyEmail = `Hello,
+
+Follow this link to confirm your email address:
+
+%s
+
+The link can only be used once and expires in %s.
+`
+
+const activateEmail = `Hello,
+
+Welcome! Your account is ready, follow this link to choose your password:
+
+%s
+
+The link can only be used once and expires in %s. If it expired, ask for a password reset to get a new one.
+`
+
+// ForgotPasswordHandler emails a password reset link to the user, or a new
+// activation link when the account is not activated yet. It answers the same
+// whether the email belongs to a user or not.
+func (s Service) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	request.Email = strings.TrimSpace(request.Email)
+	if request.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.store.GetFullUserByEmail(r.Context(), request.Email)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if user.ID == uuid.Nil {
+		log.Ctx(r.Context()).Debug().Msg("password reset for unknown email")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if user.IsNew {
+		err = s.SendActivation(r.Context(), user)
+	} else {
+		err = s.send(r.Context(), user, models.TokenPurposePasswordReset, s.cfg.ResetURL, s.cfg.ResetTTL, "Reset your password", resetEmail)
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to send the password reset email", http.StatusInternalServerError)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Str("user_id", user.ID.String()).Msg("password reset email sent")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPasswordHandler sets the password of the user a reset token was sent
+// to. The token can only be used once, the sessions of the user are revoked.
+func (s Service) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidatePassword(request.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.SetPassword(r.Context(), models.TokenPurposePasswordReset, request.Token, request.Password)
+	if errors.Is(err, database.ErrTokenInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.store.RemoveRefreshToken(r.Context(), user.ID.String()); err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("revoke refresh tokens")
+	}
+
+	log.Ctx(r.Context()).Info().Str("user_id", user.ID.String()).Msg("password reset")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendActivation emails a new user the link to choose a password and
+// activate the account.
+func (s Service) SendActivation(ctx context.Context, user models.User) error {
+	return s.send(ctx, user, models.TokenPurposeActivation, s.cfg.ActivateURL, s.cfg.ActivateTTL, "Activate your account", activateEmail)
+}
+
+// ActivateHandler sets the first password of the user an activation token
+// was sent to, activating the account.
+func (s Service) ActivateHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := ValidatePassword(request.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.SetPassword(r.Context(), models.TokenPurposeActivation, request.Token, request.Password)
+	if errors.Is(err, database.ErrTokenInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to activate account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Str("user_id", user.ID.String()).Msg("account activated")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetPassword uses a token emailed for purpose to set the password of its
+// user, database.ErrTokenInvalid is returned for forged, used or expired
+// tokens.
+func (s Service) SetPassword(ctx context.Context, purpose, token, password string) (models.User, error) {
+	hash, ok := s.verifyToken(purpose, token)
+	if !ok {
+		return models.User{}, database.ErrTokenInvalid
+	}
+
+	hashedPassword, err := cryptlib.GenerateHash(password, bcrypt.DefaultCost)
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return s.store.ResetPassword(ctx, purpose, hash, hashedPassword)
+}
+
+// SendVerificationHandler emails an email verification link to the logged in
+// user.
+func (s Service) SendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := s.store.GetUserByID(r.Context(), ablibhttp.User(r.Context()).GetID())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to retrieve user", http.StatusInternalServerError)
+		return
+	}
+
+	if user.EmailVerifiedAt != nil {
+		http.Error(w, "email already verified", http.StatusConflict)
+		return
+	}
+
+	err = s.send(r.Context(), user, models.TokenPurposeEmailVerification, s.cfg.VerifyURL, s.cfg.VerifyTTL, "Confirm your email address", verifyEmail)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to send the verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmailHandler marks the email a verification token was sent to as
+// verified.
+func (s Service) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	hash, ok := s.verifyToken(models.TokenPurposeEmailVerification, request.Token)
+	if !ok {
+		http.Error(w, database.ErrTokenInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.store.VerifyEmail(r.Context(), hash)
+	if errors.Is(err, database.ErrTokenInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Str("user_id", user.ID.String()).Msg("email verified")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// send emails the user a link to page holding a new token for purpose.
+// body is formatted with the link and the lifetime of the token.
+func (s Service) send(ctx context.Context, user models.User, purpose, page string, ttl time.Duration, subject, body string) error {
+	link, err := url.Parse(page)
+	if err != nil {
+		return fmt.Errorf("failed to parse link %q: %w", page, err)
+	}
+
+	token, hash, err := s.newToken(purpose)
+	if err != nil {
+		return err
+	}
+
+	err = s.store.CreateUserToken(ctx, models.UserToken{
+		Hash:      hash,
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+
+	return s.mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, link.String(), formatTTL(ttl)),
+	})
+}
+
+// formatTTL writes d in days, hours or minutes.
+func formatTTL(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d >= day && d%day == 0 {
+		if d == day {
+			return "1 day"
+		}
+		return fmt.Sprintf("%d days", d/day)
+	}
+	if d >= time.Hour && d%time.Hour == 0 {
+		if d == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	return fmt.Sprintf("%d minutes", d/time.Minute)
+}
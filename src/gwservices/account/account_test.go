@@ -0,0 +1,334 @@
+package account_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/ablib/cryptlib"
+	"github.com/amaurybrisou/gateway/src/apikey"
+	"github.com/amaurybrisou/gateway/src/database"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/account"
+	"github.com/amaurybrisou/gateway/src/mailer/mailertest"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type store struct {
+	mu      sync.Mutex
+	now     time.Time
+	users   map[uuid.UUID]models.User
+	tokens  map[string]models.UserToken
+	revoked []string
+}
+
+func newStore(users ...models.User) *store {
+	s := &store{now: time.Now(), users: make(map[uuid.UUID]models.User), tokens: make(map[string]models.UserToken)}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return s
+}
+
+func (s *store) GetFullUserByEmail(ctx context.Context, email string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, nil
+}
+
+func (s *store) GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[userID], nil
+}
+
+func (s *store) CreateUserToken(ctx context.Context, t models.UserToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Hash] = t
+	return nil
+}
+
+// use consumes a token like the database does.
+func (s *store) use(purpose, hash string) (models.User, error) {
+	t, ok := s.tokens[hash]
+	if !ok || t.Purpose != purpose || t.UsedAt != nil || !s.now.Before(t.ExpiresAt) {
+		return models.User{}, database.ErrTokenInvalid
+	}
+	t.UsedAt = &s.now
+	s.tokens[hash] = t
+
+	u, ok := s.users[t.UserID]
+	if !ok || u.Email != t.Email {
+		return models.User{}, database.ErrTokenInvalid
+	}
+	if u.EmailVerifiedAt == nil {
+		u.EmailVerifiedAt = &s.now
+	}
+	return u, nil
+}
+
+func (s *store) ResetPassword(ctx context.Context, purpose, hash, password string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.use(purpose, hash)
+	if err != nil {
+		return u, err
+	}
+	for h, t := range s.tokens {
+		if t.UserID == u.ID && t.Purpose == purpose && t.UsedAt == nil {
+			t.UsedAt = &s.now
+			s.tokens[h] = t
+		}
+	}
+	u.Password = password
+	u.IsNew = false
+	s.users[u.ID] = u
+	return u, nil
+}
+
+func (s *store) VerifyEmail(ctx context.Context, hash string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := s.use(models.TokenPurposeEmailVerification, hash)
+	if err != nil {
+		return u, err
+	}
+	s.users[u.ID] = u
+	return u, nil
+}
+
+func (s *store) RemoveRefreshToken(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = append(s.revoked, userID)
+	return nil
+}
+
+var cfg = account.Config{
+	Secret:      "token-secret",
+	ResetURL:    "https://gateway.test/home/reset-password",
+	VerifyURL:   "https://gateway.test/home/verify-email?lang=en",
+	ActivateURL: "https://gateway.test/home/activate",
+}
+
+func post(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return w
+}
+
+// token returns the token of the link of the last email, checking it
+// points to page.
+func token(t *testing.T, mail *mailertest.Sender, page string) string {
+	m, ok := mail.Last()
+	require.True(t, ok)
+
+	for _, line := range strings.Split(m.Body, "\n") {
+		if !strings.HasPrefix(line, "https://") {
+			continue
+		}
+		link, err := url.Parse(line)
+		require.NoError(t, err)
+		base, err := url.Parse(page)
+		require.NoError(t, err)
+		require.Equal(t, base.Path, link.Path)
+		for k := range base.Query() {
+			require.Equal(t, base.Query().Get(k), link.Query().Get(k))
+		}
+		return link.Query().Get("token")
+	}
+
+	require.Fail(t, "no link in email", m.Body)
+	return ""
+}
+
+func TestResetPassword(t *testing.T) {
+	ada := models.User{ID: uuid.New(), Email: "ada@example.org", Password: "old"}
+	s := newStore(ada)
+	mail := &mailertest.Sender{}
+	svc := account.New(s, mail, cfg)
+
+	// Unknown emails get the same answer, without any email.
+	w := post(svc.ForgotPasswordHandler, `{"email":"eve@example.org"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Empty(t, mail.Messages())
+
+	w = post(svc.ForgotPasswordHandler, `{"email":"ada@example.org"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	m, _ := mail.Last()
+	require.Equal(t, "ada@example.org", m.To)
+	require.Contains(t, m.Body, "expires in 1 hour")
+	first := token(t, mail, cfg.ResetURL)
+
+	post(svc.ForgotPasswordHandler, `{"email":"ada@example.org"}`)
+	tok := token(t, mail, cfg.ResetURL)
+	require.NotEqual(t, first, tok)
+
+	// Only the hash of the token is stored.
+	sum := sha256.Sum256([]byte(tok))
+	require.Contains(t, s.tokens, hex.EncodeToString(sum[:]))
+
+	w = post(svc.ResetPasswordHandler, `{"token":"`+tok+`","password":"short"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post(svc.ResetPasswordHandler, `{"token":"`+tok+`","password":"correct horse"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.True(t, cryptlib.ValidateHash("correct horse", s.users[ada.ID].Password))
+	require.NotNil(t, s.users[ada.ID].EmailVerifiedAt)
+	require.Equal(t, []string{ada.ID.String()}, s.revoked)
+
+	// Tokens are single use, and the other tokens are revoked.
+	w = post(svc.ResetPasswordHandler, `{"token":"`+tok+`","password":"battery staple"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = post(svc.ResetPasswordHandler, `{"token":"`+first+`","password":"battery staple"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.True(t, cryptlib.ValidateHash("correct horse", s.users[ada.ID].Password))
+}
+
+func TestResetPasswordInvalidToken(t *testing.T) {
+	ada := models.User{ID: uuid.New(), Email: "ada@example.org"}
+	s := newStore(ada)
+	mail := &mailertest.Sender{}
+	svc := account.New(s, mail, cfg)
+
+	post(svc.ForgotPasswordHandler, `{"email":"ada@example.org"}`)
+	tok := token(t, mail, cfg.ResetURL)
+	nonce, _, _ := strings.Cut(tok, ".")
+
+	for name, forged := range map[string]string{
+		"empty":        "",
+		"unsigned":     nonce,
+		"bad sig":      nonce + ".c2lnbmF0dXJl",
+		"other secret": signedWith(t, "other-secret", "ada@example.org"),
+	} {
+		w := post(svc.ResetPasswordHandler, `{"token":"`+forged+`","password":"correct horse"}`)
+		require.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+
+	// Verification tokens do not reset passwords.
+	svc.SendVerificationHandler(httptest.NewRecorder(), authenticated(ada))
+	verify := token(t, mail, cfg.VerifyURL)
+	w := post(svc.ResetPasswordHandler, `{"token":"`+verify+`","password":"correct horse"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Tokens expire.
+	s.now = time.Now().Add(time.Hour + time.Minute)
+	w = post(svc.ResetPasswordHandler, `{"token":"`+tok+`","password":"correct horse"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	s.now = time.Now()
+
+	// And are only valid for the email they were sent to.
+	post(svc.ForgotPasswordHandler, `{"email":"ada@example.org"}`)
+	tok = token(t, mail, cfg.ResetURL)
+	ada.Email = "ada@new.example.org"
+	s.users[ada.ID] = ada
+	w = post(svc.ResetPasswordHandler, `{"token":"`+tok+`","password":"correct horse"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Empty(t, s.users[ada.ID].Password)
+}
+
+// signedWith returns a reset token for email signed with another secret.
+func signedWith(t *testing.T, secret, email string) string {
+	mail := &mailertest.Sender{}
+	c := cfg
+	c.Secret = secret
+	svc := account.New(newStore(models.User{ID: uuid.New(), Email: email}), mail, c)
+	post(svc.ForgotPasswordHandler, `{"email":"`+email+`"}`)
+	return token(t, mail, cfg.ResetURL)
+}
+
+func authenticated(u models.User) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	return r.WithContext(apikey.NewContext(r.Context(), models.APIKey{}, u))
+}
+
+func TestVerifyEmail(t *testing.T) {
+	ada := models.User{ID: uuid.New(), Email: "ada@example.org"}
+	s := newStore(ada)
+	mail := &mailertest.Sender{}
+	svc := account.New(s, mail, cfg)
+
+	w := httptest.NewRecorder()
+	svc.SendVerificationHandler(w, authenticated(ada))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	m, _ := mail.Last()
+	require.Equal(t, "ada@example.org", m.To)
+	require.Contains(t, m.Body, "expires in 2 days")
+	tok := token(t, mail, cfg.VerifyURL)
+
+	w = post(svc.VerifyEmailHandler, `{"token":"`+tok+`"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.NotNil(t, s.users[ada.ID].EmailVerifiedAt)
+
+	w = post(svc.VerifyEmailHandler, `{"token":"`+tok+`"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	svc.SendVerificationHandler(w, authenticated(ada))
+	require.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestActivate(t *testing.T) {
+	ada := models.User{ID: uuid.New(), Email: "ada@example.org", IsNew: true}
+	s := newStore(ada)
+	mail := &mailertest.Sender{}
+	svc := account.New(s, mail, cfg)
+
+	require.NoError(t, svc.SendActivation(context.Background(), ada))
+	m, _ := mail.Last()
+	require.Equal(t, "ada@example.org", m.To)
+	require.Equal(t, "Activate your account", m.Subject)
+	require.Contains(t, m.Body, "expires in 7 days")
+	tok := token(t, mail, cfg.ActivateURL)
+
+	// Pending users asking for a reset get a new activation link.
+	w := post(svc.ForgotPasswordHandler, `{"email":"ada@example.org"}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	m, _ = mail.Last()
+	require.Equal(t, "Activate your account", m.Subject)
+	again := token(t, mail, cfg.ActivateURL)
+
+	// Activation tokens do not reset passwords.
+	w = post(svc.ResetPasswordHandler, `{"token":"`+tok+`","password":"correct horse"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post(svc.ActivateHandler, `{"token":"`+tok+`","password":"short"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post(svc.ActivateHandler, `{"token":"`+tok+`","password":"correct horse"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.False(t, s.users[ada.ID].IsNew)
+	require.True(t, cryptlib.ValidateHash("correct horse", s.users[ada.ID].Password))
+
+	// The links are single use and the other ones are revoked.
+	w = post(svc.ActivateHandler, `{"token":"`+tok+`","password":"battery staple"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = post(svc.ActivateHandler, `{"token":"`+again+`","password":"battery staple"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Active users get reset links.
+	post(svc.ForgotPasswordHandler, `{"email":"ada@example.org"}`)
+	m, _ = mail.Last()
+	require.Equal(t, "Reset your password", m.Subject)
+}
+
+func TestValidatePassword(t *testing.T) {
+	require.Error(t, account.ValidatePassword(""))
+	require.Error(t, account.ValidatePassword("1234567"))
+	require.NoError(t, account.ValidatePassword("12345678"))
+	require.Error(t, account.ValidatePassword(strings.Repeat("a", 73)))
+}
@@ -0,0 +1,51 @@
+package account
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// newToken returns a random token signed for purpose, and the hash it is
+// stored with. Tokens are <nonce>.<signature>, the signature rejects forged
+// tokens before the database is queried.
+func (s Service) newToken(purpose string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	token = nonce + "." + s.sign(purpose, nonce)
+
+	return token, hashToken(token), nil
+}
+
+// verifyToken returns the hash of token when it is signed for purpose.
+func (s Service) verifyToken(purpose, token string) (string, bool) {
+	nonce, signature, ok := strings.Cut(token, ".")
+	if !ok || nonce == "" {
+		return "", false
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.sign(purpose, nonce))) {
+		return "", false
+	}
+
+	return hashToken(token), true
+}
+
+func (s Service) sign(purpose, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg.Secret))
+	mac.Write([]byte(purpose + "." + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
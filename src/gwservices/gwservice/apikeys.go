@@ -0,0 +1,134 @@
+package gwservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/apikey"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// maxAPIKeyNameLength bounds the names of the API keys.
+const maxAPIKeyNameLength = 100
+
+// CreatedAPIKey is the answer to the creation of a key, the only time the
+// key itself is disclosed.
+type CreatedAPIKey struct {
+	models.APIKey
+	Key string `json:"key"`
+}
+
+// GetAPIKeysHandler lists the API keys of the user.
+func (s Service) GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.db.GetUserAPIKeys(r.Context(), ablibhttp.User(r.Context()).GetID())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// CreateAPIKeyHandler creates an API key for the user.
+func (s Service) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name       string      `json:"name"`
+		ServiceIDs []uuid.UUID `json:"service_ids"`
+		ExpiresAt  *time.Time  `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if len(req.Name) > maxAPIKeyNameLength {
+		http.Error(w, fmt.Sprintf("name is longer than %d characters", maxAPIKeyNameLength), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at is in the past", http.StatusBadRequest)
+		return
+	}
+	for _, id := range req.ServiceIDs {
+		_, err := s.db.GetServiceByID(r.Context(), id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("service %s not found", id), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Ctx(r.Context()).Err(err).Send()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	key, prefix, hash, err := apikey.Generate()
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	created, err := s.db.CreateAPIKey(r.Context(), models.APIKey{
+		ID:         uuid.New(),
+		UserID:     ablibhttp.User(r.Context()).GetID(),
+		Name:       req.Name,
+		Prefix:     prefix,
+		Hash:       hash,
+		ServiceIDs: req.ServiceIDs,
+		ExpiresAt:  req.ExpiresAt,
+	})
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Str("api_key", created.Prefix).Msg("api key created")
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(CreatedAPIKey{APIKey: created, Key: key}); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteAPIKeyHandler revokes an API key of the user.
+func (s Service) DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := uuid.Parse(chi.URLParam(r, "key_id"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "invalid keyID", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.db.DeleteAPIKey(r.Context(), ablibhttp.User(r.Context()).GetID(), keyID)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "api key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package gwservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/iprules"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// DenyList is the global ip deny list of the proxy.
+type DenyList interface {
+	// Reload fetches the deny list after it has changed.
+	Reload(ctx context.Context) error
+}
+
+// GetIPRulesHandler lists the global deny list.
+func (s Service) GetIPRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.db.GetIPRules(r.Context())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// CreateIPRuleHandler adds a CIDR to the global deny list.
+func (s Service) CreateIPRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule models.IPRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := iprules.ParseRule(rule.CIDR)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = uuid.New()
+	rule.CIDR = p.String()
+	rule.Comment = strings.TrimSpace(rule.Comment)
+
+	created, err := s.db.CreateIPRule(r.Context(), rule)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.reloadDenyList(r.Context())
+
+	log.Ctx(r.Context()).Info().Str("cidr", created.CIDR).Msg("ip denied")
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteIPRuleHandler removes a CIDR from the global deny list.
+func (s Service) DeleteIPRuleHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := uuid.Parse(chi.URLParam(r, "rule_id"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "invalid ruleID", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.db.DeleteIPRule(r.Context(), ruleID)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "ip rule not found", http.StatusNotFound)
+		return
+	}
+
+	s.reloadDenyList(r.Context())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reloadDenyList refreshes the local deny list right away, other replicas
+// are refreshed by the database notification.
+func (s Service) reloadDenyList(ctx context.Context) {
+	if s.denyList == nil {
+		return
+	}
+
+	if err := s.denyList.Reload(ctx); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("reload ip deny list")
+	}
+}
+
+func validateIPRules(rules *models.IPRules) error {
+	if rules == nil {
+		return nil
+	}
+	for _, list := range [][]string{rules.Allow, rules.Deny} {
+		for i, rule := range list {
+			p, err := iprules.ParseRule(rule)
+			if err != nil {
+				return fmt.Errorf("ip_rules: %w", err)
+			}
+			list[i] = p.String()
+		}
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package gwservice
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"text/template"
 
 	"github.com/amaurybrisou/ablib/cryptlib"
@@ -11,22 +14,44 @@ import (
 	"github.com/amaurybrisou/ablib/jwtlib"
 	"github.com/amaurybrisou/gateway/src/database"
 	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/account"
 	"github.com/amaurybrisou/gateway/src/serializer"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// RouteTable is the proxy routing table kept up to date by the handlers.
+type RouteTable interface {
+	// Reload rebuilds the routes after a service has changed.
+	Reload(ctx context.Context) error
+	// Conflict returns an error when the service would be routed the same
+	// requests as another one.
+	Conflict(ctx context.Context, s models.Service) error
+}
+
+// CachePurger removes the cached responses of a service.
+type CachePurger interface {
+	Purge(serviceID string) error
+}
+
 type Service struct {
-	db  *database.Database
-	jwt *jwtlib.JWT
+	db       *database.Database
+	jwt      *jwtlib.JWT
+	routes   RouteTable
+	cache    CachePurger
+	denyList DenyList
 }
 
-func New(db *database.Database, jwt *jwtlib.JWT) Service {
+func New(db *database.Database, jwt *jwtlib.JWT, routes RouteTable, cache CachePurger, denyList DenyList) Service {
 	return Service{
-		db:  db,
-		jwt: jwt,
+		db:       db,
+		jwt:      jwt,
+		routes:   routes,
+		cache:    cache,
+		denyList: denyList,
 	}
 }
 
@@ -40,6 +65,20 @@ func (s Service) CreateServiceHandler(w http.ResponseWriter, r *http.Request) {
 
 	service.ID = uuid.New()
 
+	if err := validateService(&service); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.routes != nil {
+		if err := s.routes.Conflict(r.Context(), service); err != nil {
+			log.Ctx(r.Context()).Err(err).Send()
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
 	createdService, err := s.db.CreateService(r.Context(), service)
 	if err != nil {
 		log.Ctx(r.Context()).Err(err).Send()
@@ -47,6 +86,8 @@ func (s Service) CreateServiceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.reloadRoutes(r.Context())
+
 	if err := json.NewEncoder(w).Encode(serializer.Service(&createdService, ablibhttp.IsAdmin(r.Context()))); err != nil {
 		log.Ctx(r.Context()).Err(err).Send()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -77,6 +118,11 @@ func (s Service) DeleteServiceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if deleted {
+		s.reloadRoutes(r.Context())
+		s.purgeCache(r.Context(), uuidServiceID)
+	}
+
 	response := struct {
 		Deleted bool `json:"deleted"`
 	}{
@@ -91,6 +137,203 @@ func (s Service) DeleteServiceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// healthEventsLimit is the number of health events returned when the limit
+// parameter is missing.
+const healthEventsLimit = 50
+
+// GetServiceHealthHandler returns the latest health status changes of the
+// targets of a service.
+func (s Service) GetServiceHealthHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID, err := uuid.Parse(chi.URLParam(r, "service_id"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "invalid serviceID", http.StatusBadRequest)
+		return
+	}
+
+	limit := healthEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := s.db.GetServiceHealthEvents(r.Context(), serviceID, limit)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// UpdateServiceVersionsHandler changes the weights of the backend versions of
+// a service, the body maps the version names to their new weight.
+func (s Service) UpdateServiceVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID, err := uuid.Parse(chi.URLParam(r, "service_id"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "invalid serviceID", http.StatusBadRequest)
+		return
+	}
+
+	var weights map[string]int
+	if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	service, err := s.db.GetServiceByID(r.Context(), serviceID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if service.Canary == nil {
+		http.Error(w, "service has no versions", http.StatusBadRequest)
+		return
+	}
+
+	canary := *service.Canary
+	canary.Versions = append([]models.Version(nil), canary.Versions...)
+	for name, weight := range weights {
+		found := false
+		for i := range canary.Versions {
+			if canary.Versions[i].Name == name {
+				canary.Versions[i].Weight = weight
+				found = true
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("unknown version %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := validateCanary(&canary); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := s.db.UpdateServiceCanary(r.Context(), serviceID, &canary)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.reloadRoutes(r.Context())
+
+	log.Ctx(r.Context()).Info().Str("service", updated.Name).Any("weights", weights).Msg("version weights updated")
+
+	if err := json.NewEncoder(w).Encode(serializer.Service(&updated, ablibhttp.IsAdmin(r.Context()))); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// UpdateServiceMaintenanceHandler puts a service in or out of maintenance.
+func (s Service) UpdateServiceMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID, err := uuid.Parse(chi.URLParam(r, "service_id"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "invalid serviceID", http.StatusBadRequest)
+		return
+	}
+
+	var maintenance models.Maintenance
+	if err := json.NewDecoder(r.Body).Decode(&maintenance); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateMaintenance(&maintenance); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := s.db.UpdateServiceMaintenance(r.Context(), serviceID, &maintenance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.reloadRoutes(r.Context())
+
+	log.Ctx(r.Context()).Info().Str("service", updated.Name).Bool("enabled", maintenance.Enabled).Msg("maintenance updated")
+
+	if err := json.NewEncoder(w).Encode(serializer.Service(&updated, ablibhttp.IsAdmin(r.Context()))); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// PurgeServiceCacheHandler removes the cached responses of a service.
+func (s Service) PurgeServiceCacheHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID, err := uuid.Parse(chi.URLParam(r, "service_id"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "invalid serviceID", http.StatusBadRequest)
+		return
+	}
+
+	if s.cache != nil {
+		if err := s.cache.Purge(serviceID.String()); err != nil {
+			log.Ctx(r.Context()).Err(err).Send()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s Service) purgeCache(ctx context.Context, serviceID uuid.UUID) {
+	if s.cache == nil {
+		return
+	}
+
+	if err := s.cache.Purge(serviceID.String()); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("purge cache")
+	}
+}
+
+// reloadRoutes refreshes the local route table right away, other replicas
+// are refreshed by the database notification.
+func (s Service) reloadRoutes(ctx context.Context) {
+	if s.routes == nil {
+		return
+	}
+
+	if err := s.routes.Reload(ctx); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("reload routes")
+	}
+}
+
 func (s Service) GetAllServicesHandler(w http.ResponseWriter, r *http.Request) {
 	user := ablibhttp.User(r.Context())
 	var services []*models.Service
@@ -174,11 +417,12 @@ func (s Service) ServicePricePage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// PasswordUpdateHandler is an HTTP handler for updating the user password.
+// PasswordUpdateHandler is an HTTP handler for updating the password of the
+// logged in user, it requires the current password.
 func (s Service) PasswordUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&request)
@@ -188,6 +432,31 @@ func (s Service) PasswordUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := account.ValidatePassword(request.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email := ablibhttp.User(r.Context()).GetEmail()
+
+	current, err := s.db.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			log.Ctx(r.Context()).Error().Err(err).Msg("user not found")
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			log.Ctx(r.Context()).Error().Err(err).Msg("get user")
+			http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !cryptlib.ValidateHash(request.CurrentPassword, current.Password) {
+		log.Ctx(r.Context()).Warn().Str("user_id", current.ID.String()).Msg("invalid current password")
+		http.Error(w, "Invalid current password", http.StatusForbidden)
+		return
+	}
+
 	cipheredPassword, err := cryptlib.GenerateHash(request.Password, bcrypt.DefaultCost)
 	if err != nil {
 		log.Ctx(r.Context()).Error().Err(err).Msg("cipher password")
@@ -195,7 +464,7 @@ func (s Service) PasswordUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.db.UpdatePassword(r.Context(), request.Email, cipheredPassword)
+	user, err := s.db.UpdatePassword(r.Context(), email, cipheredPassword)
 	if err != nil {
 		if errors.Is(err, database.ErrUserNotFound) {
 			log.Ctx(r.Context()).Error().Err(err).Msg("user not found")
@@ -0,0 +1,518 @@
+package gwservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/errorpage"
+	"github.com/amaurybrisou/gateway/src/ratelimit"
+	"github.com/amaurybrisou/gateway/src/transform"
+	"github.com/amaurybrisou/gateway/src/upstreamtls"
+	"golang.org/x/net/http/httpguts"
+)
+
+// validateService checks the proxy settings of s and fills their defaults.
+func validateService(s *models.Service) error {
+	switch s.LoadBalancing {
+	case "":
+		s.LoadBalancing = models.LoadBalancingRoundRobin
+	case models.LoadBalancingRoundRobin, models.LoadBalancingLeastConnections, models.LoadBalancingConsistentHash:
+	default:
+		return fmt.Errorf("unknown load balancing strategy %q", s.LoadBalancing)
+	}
+
+	switch s.Protocol {
+	case "":
+		s.Protocol = models.ProtocolHTTP1
+	case models.ProtocolHTTP1, models.ProtocolH2C, models.ProtocolH2, models.ProtocolGRPC:
+	default:
+		return fmt.Errorf("unknown protocol %q", s.Protocol)
+	}
+
+	if err := validateCanary(s.Canary); err != nil {
+		return err
+	}
+
+	for _, t := range s.AllUpstreams() {
+		if err := validateProtocol(s.Protocol, t.URL); err != nil {
+			return err
+		}
+	}
+
+	// Services split between versions are routed to their targets only.
+	if s.Canary == nil || s.Host != "" || len(s.Targets) > 0 {
+		if s.Host == "" && len(s.Targets) == 0 {
+			return fmt.Errorf("host or targets are required")
+		}
+		if err := validateTargets(s.Upstreams(), s.Targets); err != nil {
+			return err
+		}
+	}
+
+	if err := validateTLS(*s); err != nil {
+		return err
+	}
+
+	if err := validateSigning(s.Signing); err != nil {
+		return err
+	}
+
+	if err := validateRateLimit(s.RateLimit); err != nil {
+		return err
+	}
+
+	if err := validateIPRules(s.IPRules); err != nil {
+		return err
+	}
+
+	if err := validateTransform(s.Transform); err != nil {
+		return err
+	}
+
+	if err := validateCompression(s.Compression); err != nil {
+		return err
+	}
+
+	if err := validateMaintenance(s.Maintenance); err != nil {
+		return err
+	}
+
+	if err := errorpage.Validate(s.ErrorPages); err != nil {
+		return err
+	}
+
+	if err := validateHealthCheck(s.HealthCheck); err != nil {
+		return err
+	}
+
+	if err := validateRetryPolicy(s.RetryPolicy); err != nil {
+		return err
+	}
+
+	if err := validateCircuitBreaker(s.CircuitBreaker); err != nil {
+		return err
+	}
+
+	if err := validateStreamLimits(s.Streaming); err != nil {
+		return err
+	}
+
+	if err := validateRewrite(s.Rewrite); err != nil {
+		return err
+	}
+
+	if err := validateLimits(s.Limits); err != nil {
+		return err
+	}
+
+	if err := validateHeaderRules(s.RequestHeaders); err != nil {
+		return fmt.Errorf("invalid request headers: %w", err)
+	}
+
+	if err := validateHeaderRules(s.ResponseHeaders); err != nil {
+		return fmt.Errorf("invalid response headers: %w", err)
+	}
+
+	if s.Cache != nil && s.Cache.MaxEntrySize < 0 {
+		return fmt.Errorf("cache max entry size must be positive")
+	}
+
+	if err := validateMirror(s.Mirror); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateTargets checks the upstreams of a service or a version and defaults
+// the weights of its explicit targets.
+func validateTargets(upstreams, targets []models.Target) error {
+	for i, t := range upstreams {
+		u, err := url.Parse(t.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid target url %q", t.URL)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for target %q", t.Weight, t.URL)
+		}
+		if len(targets) > 0 && t.Weight == 0 {
+			targets[i].Weight = 1
+		}
+	}
+
+	return nil
+}
+
+// validateProtocol checks the scheme of a target matches the protocol, h2
+// negotiates HTTP/2 with TLS while h2c speaks it in cleartext.
+func validateProtocol(protocol, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target url %q", target)
+	}
+
+	switch {
+	case protocol == models.ProtocolH2 && u.Scheme != "https":
+		return fmt.Errorf("protocol h2 requires https targets, got %q", target)
+	case protocol == models.ProtocolH2C && u.Scheme != "http":
+		return fmt.Errorf("protocol h2c requires http targets, got %q", target)
+	}
+
+	return nil
+}
+
+// minSigningSecret is the minimum length of the signing secrets, the size
+// of the HMAC-SHA256 key.
+const minSigningSecret = 32
+
+func validateSigning(s *models.Signing) error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Secret) < minSigningSecret {
+		return fmt.Errorf("signing secret must be at least %d bytes long", minSigningSecret)
+	}
+	return nil
+}
+
+func validateRateLimit(l *models.RateLimit) error {
+	if l == nil {
+		return nil
+	}
+	if _, err := ratelimit.ParseLimit(l.Rate); err != nil {
+		return err
+	}
+	if _, err := ratelimit.ParseLimit(l.AnonymousRate); err != nil {
+		return err
+	}
+	if l.MonthlyQuota < 0 {
+		return fmt.Errorf("monthly quota must be positive")
+	}
+	return nil
+}
+
+func validateTLS(s models.Service) error {
+	if s.TLS == nil {
+		return nil
+	}
+
+	if (s.TLS.ClientCert == "") != (s.TLS.ClientKey == "") {
+		return fmt.Errorf("tls client_cert and client_key go together")
+	}
+
+	if _, err := upstreamtls.Config(s.TLS); err != nil {
+		return fmt.Errorf("invalid tls: %w", err)
+	}
+
+	for _, t := range s.AllUpstreams() {
+		if strings.HasPrefix(t.URL, "https://") {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("tls requires https targets")
+}
+
+func validateTransform(t *models.Transform) error {
+	if t == nil {
+		return nil
+	}
+
+	for _, rules := range [][]models.PatchRule{t.Request, t.Response} {
+		for _, rule := range rules {
+			if err := validatePatchRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The proxy builds the same pipeline, it must not fail once saved.
+	if _, err := transform.New(t); err != nil {
+		return err
+	}
+
+	if t.MaxBodySize < 0 {
+		return fmt.Errorf("transform max_body_size must be positive")
+	}
+
+	return nil
+}
+
+func validateCompression(c *models.Compression) error {
+	if c == nil {
+		return nil
+	}
+
+	for _, t := range c.ContentTypes {
+		if t == "*" || !strings.Contains(t, "/") {
+			return fmt.Errorf("invalid compression content type %q", t)
+		}
+	}
+
+	if c.MinSize < 0 {
+		return fmt.Errorf("compression min_size must be positive")
+	}
+
+	return nil
+}
+
+func validateMaintenance(m *models.Maintenance) error {
+	if m == nil {
+		return nil
+	}
+	if m.RetryAfter < 0 {
+		return fmt.Errorf("maintenance retry_after must be positive")
+	}
+	return nil
+}
+
+func validatePatchRule(rule models.PatchRule) error {
+	if !strings.HasPrefix(rule.Path, "/") {
+		return fmt.Errorf("invalid patch path %q: must be a JSON pointer", rule.Path)
+	}
+
+	switch rule.Op {
+	case models.PatchRemove:
+		if len(rule.Value) > 0 || rule.Variable != "" {
+			return fmt.Errorf("patch remove %q takes no value", rule.Path)
+		}
+		return nil
+	case models.PatchAdd, models.PatchReplace:
+	default:
+		return fmt.Errorf("unknown patch op %q", rule.Op)
+	}
+
+	switch rule.Variable {
+	case "":
+		if len(rule.Value) == 0 || !json.Valid(rule.Value) {
+			return fmt.Errorf("patch %s %q requires a JSON value or a variable", rule.Op, rule.Path)
+		}
+	case models.VariableUserID, models.VariablePlan, models.VariableRequestID:
+		if len(rule.Value) > 0 {
+			return fmt.Errorf("patch %s %q takes a value or a variable, not both", rule.Op, rule.Path)
+		}
+	default:
+		return fmt.Errorf("unknown patch variable %q", rule.Variable)
+	}
+
+	return nil
+}
+
+func validateCanary(c *models.Canary) error {
+	if c == nil {
+		return nil
+	}
+
+	switch c.Sticky {
+	case "", models.StickyUser, models.StickyCookie:
+	default:
+		return fmt.Errorf("unknown canary stickiness %q", c.Sticky)
+	}
+
+	if len(c.Versions) == 0 {
+		return fmt.Errorf("canary requires versions")
+	}
+
+	names := make(map[string]bool, len(c.Versions))
+	total := 0
+	for _, v := range c.Versions {
+		if v.Name == "" {
+			return fmt.Errorf("version name is required")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate version %q", v.Name)
+		}
+		names[v.Name] = true
+
+		if v.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for version %q", v.Weight, v.Name)
+		}
+		total += v.Weight
+
+		if v.Host == "" && len(v.Targets) == 0 {
+			return fmt.Errorf("host or targets are required for version %q", v.Name)
+		}
+		if err := validateTargets(v.Upstreams(), v.Targets); err != nil {
+			return fmt.Errorf("invalid version %q: %w", v.Name, err)
+		}
+	}
+
+	if total == 0 {
+		return fmt.Errorf("at least one version needs a weight")
+	}
+
+	return nil
+}
+
+func validateHealthCheck(h *models.HealthCheck) error {
+	if h == nil {
+		return nil
+	}
+
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("health check path %q must start with /", h.Path)
+	}
+	if h.Interval < 0 || h.Timeout < 0 {
+		return fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if h.Timeout > 0 && h.Interval > 0 && h.Timeout > h.Interval {
+		return fmt.Errorf("health check timeout must not exceed its interval")
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check thresholds must be positive")
+	}
+	for _, status := range h.ExpectedStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("invalid expected status %d", status)
+		}
+	}
+
+	return nil
+}
+
+func validateRetryPolicy(p *models.RetryPolicy) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry max attempts must be positive")
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("retry backoff must be positive")
+	}
+	if p.Backoff > 0 && p.MaxBackoff > 0 && p.Backoff > p.MaxBackoff {
+		return fmt.Errorf("retry backoff must not exceed max backoff")
+	}
+	if p.Budget < 0 || p.Budget > 1 {
+		return fmt.Errorf("retry budget must be between 0 and 1")
+	}
+
+	return nil
+}
+
+func validateCircuitBreaker(b *models.CircuitBreaker) error {
+	if b == nil {
+		return nil
+	}
+
+	if b.FailureThreshold < 0 || b.HalfOpenRequests < 0 {
+		return fmt.Errorf("circuit breaker thresholds must be positive")
+	}
+	if b.OpenDuration < 0 {
+		return fmt.Errorf("circuit breaker open duration must be positive")
+	}
+
+	return nil
+}
+
+func validateStreamLimits(l *models.StreamLimits) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.IdleTimeout < 0 || l.MaxLifetime < 0 {
+		return fmt.Errorf("stream idle timeout and max lifetime must be positive")
+	}
+
+	return nil
+}
+
+func validateRewrite(r *models.Rewrite) error {
+	if r == nil {
+		return nil
+	}
+
+	switch r.Mode {
+	case "":
+		r.Mode = models.RewriteStrip
+	case models.RewriteStrip, models.RewriteKeep:
+	case models.RewriteReplace:
+		if !strings.HasPrefix(r.BasePath, "/") {
+			return fmt.Errorf("rewrite base path %q must start with /", r.BasePath)
+		}
+	case models.RewriteRegex:
+		if len(r.Rules) == 0 {
+			return fmt.Errorf("regex rewrite requires rules")
+		}
+	default:
+		return fmt.Errorf("unknown rewrite mode %q", r.Mode)
+	}
+
+	for _, rule := range append(append([]models.RewriteRule{}, r.Rules...), r.ResponseRules...) {
+		if _, err := regexp.Compile(rule.Match); err != nil {
+			return fmt.Errorf("invalid rewrite rule %q: %w", rule.Match, err)
+		}
+	}
+
+	return nil
+}
+
+func validateLimits(l *models.ServiceLimits) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.ConnectTimeout < 0 || l.ResponseHeaderTimeout < 0 || l.Timeout < 0 {
+		return fmt.Errorf("timeouts must be positive")
+	}
+	if l.MaxRequestBodySize < 0 || l.MaxResponseBodySize < 0 {
+		return fmt.Errorf("body sizes must be positive")
+	}
+
+	return nil
+}
+
+func validateMirror(m *models.Mirror) error {
+	if m == nil {
+		return nil
+	}
+
+	u, err := url.Parse(m.Host)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid mirror host %q", m.Host)
+	}
+	if m.Percentage < 0 || m.Percentage > 100 {
+		return fmt.Errorf("mirror percentage must be between 0 and 100")
+	}
+	if m.Timeout < 0 || m.MaxBodySize < 0 {
+		return fmt.Errorf("mirror timeout and max body size must be positive")
+	}
+
+	return nil
+}
+
+func validateHeaderRules(h *models.HeaderRules) error {
+	if h == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(h.Add)+len(h.Set)+len(h.Remove))
+	for name := range h.Add {
+		names = append(names, name)
+	}
+	for name := range h.Set {
+		names = append(names, name)
+	}
+	names = append(names, h.Remove...)
+
+	for _, name := range names {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+
+	for _, values := range []map[string]string{h.Add, h.Set} {
+		for name, value := range values {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("invalid value for header %q", name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,445 @@
+// Package identity logs users in with external identity providers and links
+// their identities to the users of the gateway.
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/ablib/cryptlib"
+	coremodels "github.com/amaurybrisou/ablib/models"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// stateCookie holds the state of a login until the provider redirects back.
+const (
+	stateCookie = "gw_oidc_state"
+	stateMaxAge = 10 * time.Minute
+)
+
+// ErrUnknownProvider is returned for the providers not configured.
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// Store keeps the providers, the users and their identities.
+type Store interface {
+	GetOIDCProviders(ctx context.Context) ([]models.OIDCProvider, error)
+	UpsertOIDCProvider(ctx context.Context, p models.OIDCProvider) (models.OIDCProvider, error)
+	DeleteOIDCProvider(ctx context.Context, name string) (bool, error)
+	GetUserIdentity(ctx context.Context, provider, subject string) (models.UserIdentity, error)
+	CreateUserIdentity(ctx context.Context, i models.UserIdentity) error
+	GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error)
+	GetFullUserByEmail(ctx context.Context, email string) (models.User, error)
+	CreateUser(ctx context.Context, u models.User) (models.User, error)
+}
+
+// Session is the cookie the users are logged in with, as set by the
+// password login.
+type Session struct {
+	Secret string
+	Name   string
+	Domain string
+	MaxAge int
+}
+
+type Config struct {
+	// Providers are configured from the environment, they take precedence
+	// over the providers of the database.
+	Providers []models.OIDCProvider
+	// BaseURL is the public URL of the gateway the providers redirect to.
+	BaseURL string
+	// DefaultRedirect is where the users land after logging in.
+	DefaultRedirect string
+	Session         Session
+	// Client calls the providers.
+	Client *http.Client
+}
+
+type Service struct {
+	store  Store
+	cfg    Config
+	cached *providerCache
+}
+
+func New(store Store, cfg Config) Service {
+	if cfg.DefaultRedirect == "" {
+		cfg.DefaultRedirect = "/home"
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+
+	return Service{
+		store:  store,
+		cfg:    cfg,
+		cached: &providerCache{providers: make(map[string]*cachedProvider)},
+	}
+}
+
+// providerCache keeps the discovered providers until their configuration
+// changes.
+type providerCache struct {
+	mu        sync.Mutex
+	providers map[string]*cachedProvider
+}
+
+type cachedProvider struct {
+	cfg      models.OIDCProvider
+	provider *oidc.Provider
+}
+
+// provider returns the provider named name.
+func (s Service) provider(ctx context.Context, name string) (*oidc.Provider, error) {
+	cfg, ok, err := s.config(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	s.cached.mu.Lock()
+	defer s.cached.mu.Unlock()
+
+	if c, ok := s.cached.providers[name]; ok && reflect.DeepEqual(c.cfg, cfg) {
+		return c.provider, nil
+	}
+
+	p, err := oidc.New(ctx, cfg, s.cfg.Client)
+	if err != nil {
+		return nil, err
+	}
+	s.cached.providers[name] = &cachedProvider{cfg: cfg, provider: p}
+	return p, nil
+}
+
+// config returns the configuration of the provider named name.
+func (s Service) config(ctx context.Context, name string) (models.OIDCProvider, bool, error) {
+	for _, p := range s.cfg.Providers {
+		if p.Name == name {
+			return p, true, nil
+		}
+	}
+
+	providers, err := s.store.GetOIDCProviders(ctx)
+	if err != nil {
+		return models.OIDCProvider{}, false, err
+	}
+	for _, p := range providers {
+		if p.Name == name {
+			// The timestamps change nothing to the provider.
+			p.CreatedAt, p.UpdatedAt = time.Time{}, nil
+			return p, true, nil
+		}
+	}
+	return models.OIDCProvider{}, false, nil
+}
+
+// Session returns the cookie the users are logged in with.
+func (s Service) Session() Session {
+	return s.cfg.Session
+}
+
+func (s Service) redirectURL(provider string) string {
+	return s.cfg.BaseURL + "/auth/oidc/" + provider + "/callback"
+}
+
+// loginState is the content of the state cookie.
+type loginState struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+}
+
+// LoginHandler redirects the user to the provider. The optional redirect
+// parameter is the local path the user lands on once logged in.
+func (s Service) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	p, err := s.provider(r.Context(), name)
+	if errors.Is(err, ErrUnknownProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err := oidc.NewVerifier()
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	value, err := json.Marshal(loginState{
+		Provider: name,
+		State:    state,
+		Verifier: verifier,
+		Redirect: localRedirect(r.URL.Query().Get("redirect"), s.cfg.DefaultRedirect),
+	})
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = cryptlib.SetSignedCookie(w, http.Cookie{
+		Name:     stateCookie,
+		Value:    string(value),
+		Path:     "/auth/oidc/",
+		MaxAge:   int(stateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}, []byte(s.cfg.Session.Secret))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, p.AuthCodeURL(state, verifier, s.redirectURL(name)), http.StatusFound)
+}
+
+// CallbackHandler completes the login once the provider redirects the user
+// back, and logs the user in with the session cookie.
+func (s Service) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+
+	value, err := cryptlib.GetSignedCookie(r, stateCookie, []byte(s.cfg.Session.Secret))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Msg("oidc state cookie")
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	// The state is single use.
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/auth/oidc/", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	var state loginState
+	if err := json.Unmarshal([]byte(value), &state); err != nil || state.Provider != name || state.State == "" || state.State != r.URL.Query().Get("state") {
+		log.Ctx(r.Context()).Error().Str("provider", name).Msg("oidc state mismatch")
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.Ctx(r.Context()).Warn().Str("provider", name).Str("error", e).Str("description", r.URL.Query().Get("error_description")).Msg("oidc login refused")
+		http.Error(w, "login refused by the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	p, err := s.provider(r.Context(), name)
+	if errors.Is(err, ErrUnknownProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	token, err := p.Exchange(r.Context(), r.URL.Query().Get("code"), state.Verifier, s.redirectURL(name))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Str("provider", name).Send()
+		http.Error(w, "failed to log in with the identity provider", http.StatusBadGateway)
+		return
+	}
+
+	identity, err := p.Identity(r.Context(), token)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Str("provider", name).Send()
+		http.Error(w, "failed to log in with the identity provider", http.StatusBadGateway)
+		return
+	}
+
+	user, err := s.link(r.Context(), name, identity)
+	if errors.Is(err, oidc.ErrEmailNotVerified) {
+		log.Ctx(r.Context()).Warn().Str("provider", name).Str("subject", identity.Subject).Msg("oidc email not verified")
+		http.Error(w, "the email address of this account is not verified", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, "failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	err = cryptlib.SetSignedCookie(w, http.Cookie{
+		Name:     s.cfg.Session.Name,
+		Domain:   s.cfg.Session.Domain,
+		Value:    user.ID.String(),
+		Path:     "/",
+		MaxAge:   s.cfg.Session.MaxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}, []byte(s.cfg.Session.Secret))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Ctx(r.Context()).Info().Str("provider", name).Str("user_id", user.ID.String()).Msg("oidc login")
+
+	http.Redirect(w, r, state.Redirect, http.StatusFound)
+}
+
+// link returns the user of identity. Identities seen for the first time
+// are linked to the user with the same verified email address, or to a new
+// user.
+func (s Service) link(ctx context.Context, provider string, identity oidc.Identity) (models.User, error) {
+	linked, err := s.store.GetUserIdentity(ctx, provider, identity.Subject)
+	if err != nil {
+		return models.User{}, err
+	}
+	if linked.UserID != uuid.Nil {
+		return s.store.GetUserByID(ctx, linked.UserID)
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return models.User{}, oidc.ErrEmailNotVerified
+	}
+
+	user, err := s.store.GetFullUserByEmail(ctx, identity.Email)
+	if err != nil {
+		return models.User{}, err
+	}
+	if user.ID == uuid.Nil {
+		user, err = s.store.CreateUser(ctx, models.User{
+			ID:        uuid.New(),
+			Email:     identity.Email,
+			Firstname: identity.Name,
+			AvatarURL: identity.Picture,
+			Role:      coremodels.USER,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			return models.User{}, err
+		}
+		log.Ctx(ctx).Info().Str("provider", provider).Str("user_id", user.ID.String()).Msg("user created from identity")
+	}
+
+	err = s.store.CreateUserIdentity(ctx, models.UserIdentity{
+		Provider: provider,
+		Subject:  identity.Subject,
+		UserID:   user.ID,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	return user, nil
+}
+
+// localRedirect returns redirect when it is a path of the gateway, def
+// otherwise, so that the login cannot redirect to another site.
+func localRedirect(redirect, def string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return def
+	}
+	return redirect
+}
+
+// GetProvidersHandler lists the identity providers, without their secrets.
+func (s Service) GetProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	stored, err := s.store.GetOIDCProviders(r.Context())
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type publicProvider struct {
+		models.OIDCProvider
+		Source string `json:"source"`
+	}
+	providers := []publicProvider{}
+	for _, p := range s.cfg.Providers {
+		p.ClientSecret = ""
+		providers = append(providers, publicProvider{OIDCProvider: p, Source: "env"})
+	}
+	for _, p := range stored {
+		p.ClientSecret = ""
+		providers = append(providers, publicProvider{OIDCProvider: p, Source: "database"})
+	}
+
+	if err := json.NewEncoder(w).Encode(providers); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// PutProviderHandler creates or replaces an identity provider of the
+// database.
+func (s Service) PutProviderHandler(w http.ResponseWriter, r *http.Request) {
+	var p models.OIDCProvider
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.Name = chi.URLParam(r, "provider")
+
+	if err := oidc.Validate(p); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, env := range s.cfg.Providers {
+		if env.Name == p.Name {
+			http.Error(w, fmt.Sprintf("identity provider %s is configured from the environment", p.Name), http.StatusConflict)
+			return
+		}
+	}
+
+	saved, err := s.store.UpsertOIDCProvider(r.Context(), p)
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	saved.ClientSecret = ""
+
+	if err := json.NewEncoder(w).Encode(saved); err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteProviderHandler removes an identity provider of the database.
+func (s Service) DeleteProviderHandler(w http.ResponseWriter, r *http.Request) {
+	deleted, err := s.store.DeleteOIDCProvider(r.Context(), chi.URLParam(r, "provider"))
+	if err != nil {
+		log.Ctx(r.Context()).Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "identity provider not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package identity_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/amaurybrisou/ablib/cryptlib"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/identity"
+	"github.com/amaurybrisou/gateway/src/oidc/oidctest"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type store struct {
+	mu         sync.Mutex
+	providers  []models.OIDCProvider
+	users      map[uuid.UUID]models.User
+	identities map[string]models.UserIdentity
+}
+
+func newStore() *store {
+	return &store{users: make(map[uuid.UUID]models.User), identities: make(map[string]models.UserIdentity)}
+}
+
+func (s *store) GetOIDCProviders(ctx context.Context) ([]models.OIDCProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]models.OIDCProvider(nil), s.providers...), nil
+}
+
+func (s *store) UpsertOIDCProvider(ctx context.Context, p models.OIDCProvider) (models.OIDCProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers = append(s.providers, p)
+	return p, nil
+}
+
+func (s *store) DeleteOIDCProvider(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
+func (s *store) GetUserIdentity(ctx context.Context, provider, subject string) (models.UserIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.identities[provider+"/"+subject], nil
+}
+
+func (s *store) CreateUserIdentity(ctx context.Context, i models.UserIdentity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities[i.Provider+"/"+i.Subject] = i
+	return nil
+}
+
+func (s *store) GetUserByID(ctx context.Context, userID uuid.UUID) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[userID], nil
+}
+
+func (s *store) GetFullUserByEmail(ctx context.Context, email string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return models.User{}, nil
+}
+
+func (s *store) CreateUser(ctx context.Context, u models.User) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.ID] = u
+	return u, nil
+}
+
+var session = identity.Session{Secret: "cookie-secret", Name: "session", MaxAge: 3600}
+
+// gateway serves the identity routes of a service configured with cfg.
+func gateway(s identity.Store, cfg identity.Config) *httptest.Server {
+	r := chi.NewRouter()
+	srv := httptest.NewServer(r)
+
+	cfg.BaseURL = srv.URL
+	cfg.Session = session
+	svc := identity.New(s, cfg)
+
+	r.Get("/auth/oidc/{provider}/login", svc.LoginHandler)
+	r.Get("/auth/oidc/{provider}/callback", svc.CallbackHandler)
+	r.Put("/auth/admin/oidc-providers/{provider}", svc.PutProviderHandler)
+
+	return srv
+}
+
+var noRedirect = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// login goes through a whole login with the provider, it returns the
+// response of the callback and the user id of its session cookie.
+func login(t *testing.T, gw *httptest.Server, provider, redirect string) (*http.Response, string) {
+	u := gw.URL + "/auth/oidc/" + provider + "/login"
+	if redirect != "" {
+		u += "?redirect=" + url.QueryEscape(redirect)
+	}
+
+	resp, err := noRedirect.Get(u)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	state := resp.Cookies()
+
+	// The mock provider redirects straight back to the callback.
+	resp, err = noRedirect.Get(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+	require.NoError(t, err)
+	for _, c := range state {
+		req.AddCookie(c)
+	}
+	resp, err = noRedirect.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	for _, c := range resp.Cookies() {
+		if c.Name != session.Name {
+			continue
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(c)
+		userID, err := cryptlib.GetSignedCookie(req, session.Name, []byte(session.Secret))
+		require.NoError(t, err)
+		return resp, userID
+	}
+
+	return resp, ""
+}
+
+func TestLogin(t *testing.T) {
+	provider := oidctest.NewServer(oidctest.User{Subject: "u-1", Email: "ada@example.org", EmailVerified: true, Name: "Ada"})
+	defer provider.Close()
+
+	s := newStore()
+	existing := models.User{ID: uuid.New(), Email: "grace@example.org"}
+	s.users[existing.ID] = existing
+
+	gw := gateway(s, identity.Config{Providers: []models.OIDCProvider{provider.Provider("corp")}})
+	defer gw.Close()
+
+	// A new user is created and linked.
+	resp, userID := login(t, gw, "corp", "/services")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "/services", resp.Header.Get("Location"))
+	require.NotEmpty(t, userID)
+	created := s.users[uuid.MustParse(userID)]
+	require.Equal(t, "ada@example.org", created.Email)
+	require.Equal(t, "Ada", created.Firstname)
+	require.Equal(t, created.ID, s.identities["corp/u-1"].UserID)
+
+	// The identity logs the same user in again, whatever its email.
+	provider.SetUser(oidctest.User{Subject: "u-1", Email: "ada@new.example.org", Name: "Ada"})
+	resp, again := login(t, gw, "corp", "https://evil.example/")
+	require.Equal(t, userID, again)
+	require.Equal(t, "/home", resp.Header.Get("Location"))
+	require.Len(t, s.users, 2)
+
+	// A new identity is linked to the user with its verified email.
+	provider.SetUser(oidctest.User{Subject: "u-2", Email: "grace@example.org", EmailVerified: true})
+	_, linked := login(t, gw, "corp", "")
+	require.Equal(t, existing.ID.String(), linked)
+	require.Equal(t, existing.ID, s.identities["corp/u-2"].UserID)
+
+	// Unless the email is not verified.
+	provider.SetUser(oidctest.User{Subject: "u-3", Email: "grace@example.org"})
+	resp, none := login(t, gw, "corp", "")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Empty(t, none)
+	require.NotContains(t, s.identities, "corp/u-3")
+}
+
+func TestLoginFromDatabase(t *testing.T) {
+	provider := oidctest.NewServer(oidctest.User{Subject: "7", Email: "ada@example.org", EmailVerified: true, Name: "ada"})
+	defer provider.Close()
+
+	s := newStore()
+	s.providers = []models.OIDCProvider{provider.GitHubProvider("github")}
+
+	gw := gateway(s, identity.Config{})
+	defer gw.Close()
+
+	resp, userID := login(t, gw, "github", "")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.NotEmpty(t, userID)
+	require.Equal(t, uuid.MustParse(userID), s.identities["github/7"].UserID)
+
+	resp, err := http.Get(gw.URL + "/auth/oidc/unknown/login")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestCallbackState(t *testing.T) {
+	provider := oidctest.NewServer(oidctest.User{Subject: "u-1", Email: "ada@example.org", EmailVerified: true})
+	defer provider.Close()
+
+	gw := gateway(newStore(), identity.Config{Providers: []models.OIDCProvider{provider.Provider("corp")}})
+	defer gw.Close()
+
+	// Without the state cookie of the login.
+	resp, err := http.Get(gw.URL + "/auth/oidc/corp/callback?code=c&state=s")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// With the state of another login.
+	resp, err = noRedirect.Get(gw.URL + "/auth/oidc/corp/login")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, gw.URL+"/auth/oidc/corp/callback?code=c&state=forged", nil)
+	require.NoError(t, err)
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+	resp, err = noRedirect.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPutProvider(t *testing.T) {
+	s := newStore()
+	gw := gateway(s, identity.Config{Providers: []models.OIDCProvider{{Name: "google", Kind: models.OIDCKindGoogle, ClientID: "id"}}})
+	defer gw.Close()
+
+	put := func(name, body string) int {
+		req, err := http.NewRequest(http.MethodPut, gw.URL+"/auth/admin/oidc-providers/"+name, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, put("corp", `{"kind":"oidc","issuer":"https://sso.corp.example","client_id":"id","client_secret":"secret"}`))
+	require.Equal(t, "corp", s.providers[0].Name)
+	require.Equal(t, http.StatusBadRequest, put("corp", `{"kind":"oidc","client_id":"id"}`))
+	require.Equal(t, http.StatusConflict, put("google", `{"kind":"google","client_id":"id"}`))
+}
@@ -2,19 +2,22 @@ package payment
 
 import (
 	"context"
-	"fmt"
-	"strings"
 	"time"
 
-	"github.com/amaurybrisou/ablib"
-	"github.com/amaurybrisou/ablib/cryptlib"
 	coremodels "github.com/amaurybrisou/ablib/models"
 	"github.com/amaurybrisou/gateway/src/database/models"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// Activator emails the new users the link to activate their account.
+type Activator interface {
+	SendActivation(ctx context.Context, user models.User) error
+}
+
+// RegisterUser creates the account of a customer, pending until the customer
+// follows the activation link emailed to choose a password. Customers whose
+// account is still pending get a new link.
 func (s Service) RegisterUser(ctx context.Context, externalID, email, name string) (models.User, error) {
 	user, err := s.db.GetFullUserByEmail(ctx, email)
 	if err != nil {
@@ -23,32 +26,18 @@ func (s Service) RegisterUser(ctx context.Context, externalID, email, name strin
 
 	if user.ID != uuid.Nil {
 		log.Ctx(ctx).Debug().Any("user", user).Msg("user already exists")
+		if user.IsNew {
+			s.sendActivation(ctx, user)
+		}
 		return user, nil
 	}
 
-	password, err := cryptlib.GenerateRandomPassword(16)
-	if err != nil {
-		return models.User{}, err
-	}
-
-	env := ablib.LookupEnv("ENV", "dev")
-	if env == "dev" {
-		fmt.Println(strings.Repeat("#", 100))
-		fmt.Println("Password:", password)
-		fmt.Println(strings.Repeat("#", 100))
-	}
-
-	hashedPassword, err := cryptlib.GenerateHash(password, bcrypt.DefaultCost)
-	if err != nil {
-		return models.User{}, err
-	}
-
+	// The user has no password, and is_new set, until the activation.
 	u := models.User{
 		ID:         uuid.New(),
 		ExternalID: externalID,
 		Email:      email,
 		Firstname:  name,
-		Password:   hashedPassword,
 		Role:       coremodels.USER,
 		CreatedAt:  time.Now(),
 	}
@@ -58,19 +47,23 @@ func (s Service) RegisterUser(ctx context.Context, externalID, email, name strin
 		return u, err
 	}
 
-	go func() {
-		if s.mailcli != nil && env == "prod" {
-			err := s.mailcli.SendPasswordEmail(u.Email, hashedPassword)
-			if err != nil {
-				log.Ctx(ctx).Error().Err(err).Msg("error sending auto generated password email")
-				fmt.Println(strings.Repeat("#", 100))
-				fmt.Println("Password:", password)
-				fmt.Println(strings.Repeat("#", 100))
-				return
-			}
-			log.Ctx(ctx).Debug().Any("email", u.Email).Msg("auto generated password email sent")
-		}
-	}()
+	s.sendActivation(ctx, u)
 
 	return u, nil
 }
+
+// sendActivation emails the activation link. The checkout is not failed
+// when the email cannot be sent, the user can ask for a new link with a
+// password reset.
+func (s Service) sendActivation(ctx context.Context, u models.User) {
+	if s.activation == nil {
+		return
+	}
+
+	if err := s.activation.SendActivation(ctx, u); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("user_id", u.ID.String()).Msg("error sending activation email")
+		return
+	}
+
+	log.Ctx(ctx).Debug().Str("user_id", u.ID.String()).Msg("activation email sent")
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/amaurybrisou/ablib/jwtlib"
-	"github.com/amaurybrisou/ablib/mailcli"
 	"github.com/amaurybrisou/gateway/src/database"
 	"github.com/amaurybrisou/gateway/src/database/models"
 	"github.com/google/uuid"
@@ -23,7 +22,7 @@ type Service struct {
 	*client.API
 	db            *database.Database
 	jwt           *jwtlib.JWT
-	mailcli       *mailcli.MailClient
+	activation    Activator
 	stripeKey     string
 	successURL    string
 	webHookSecret string
@@ -34,7 +33,7 @@ type Config struct {
 	StripeKey, StripeSuccessURL, StripeCancelURL, StripeWebHookSecret string
 }
 
-func NewService(db *database.Database, jwt *jwtlib.JWT, mail *mailcli.MailClient, cfg Config) Service {
+func NewService(db *database.Database, jwt *jwtlib.JWT, activation Activator, cfg Config) Service {
 	stripe.Key = cfg.StripeKey
 
 	// stripeClient := &client.API{}
@@ -43,7 +42,7 @@ func NewService(db *database.Database, jwt *jwtlib.JWT, mail *mailcli.MailClient
 	return Service{
 		db:            db,
 		jwt:           jwt,
-		mailcli:       mail,
+		activation:    activation,
 		stripeKey:     cfg.StripeKey,
 		successURL:    cfg.StripeSuccessURL,
 		cancelURL:     cfg.StripeCancelURL,
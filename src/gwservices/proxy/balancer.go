@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/google/uuid"
+)
+
+// balancer selects the target a request is sent to.
+type balancer interface {
+	// pick returns one of the available targets, available is never empty.
+	pick(r *http.Request, available []*target) *target
+}
+
+func newBalancer(strategy string, targets []*target) balancer {
+	switch strategy {
+	case models.LoadBalancingLeastConnections:
+		return &leastConnections{}
+	case models.LoadBalancingConsistentHash:
+		return newConsistentHash(targets)
+	default:
+		return &roundRobin{current: make(map[*target]int, len(targets))}
+	}
+}
+
+// roundRobin is a smooth weighted round robin, targets with a higher weight
+// are picked more often without being picked in bursts.
+type roundRobin struct {
+	mu      sync.Mutex
+	current map[*target]int
+}
+
+func (b *roundRobin) pick(_ *http.Request, available []*target) *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	var best *target
+	for _, t := range available {
+		b.current[t] += t.weight
+		total += t.weight
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+	b.current[best] -= total
+
+	return best
+}
+
+// leastConnections picks the target with the fewest in-flight requests
+// relative to its weight.
+type leastConnections struct {
+	offset atomic.Uint32
+}
+
+func (b *leastConnections) pick(_ *http.Request, available []*target) *target {
+	// Rotate the starting point so ties are spread across targets.
+	start := int(b.offset.Add(1)) % len(available)
+
+	best := available[start]
+	for i := 1; i < len(available); i++ {
+		t := available[(start+i)%len(available)]
+		if t.active.Load()*int64(best.weight) < best.active.Load()*int64(t.weight) {
+			best = t
+		}
+	}
+
+	return best
+}
+
+// virtualNodes is the number of points a target of weight 1 owns on the ring.
+const virtualNodes = 40
+
+type ringPoint struct {
+	hash   uint32
+	target *target
+}
+
+// consistentHash sends the requests of a user to the same target as long as
+// it is available, anonymous requests are hashed by client IP.
+type consistentHash struct {
+	ring []ringPoint
+}
+
+func newConsistentHash(targets []*target) *consistentHash {
+	b := &consistentHash{}
+	for _, t := range targets {
+		for i := 0; i < t.weight*virtualNodes; i++ {
+			b.ring = append(b.ring, ringPoint{hash: hash32(t.url.String() + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+
+	return b
+}
+
+func (b *consistentHash) pick(r *http.Request, available []*target) *target {
+	h := hash32(hashKey(r))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+
+	for i := 0; i < len(b.ring); i++ {
+		t := b.ring[(start+i)%len(b.ring)].target
+		for _, a := range available {
+			if a == t {
+				return t
+			}
+		}
+	}
+
+	return available[0]
+}
+
+func hashKey(r *http.Request) string {
+	if userID, ok := r.Context().Value(ablibhttp.UserIDCtxKey).(uuid.UUID); ok {
+		return userID.String()
+	}
+
+	return forwarded.ClientIP(r)
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s)) //nolint
+	return h.Sum32()
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops sending traffic to a target after consecutive
+// failures, then lets a few probe requests through once OpenDuration has
+// elapsed to decide whether to close again.
+type circuitBreaker struct {
+	cfg      models.CircuitBreaker
+	onChange func(to breakerState)
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	probes    int
+	openUntil time.Time
+	// generation changes with the state, the outcomes of the requests let
+	// through in another state are ignored.
+	generation uint64
+}
+
+// breakerTicket identifies a request let through by acquire.
+type breakerTicket struct {
+	generation uint64
+}
+
+func newCircuitBreaker(cfg models.CircuitBreaker, onChange func(to breakerState)) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, onChange: onChange}
+}
+
+// ready reports whether a request could be let through at now.
+func (b *circuitBreaker) ready(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return !now.Before(b.openUntil)
+	case breakerHalfOpen:
+		return b.probes < b.cfg.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// acquire lets a request through, its outcome must be reported with
+// record or release.
+func (b *circuitBreaker) acquire(now time.Time) (breakerTicket, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if now.Before(b.openUntil) {
+			return breakerTicket{}, false
+		}
+		b.probes = 0
+		b.setState(breakerHalfOpen)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return breakerTicket{}, false
+		}
+		b.probes++
+	}
+
+	return breakerTicket{generation: b.generation}, true
+}
+
+// record counts the outcome of a request let through by acquire. Requests
+// let through before the last state change are ignored: a request sent
+// while closed says nothing about the target once it is half-open.
+func (b *circuitBreaker) record(ticket breakerTicket, ok bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket.generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.probes--
+		if ok {
+			b.failures = 0
+			b.setState(breakerClosed)
+			return
+		}
+		b.open(now)
+	case breakerClosed:
+		if ok {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.open(now)
+		}
+	}
+}
+
+// release gives back a request let through by acquire without counting its
+// outcome, for instance when the client went away.
+func (b *circuitBreaker) release(ticket breakerTicket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ticket.generation == b.generation && b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// openFor returns how long the breaker stays open.
+func (b *circuitBreaker) openFor(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	return b.openUntil.Sub(now)
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.failures = 0
+	b.openUntil = now.Add(b.cfg.OpenDuration.Duration())
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	b.generation++
+	if b.onChange != nil {
+		b.onChange(s)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerStaleOutcomes(t *testing.T) {
+	now := time.Now()
+	b := proxy.NewCircuitBreaker(&models.CircuitBreaker{
+		FailureThreshold: 1,
+		OpenDuration:     models.Duration(time.Second),
+		HalfOpenRequests: 1,
+	})
+
+	// A slow request is sent while the breaker is closed.
+	slow, ok := b.Acquire(now)
+	require.True(t, ok)
+
+	failed, ok := b.Acquire(now)
+	require.True(t, ok)
+	b.Record(failed, false, now)
+	require.Equal(t, "open", b.State())
+
+	now = now.Add(time.Second)
+	probe, ok := b.Acquire(now)
+	require.True(t, ok)
+	require.Equal(t, "half_open", b.State())
+	_, ok = b.Acquire(now)
+	require.False(t, ok)
+
+	// It succeeds once the breaker is half-open: it is not a probe.
+	b.Record(slow, true, now)
+	require.Equal(t, "half_open", b.State())
+	_, ok = b.Acquire(now)
+	require.False(t, ok)
+
+	b.Record(probe, true, now)
+	require.Equal(t, "closed", b.State())
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	now := time.Now()
+	b := proxy.NewCircuitBreaker(&models.CircuitBreaker{
+		FailureThreshold: 1,
+		OpenDuration:     models.Duration(time.Second),
+		HalfOpenRequests: 1,
+	})
+
+	slow, _ := b.Acquire(now)
+	failed, _ := b.Acquire(now)
+	b.Record(failed, false, now)
+
+	now = now.Add(time.Second)
+	probe, ok := b.Acquire(now)
+	require.True(t, ok)
+
+	// Releasing a stale request does not free the probe slot.
+	b.Release(slow)
+	_, ok = b.Acquire(now)
+	require.False(t, ok)
+
+	// Releasing the probe does.
+	b.Release(probe)
+	probe, ok = b.Acquire(now)
+	require.True(t, ok)
+	b.Record(probe, false, now)
+	require.Equal(t, "open", b.State())
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+)
+
+// BackendVersionHeader tells the upstream which version of its service a
+// request was routed to.
+const BackendVersionHeader = "X-Gateway-Backend-Version"
+
+// How the version of a request was decided.
+const (
+	decisionUser     = "user"
+	decisionCookie   = "cookie"
+	decisionWeighted = "weighted"
+)
+
+// pickVersion returns the version of service r is routed to and how it was
+// decided, ok is false when the service is not split between versions. With
+// the cookie stickiness, the cookie of a new assignment is set on w.
+func pickVersion(service models.Service, w http.ResponseWriter, r *http.Request) (v models.Version, decision string, ok bool) {
+	c := service.Canary
+	if c == nil || len(c.Versions) == 0 {
+		return models.Version{}, "", false
+	}
+
+	if c.Sticky == models.StickyUser {
+		if userID, ok := r.Context().Value(ablibhttp.UserIDCtxKey).(uuid.UUID); ok {
+			return versionAt(c.Versions, bucket(userID.String())), decisionUser, true
+		}
+		// Anonymous users are kept on their version with the cookie.
+	}
+
+	if c.Sticky == "" {
+		return versionAt(c.Versions, rand.Float64()), decisionWeighted, true //nolint:gosec
+	}
+
+	if cookie, err := r.Cookie(c.CookieName()); err == nil {
+		for _, v := range c.Versions {
+			// A version drained of its traffic releases its users.
+			if v.Name == cookie.Value && v.Weight > 0 {
+				return v, decisionCookie, true
+			}
+		}
+	}
+
+	v = versionAt(c.Versions, rand.Float64()) //nolint:gosec
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.CookieName(),
+		Value:    v.Name,
+		Path:     cleanPrefix(service.Prefix),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return v, decisionWeighted, true
+}
+
+// bucket maps key to a stable position in [0, 1). Users keep their position
+// when the weights change, so shifting weight from a version to another only
+// moves the users at the boundary.
+func bucket(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key)) //nolint
+	return float64(h.Sum64()%10000) / 10000
+}
+
+// versionAt returns the version at position x in [0, 1) of the versions
+// laid out according to their weights.
+func versionAt(versions []models.Version, x float64) models.Version {
+	total := 0
+	for _, v := range versions {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return versions[0]
+	}
+
+	position := x * float64(total)
+	cumulative := 0
+	for _, v := range versions {
+		cumulative += v.Weight
+		if position < float64(cumulative) {
+			return v
+		}
+	}
+
+	return versions[len(versions)-1]
+}
@@ -0,0 +1,123 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyCanary(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s:%s", name, r.Header.Get(proxy.BackendVersionHeader))
+		}))
+	}
+	v1, v2 := backend("one"), backend("two")
+	defer v1.Close()
+	defer v2.Close()
+
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second))
+	service := func(sticky string, w1, w2 int) models.Service {
+		return models.Service{
+			ID:     uuid.MustParse("6f1c2a43-5b7e-4a8e-9a3e-1a2b3c4d5e6f"),
+			Name:   "hello",
+			Prefix: "/hello",
+			Canary: &models.Canary{
+				Sticky: sticky,
+				Versions: []models.Version{
+					{Name: "v1", Weight: w1, Host: v1.URL},
+					{Name: "v2", Weight: w2, Host: v2.URL},
+				},
+			},
+		}
+	}
+	do := func(s models.Service, req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ProxyHandler(s, nil, nil).ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("weighted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/hello/", nil)
+		req.Header.Set(proxy.BackendVersionHeader, "v2")
+
+		w := do(service("", 0, 100), req)
+		require.Equal(t, "two:v2", w.Body.String())
+
+		w = do(service("", 100, 0), req)
+		require.Equal(t, "one:v1", w.Body.String())
+		require.Empty(t, w.Header().Get("Set-Cookie"))
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		w := do(service(models.StickyCookie, 0, 100), httptest.NewRequest(http.MethodGet, "/hello/", nil))
+		require.Equal(t, "two:v2", w.Body.String())
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		require.Equal(t, "gw_backend_version", cookies[0].Name)
+		require.Equal(t, "v2", cookies[0].Value)
+		require.Equal(t, "/hello", cookies[0].Path)
+
+		// The user stays on v2 as the weights shift back to v1.
+		req := httptest.NewRequest(http.MethodGet, "/hello/", nil)
+		req.AddCookie(cookies[0])
+		w = do(service(models.StickyCookie, 90, 10), req)
+		require.Equal(t, "two:v2", w.Body.String())
+		require.Empty(t, w.Header().Get("Set-Cookie"))
+
+		// Until v2 gets no traffic at all.
+		w = do(service(models.StickyCookie, 100, 0), req)
+		require.Equal(t, "one:v1", w.Body.String())
+		require.Contains(t, w.Header().Get("Set-Cookie"), "gw_backend_version=v1")
+	})
+
+	t.Run("user", func(t *testing.T) {
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/hello/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), ablibhttp.UserIDCtxKey, uuid.New()))
+
+			first := do(service(models.StickyUser, 50, 50), req).Body.String()
+			again := do(service(models.StickyUser, 50, 50), req).Body.String()
+			require.Equal(t, first, again)
+			counts[first]++
+
+			// Shifting weight to v2 never moves a user off v2.
+			if first == "two:v2" {
+				require.Equal(t, "two:v2", do(service(models.StickyUser, 20, 80), req).Body.String())
+			}
+		}
+
+		require.InDelta(t, 500, counts["one:v1"], 100)
+		require.InDelta(t, 500, counts["two:v2"], 100)
+	})
+}
+
+func TestProxyCanaryUpstreamDrain(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok") //nolint
+	}))
+	defer u.Close()
+
+	// A version without weight gets no traffic.
+	w := serve(t, models.Service{
+		Canary: &models.Canary{Versions: []models.Version{
+			{Name: "old", Weight: 0, Host: "http://127.0.0.1:1"},
+			{Name: "new", Weight: 1, Host: u.URL},
+		}},
+	}, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "ok", w.Body.String())
+}
@@ -0,0 +1,39 @@
+package proxy_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyCompression(t *testing.T) {
+	body := strings.Repeat("hello ", 1000)
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body) //nolint
+	}))
+	defer u.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	w := serve(t, models.Service{Host: u.URL}, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	b, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, body, string(b))
+
+	w = serve(t, models.Service{Host: u.URL, Compression: &models.Compression{Disabled: true}}, req)
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Equal(t, body, w.Body.String())
+}
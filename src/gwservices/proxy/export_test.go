@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/iprules"
+	"github.com/amaurybrisou/gateway/src/ratelimit"
+	"github.com/amaurybrisou/gateway/src/upstreamtls"
+)
+
+// NewUpstreamTransport exposes the load balancing transport to the tests.
+func NewUpstreamTransport(s models.Service) (http.RoundTripper, error) {
+	return NewUpstreamTransportWithHealth(s, nil)
+}
+
+// NewUpstreamTransportWithHealth is NewUpstreamTransport filtering the targets
+// with health.
+func NewUpstreamTransportWithHealth(s models.Service, health HealthState) (http.RoundTripper, error) {
+	tlsConfig, err := upstreamtls.Config(s.TLS)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newUpstreamPool(s, "", health, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return upstreamTransport{pool: p, base: p.transport}, nil
+}
+
+// NewTestProxy returns a proxy able to serve ProxyHandler without a database.
+func NewTestProxy(streams *Streams) Proxy {
+	return Proxy{upstreams: newUpstreams(nil), streams: streams, redirects: Redirects{}.WithDefaults()}
+}
+
+// WithRedirects returns the proxy redirecting with r.
+func (s Proxy) WithRedirects(r Redirects) Proxy {
+	s.redirects = r.WithDefaults()
+	return s
+}
+
+// NotFound answers r as a request of an unknown service.
+func (s Proxy) NotFound(w http.ResponseWriter, r *http.Request) {
+	s.notFound(w, r)
+}
+
+// NoRole answers r as a request of a user missing the role of service.
+func (s Proxy) NoRole(w http.ResponseWriter, r *http.Request, service models.Service) {
+	s.noRole(w, r, service)
+}
+
+// WithMirrors returns the proxy sending its mirrored traffic with m.
+func (s Proxy) WithMirrors(m *Mirrors) Proxy {
+	s.mirrors = m
+	return s
+}
+
+// WithLimiter returns the proxy limiting the requests with l.
+func (s Proxy) WithLimiter(l *ratelimit.Limiter) Proxy {
+	s.limiter = l
+	return s
+}
+
+// RateLimit counts r against policy as the requests of service.
+func (s Proxy) RateLimit(w http.ResponseWriter, r *http.Request, service models.Service, policy ratelimit.Policy) bool {
+	return s.rateLimit(w, r, service, policy, nil)
+}
+
+// WithIPRules returns the proxy denying the clients of l.
+func (s Proxy) WithIPRules(l *iprules.DenyList) Proxy {
+	s.ipRules = l
+	return s
+}
+
+// CircuitBreaker exposes the circuit breaker of the targets to the tests.
+type CircuitBreaker struct {
+	b *circuitBreaker
+}
+
+// BreakerTicket identifies a request let through by a CircuitBreaker.
+type BreakerTicket = breakerTicket
+
+func NewCircuitBreaker(cfg *models.CircuitBreaker) CircuitBreaker {
+	return CircuitBreaker{b: newCircuitBreaker(cfg.WithDefaults(), nil)}
+}
+
+func (c CircuitBreaker) Acquire(now time.Time) (BreakerTicket, bool) {
+	return c.b.acquire(now)
+}
+
+func (c CircuitBreaker) Record(ticket BreakerTicket, ok bool, now time.Time) {
+	c.b.record(ticket, ok, now)
+}
+
+func (c CircuitBreaker) Release(ticket BreakerTicket) {
+	c.b.release(ticket)
+}
+
+func (c CircuitBreaker) State() string {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	return c.b.state.String()
+}
+
+// WithServiceByName returns the proxy finding the services of PublicRoutes
+// with byName.
+func (s Proxy) WithServiceByName(byName ServiceByName) Proxy {
+	s.byName = byName
+	return s
+}
+
+// WithRouteTable returns the proxy routing with t, the upstream pools are
+// pruned on every reload of t as they are by New.
+func (s Proxy) WithRouteTable(t *RouteTable) Proxy {
+	s.routes = t
+	t.OnReload(s.upstreams.prune)
+	return s
+}
+
+// UpstreamPool builds the pool of service routed to version.
+func (s Proxy) UpstreamPool(service models.Service, version string) error {
+	_, err := s.upstreams.get(service, version)
+	return err
+}
+
+// UpstreamPools returns the number of cached upstream pools.
+func (s Proxy) UpstreamPools() int {
+	s.upstreams.mu.RLock()
+	defer s.upstreams.mu.RUnlock()
+	return len(s.upstreams.pools)
+}
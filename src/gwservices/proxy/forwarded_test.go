@@ -0,0 +1,33 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyForwardingHeaders(t *testing.T) {
+	var received http.Header
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer u.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.test/", nil)
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	req.Header.Set("X-Forwarded-Host", "admin.test")
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	w := serve(t, models.Service{Host: u.URL}, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The client is not a trusted proxy, its headers are replaced and the
+	// reverse proxy adds it once.
+	require.Equal(t, []string{"192.0.2.1"}, received.Values("X-Forwarded-For"))
+	require.Equal(t, "api.test", received.Get("X-Forwarded-Host"))
+	require.Equal(t, "http", received.Get("X-Forwarded-Proto"))
+	require.Equal(t, "192.0.2.1", received.Get("X-Real-IP"))
+	require.Equal(t, "for=192.0.2.1;host=api.test;proto=http", received.Get("Forwarded"))
+}
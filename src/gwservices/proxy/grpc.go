@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// gRPC status codes answered by the gateway.
+const (
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcPermissionDenied  = 7
+	grpcUnauthenticated   = 16
+)
+
+// IsGRPC reports whether r is a gRPC call.
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// isGRPCStream reports whether r is a gRPC call to a gRPC service, the only
+// calls proxied as streams whatever the upstream answers.
+func isGRPCStream(service models.Service, r *http.Request) bool {
+	return service.Protocol == models.ProtocolGRPC && IsGRPC(r)
+}
+
+// grpcStatus maps the HTTP status the gateway answers with to a gRPC code.
+func grpcStatus(status int) int {
+	switch status {
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	default:
+		return grpcInternal
+	}
+}
+
+// writeGRPCStatus answers a gRPC call with a trailers-only response carrying
+// code, the HTTP status of gRPC responses is always 200.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		h.Set("Grpc-Message", grpcPercentEncode(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeError answers r with status, or its gRPC equivalent for gRPC calls,
+// the other clients get the error page of service.
+func (s Proxy) writeError(w http.ResponseWriter, r *http.Request, service *models.Service, status int, message string) {
+	if IsGRPC(r) {
+		writeGRPCStatus(w, grpcStatus(status), message)
+		return
+	}
+	s.pages.Write(w, r, service, status, message)
+}
+
+// grpcPercentEncode encodes a grpc-message as required by the gRPC HTTP/2
+// protocol.
+func grpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+	}
+	return b.String()
+}
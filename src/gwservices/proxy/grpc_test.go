@@ -0,0 +1,129 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func h2cServer(h http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+}
+
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestProxyGRPCStream(t *testing.T) {
+	// The upstream echoes every line of the request and ends with a gRPC
+	// status in the trailers.
+	u := h2cServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			io.WriteString(w, scanner.Text()+"\n") //nolint
+			w.(http.Flusher).Flush()
+		}
+
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer u.Close()
+
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second))
+	service := models.Service{ID: uuid.New(), Name: "echo", Host: u.URL, Protocol: models.ProtocolGRPC}
+	gw := h2cServer(p.ProxyHandler(service, nil, nil))
+	defer gw.Close()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, gw.URL+"/echo.Echo/Stream", pr)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := h2cClient().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Each message goes through before the call ends.
+	reader := bufio.NewReader(resp.Body)
+	for _, msg := range []string{"one", "two"} {
+		_, err := io.WriteString(pw, msg+"\n")
+		require.NoError(t, err)
+
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, msg+"\n", line)
+	}
+	require.NoError(t, pw.Close())
+
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestProxyGRPCError(t *testing.T) {
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second))
+	service := models.Service{ID: uuid.New(), Name: "echo", Host: "http://127.0.0.1:1", Protocol: models.ProtocolH2C}
+
+	req := httptest.NewRequest(http.MethodPost, "/echo.Echo/Unary", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	w := httptest.NewRecorder()
+	p.ProxyHandler(service, nil, nil).ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/grpc", w.Header().Get("Content-Type"))
+	require.Equal(t, "14", w.Header().Get("Grpc-Status"))
+	require.Equal(t, "Bad Gateway", w.Header().Get("Grpc-Message"))
+}
+
+func TestProxyProtocols(t *testing.T) {
+	u := h2cServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto) //nolint
+	}))
+	defer u.Close()
+
+	tests := []struct {
+		protocol string
+		proto    string
+	}{
+		{protocol: models.ProtocolHTTP1, proto: "HTTP/1.1"},
+		{protocol: models.ProtocolH2C, proto: "HTTP/2.0"},
+		{protocol: models.ProtocolGRPC, proto: "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			w := serve(t, models.Service{Host: u.URL, Protocol: tt.protocol}, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, tt.proto, w.Body.String())
+		})
+	}
+}
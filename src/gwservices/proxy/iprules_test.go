@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/amaurybrisou/gateway/src/iprules"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPRules(t *testing.T) {
+	called := false
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer u.Close()
+
+	var global []models.IPRule
+	denyList := iprules.NewDenyList(func(ctx context.Context) ([]models.IPRule, error) {
+		return global, nil
+	}, nil)
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second)).WithIPRules(denyList)
+
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+
+	serve := func(service models.Service, remoteAddr string) *httptest.ResponseRecorder {
+		called = false
+		logs.Reset()
+		ctx := context.WithValue(logger.WithContext(context.Background()), middleware.RequestIDKey, "req-1")
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		p.ProxyHandler(service, nil, nil).ServeHTTP(w, req)
+		return w
+	}
+
+	service := models.Service{
+		ID:   uuid.New(),
+		Name: "internal",
+		Host: u.URL,
+		IPRules: &models.IPRules{
+			Allow: []string{"192.0.2.0/24"},
+			Deny:  []string{"192.0.2.66"},
+		},
+	}
+
+	w := serve(service, "192.0.2.1:1234")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, called)
+
+	w = serve(service, "203.0.113.7:1234")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.False(t, called)
+	require.JSONEq(t, `{"status":403,"error":"Forbidden","message":"Forbidden","request_id":"req-1"}`, w.Body.String())
+	require.Contains(t, logs.String(), `"request_id":"req-1"`)
+	require.Contains(t, logs.String(), `"client_ip":"203.0.113.7"`)
+	require.Contains(t, logs.String(), `"rule":"not allowed"`)
+
+	w = serve(service, "192.0.2.66:1234")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, logs.String(), `"rule":"deny 192.0.2.66/32"`)
+
+	// The global deny list applies to every service, updated at runtime.
+	global = []models.IPRule{{ID: uuid.New(), CIDR: "192.0.2.0/28"}}
+	require.NoError(t, denyList.Reload(context.Background()))
+
+	w = serve(service, "192.0.2.1:1234")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, logs.String(), `"rule":"global deny 192.0.2.0/28"`)
+
+	w = serve(models.Service{ID: uuid.New(), Host: u.URL}, "192.0.2.1:1234")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = serve(models.Service{ID: uuid.New(), Host: u.URL}, "192.0.2.20:1234")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, called)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// ErrResponseTooLarge is returned when an upstream response exceeds the
+// maximum response body size of its service.
+var ErrResponseTooLarge = errors.New("upstream response too large")
+
+// newTransport returns the transport of a service, it mirrors
+// http.DefaultTransport with the timeouts of the service.
+func newTransport(l models.ServiceLimits) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   l.ConnectTimeout.Duration(),
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: l.ResponseHeaderTimeout.Duration(),
+	}
+}
+
+// applyHeaderRules edits h according to rules.
+func applyHeaderRules(h http.Header, rules *models.HeaderRules) {
+	if rules == nil {
+		return
+	}
+
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		h.Add(name, value)
+	}
+}
+
+// limitResponse rejects resp when it announces a body larger than max and
+// otherwise caps its body to max bytes.
+func limitResponse(resp *http.Response, max int64) error {
+	if max <= 0 || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		return fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, resp.ContentLength)
+	}
+
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max}
+	return nil
+}
+
+// limitedBody fails the copy of a response body once it exceeds the limit,
+// the response is then aborted rather than silently truncated.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,145 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, s models.Service, req *http.Request) *httptest.ResponseRecorder {
+	if s.ID == uuid.Nil {
+		s.ID = uuid.New()
+	}
+
+	w := httptest.NewRecorder()
+	proxy.NewTestProxy(proxy.NewStreams(time.Second)).ProxyHandler(s, nil, nil).ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	var received http.Header
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Version", "1")
+	}))
+	defer u.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("X-Tenant", "client")
+
+	w := serve(t, models.Service{
+		Host: u.URL,
+		RequestHeaders: &models.HeaderRules{
+			Set:    map[string]string{"X-Tenant": "gateway"},
+			Add:    map[string]string{"X-Gateway": "1"},
+			Remove: []string{"X-Internal"},
+		},
+		ResponseHeaders: &models.HeaderRules{
+			Add:    map[string]string{"X-Version": "2"},
+			Remove: []string{"X-Powered-By"},
+		},
+	}, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, received.Get("X-Internal"))
+	require.Equal(t, []string{"gateway"}, received.Values("X-Tenant"))
+	require.Equal(t, "1", received.Get("X-Gateway"))
+	require.Empty(t, w.Header().Get("X-Powered-By"))
+	require.Equal(t, []string{"1", "2"}, w.Header().Values("X-Version"))
+}
+
+func TestProxyLimits(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) //nolint
+		if d, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+			time.Sleep(d)
+		}
+		io.WriteString(w, r.URL.Query().Get("body")) //nolint
+	}))
+	defer u.Close()
+
+	chunked := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(body)))
+		req.ContentLength = -1
+		return req
+	}
+	// The client asking for an event stream is answered a regular response.
+	askingStream := func(req *http.Request) *http.Request {
+		req.Header.Set("Accept", "application/json, text/event-stream")
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		limits models.ServiceLimits
+		req    *http.Request
+		want   int
+	}{
+		{
+			name:   "within limits",
+			limits: models.ServiceLimits{MaxRequestBodySize: 4, MaxResponseBodySize: 4},
+			req:    httptest.NewRequest(http.MethodPost, "/?body=pong", strings.NewReader("ping")),
+			want:   http.StatusOK,
+		},
+		{
+			name:   "request body too large",
+			limits: models.ServiceLimits{MaxRequestBodySize: 4},
+			req:    httptest.NewRequest(http.MethodPost, "/", strings.NewReader("ping pong")),
+			want:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "chunked request body too large",
+			limits: models.ServiceLimits{MaxRequestBodySize: 4},
+			req:    chunked("ping pong"),
+			want:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "response body too large",
+			limits: models.ServiceLimits{MaxResponseBodySize: 4},
+			req:    httptest.NewRequest(http.MethodGet, "/?body=ping+pong", nil),
+			want:   http.StatusBadGateway,
+		},
+		{
+			name:   "response body too large asking for a stream",
+			limits: models.ServiceLimits{MaxResponseBodySize: 4},
+			req:    askingStream(httptest.NewRequest(http.MethodGet, "/?body=ping+pong", nil)),
+			want:   http.StatusBadGateway,
+		},
+		{
+			name:   "timeout",
+			limits: models.ServiceLimits{Timeout: models.Duration(50 * time.Millisecond)},
+			req:    httptest.NewRequest(http.MethodGet, "/?sleep=500ms", nil),
+			want:   http.StatusGatewayTimeout,
+		},
+		{
+			name:   "timeout asking for a stream",
+			limits: models.ServiceLimits{Timeout: models.Duration(50 * time.Millisecond)},
+			req:    askingStream(httptest.NewRequest(http.MethodGet, "/?sleep=500ms", nil)),
+			want:   http.StatusGatewayTimeout,
+		},
+		{
+			name:   "response header timeout",
+			limits: models.ServiceLimits{ResponseHeaderTimeout: models.Duration(50 * time.Millisecond)},
+			req:    httptest.NewRequest(http.MethodGet, "/?sleep=500ms", nil),
+			want:   http.StatusGatewayTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := tt.limits
+			w := serve(t, models.Service{Host: u.URL, Limits: &limits}, tt.req)
+			require.Equal(t, tt.want, w.Code)
+		})
+	}
+}
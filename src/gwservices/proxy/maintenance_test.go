@@ -0,0 +1,54 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	called := false
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer u.Close()
+
+	service := models.Service{
+		Host: u.URL,
+		Maintenance: &models.Maintenance{
+			Enabled:    true,
+			Message:    "back at noon",
+			RetryAfter: models.Duration(2 * time.Minute),
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	w := serve(t, service, req)
+
+	require.False(t, called)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "120", w.Header().Get("Retry-After"))
+	require.JSONEq(t, `{"status":503,"error":"Service Unavailable","message":"back at noon","request_id":""}`, w.Body.String())
+
+	service.Maintenance.Enabled = false
+	w = serve(t, service, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.True(t, called)
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestBadGatewayPage(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html")
+	w := serve(t, models.Service{Host: u.URL, ErrorPages: map[string]string{"502": "{{.Status}} {{.Service}}"}, Name: "api"}, req)
+
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.Equal(t, "502 api", w.Body.String())
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "gateway"
+
+var (
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "circuit_breaker_state",
+		Help:      "Circuit breaker state of the upstream targets: 0 closed, 1 open, 2 half-open",
+	}, []string{"service", "target"})
+
+	breakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Total number of circuit breaker state changes",
+	}, []string{"service", "target", "state"})
+
+	retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "retries_total",
+		Help:      "Total number of retried upstream requests",
+	}, []string{"service"})
+
+	activeStreamsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "active_streams",
+		Help:      "Number of open WebSocket and Server-Sent Events streams",
+	}, []string{"service", "kind"})
+
+	mirrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "mirror_requests_total",
+		Help:      "Total number of mirrored requests by result: match, mismatch, error, dropped or skipped",
+	}, []string{"service", "result"})
+
+	rateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "rate_limited_requests_total",
+		Help:      "Total number of requests refused by a rate limit or a quota",
+	}, []string{"service"})
+
+	ipBlockedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "proxy",
+		Name:      "ip_blocked_requests_total",
+		Help:      "Total number of requests refused by the ip rules",
+	}, []string{"service"})
+)
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge, breakerTransitions, retriesCounter, activeStreamsGauge, mirrorCounter, rateLimitedCounter, ipBlockedCounter)
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/ablib"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Mirrors copies a share of the traffic of the services to their shadow
+// upstream. The copies are sent by a fixed number of workers once the
+// primary response is written, and dropped when the queue is full so shadow
+// traffic never slows down nor overloads the gateway.
+type Mirrors struct {
+	workers   int
+	jobs      chan mirrorJob
+	transport *http.Transport
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewMirrors(workers, queueSize int) *Mirrors {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	return &Mirrors{
+		workers:   workers,
+		jobs:      make(chan mirrorJob, queueSize),
+		transport: newTransport((*models.ServiceLimits)(nil).WithDefaults()),
+	}
+}
+
+// mirrorRequest is a request sampled for mirroring along with the outcome of
+// its primary.
+type mirrorRequest struct {
+	service string
+	mirror  models.Mirror
+	target  *url.URL
+	body    []byte
+
+	start   time.Time
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// observe records the primary response.
+func (m *mirrorRequest) observe(status int, err error) {
+	if m == nil {
+		return
+	}
+	m.status, m.err = status, err
+	m.latency = time.Since(m.start)
+}
+
+type mirrorJob struct {
+	logger    *zerolog.Logger
+	requestID string
+	req       *http.Request
+	primary   *mirrorRequest
+}
+
+// sample returns the mirror request of r when it is picked for mirroring,
+// nil otherwise. The body of r is buffered to be sent twice, bodies larger
+// than the mirror limit are not mirrored.
+func (m *Mirrors) sample(service models.Service, r *http.Request) *mirrorRequest {
+	if m == nil || service.Mirror == nil || service.Mirror.Percentage <= 0 {
+		return nil
+	}
+	if rand.Float64()*100 >= service.Mirror.Percentage { //nolint:gosec
+		return nil
+	}
+
+	cfg := service.Mirror.WithDefaults()
+	target, err := url.Parse(cfg.Host)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("service", service.Name).Msg("invalid mirror host")
+		return nil
+	}
+
+	mr := &mirrorRequest{service: service.Name, mirror: cfg, target: target, start: time.Now()}
+	if r.Body == nil || r.Body == http.NoBody {
+		return mr
+	}
+	if r.ContentLength > cfg.MaxBodySize {
+		mirrorCounter.WithLabelValues(service.Name, "skipped").Inc()
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, cfg.MaxBodySize+1))
+	// The primary reads what was buffered then the rest of the body, or the
+	// read error again.
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+	if err != nil || int64(len(body)) > cfg.MaxBodySize {
+		mirrorCounter.WithLabelValues(service.Name, "skipped").Inc()
+		return nil
+	}
+
+	mr.body = body
+	return mr
+}
+
+// send queues the copy of r once its primary is served.
+func (m *Mirrors) send(mr *mirrorRequest, r *http.Request, prepare func(*http.Request)) {
+	if mr == nil || (mr.status == 0 && mr.err == nil) {
+		// The primary was not proxied, as a cached response.
+		return
+	}
+
+	req, err := http.NewRequest(r.Method, r.URL.String(), bytes.NewReader(mr.body))
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Msg("failed to build mirror request")
+		return
+	}
+	req = req.WithContext(r.Context())
+	req.Header = r.Header.Clone()
+	req.RemoteAddr = r.RemoteAddr
+	if len(mr.body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	prepare(req)
+
+	req.URL.Scheme = mr.target.Scheme
+	req.URL.Host = mr.target.Host
+	req.Host = mr.target.Host
+
+	job := mirrorJob{
+		logger:    log.Ctx(r.Context()),
+		requestID: middleware.GetReqID(r.Context()),
+		req:       req.WithContext(context.Background()),
+		primary:   mr,
+	}
+
+	select {
+	case m.jobs <- job:
+	default:
+		mirrorCounter.WithLabelValues(mr.service, "dropped").Inc()
+	}
+}
+
+func (m *Mirrors) work(ctx context.Context) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-m.jobs:
+			m.do(ctx, job)
+		}
+	}
+}
+
+// do sends the copy and logs how its response differs from the primary.
+func (m *Mirrors) do(ctx context.Context, job mirrorJob) {
+	primary := job.primary
+
+	ctx, cancel := context.WithTimeout(ctx, primary.mirror.Timeout.Duration())
+	defer cancel()
+
+	start := time.Now()
+	resp, err := m.transport.RoundTrip(job.req.WithContext(ctx))
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	latency := time.Since(start)
+
+	event := job.logger.Info().
+		Str("request_id", job.requestID).
+		Str("service", primary.service).
+		Str("method", job.req.Method).
+		Str("path", job.req.URL.Path).
+		Int("primary_status", primary.status).
+		Dur("primary_latency", primary.latency).
+		Dur("shadow_latency", latency).
+		Dur("latency_delta", latency-primary.latency)
+	if primary.err != nil {
+		event = event.AnErr("primary_error", primary.err)
+	}
+
+	result := "match"
+	switch {
+	case err != nil:
+		result = "error"
+		event = event.AnErr("shadow_error", err)
+	case resp.StatusCode != primary.status:
+		result = "mismatch"
+	}
+	if err == nil {
+		event = event.Int("shadow_status", resp.StatusCode)
+	}
+
+	mirrorCounter.WithLabelValues(primary.service, result).Inc()
+	event.Str("result", result).Msg("mirror diff")
+}
+
+// Pending returns the number of queued copies.
+func (m *Mirrors) Pending() int {
+	return len(m.jobs)
+}
+
+func (m *Mirrors) New(core *ablib.Core) {
+	core.AddStartFunc(m.Start)
+	core.AddStopFunc(m.Stop)
+}
+
+func (m *Mirrors) Start(ctx context.Context) (<-chan struct{}, <-chan error) {
+	errChan := make(chan error)
+	startedChan := make(chan struct{})
+
+	// The workers outlive the start context, they are stopped by Stop.
+	workerCtx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(m.workers)
+	for i := 0; i < m.workers; i++ {
+		go m.work(workerCtx)
+	}
+
+	go func() {
+		defer close(errChan)
+		defer close(startedChan)
+		startedChan <- struct{}{}
+	}()
+
+	return startedChan, errChan
+}
+
+// Stop aborts the copies in flight and discards the queued ones.
+func (m *Mirrors) Stop(ctx context.Context) error {
+	if m.cancel == nil {
+		return nil
+	}
+	m.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		m.transport.CloseIdleConnections()
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to stop mirror workers: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,106 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type mirrored struct {
+	path string
+	body string
+}
+
+func TestProxyMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "primary:"+string(body)) //nolint
+	}))
+	defer primary.Close()
+
+	received := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirrored{path: r.URL.Path, body: string(body)}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	tests := []struct {
+		name     string
+		workers  bool
+		mirror   models.Mirror
+		body     string
+		mirrored *mirrored
+	}{
+		{
+			name:     "mirrored",
+			workers:  true,
+			mirror:   models.Mirror{Host: shadow.URL, Percentage: 100},
+			body:     "hello",
+			mirrored: &mirrored{path: "/users", body: "hello"},
+		},
+		{
+			name:    "not sampled",
+			workers: true,
+			mirror:  models.Mirror{Host: shadow.URL},
+			body:    "hello",
+		},
+		{
+			name:    "body too large",
+			workers: true,
+			mirror:  models.Mirror{Host: shadow.URL, Percentage: 100, MaxBodySize: 4},
+			body:    "hello",
+		},
+		{
+			name:   "queue full",
+			mirror: models.Mirror{Host: shadow.URL, Percentage: 100},
+			body:   "hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirrors := proxy.NewMirrors(1, 0)
+			if tt.workers {
+				mirrors.Start(context.Background())
+				defer mirrors.Stop(context.Background()) //nolint
+			}
+
+			p := proxy.NewTestProxy(proxy.NewStreams(time.Second)).WithMirrors(mirrors)
+			service := models.Service{ID: uuid.New(), Prefix: "/api", Host: primary.URL, Mirror: &tt.mirror}
+
+			w := httptest.NewRecorder()
+			p.ProxyHandler(service, nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(tt.body)))
+
+			// The primary response is never affected by the shadow.
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, "primary:"+tt.body, w.Body.String())
+
+			if tt.mirrored == nil {
+				select {
+				case m := <-received:
+					t.Fatalf("unexpected mirrored request %v", m)
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case m := <-received:
+				require.Equal(t, *tt.mirrored, m)
+			case <-time.After(time.Second):
+				t.Fatal("request not mirrored")
+			}
+		})
+	}
+}
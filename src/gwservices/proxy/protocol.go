@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"golang.org/x/net/http2"
+)
+
+// upstreamRoundTripper is the transport of a pool, its idle connections are
+// closed when the pool is released.
+type upstreamRoundTripper interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// newProtocolTransport returns the transport speaking protocol to the
+// targets of a service, tlsConfig is used for the https targets when not nil.
+func newProtocolTransport(l models.ServiceLimits, protocol string, tlsConfig *tls.Config) upstreamRoundTripper {
+	switch protocol {
+	case models.ProtocolH2C:
+		return withHeaderTimeout(newH2CTransport(l), l.ResponseHeaderTimeout.Duration())
+	case models.ProtocolH2:
+		return withHeaderTimeout(newH2Transport(l, tlsConfig), l.ResponseHeaderTimeout.Duration())
+	case models.ProtocolGRPC:
+		return withHeaderTimeout(schemeTransport{
+			cleartext: newH2CTransport(l),
+			tls:       newH2Transport(l, tlsConfig),
+		}, l.ResponseHeaderTimeout.Duration())
+	default:
+		t := newTransport(l)
+		t.TLSClientConfig = tlsConfig.Clone()
+		// A non-nil empty map keeps the transport from negotiating HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return t
+	}
+}
+
+func newH2CTransport(l models.ServiceLimits) *http2.Transport {
+	dialer := &net.Dialer{Timeout: l.ConnectTimeout.Duration(), KeepAlive: 30 * time.Second}
+
+	return &http2.Transport{
+		AllowHTTP: true,
+		// Cleartext connections are dialed in place of the TLS ones.
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+func newH2Transport(l models.ServiceLimits, tlsConfig *tls.Config) *http2.Transport {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: l.ConnectTimeout.Duration(), KeepAlive: 30 * time.Second}}
+
+	return &http2.Transport{
+		TLSClientConfig: tlsConfig.Clone(),
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := *dialer
+			d.Config = cfg
+			return d.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: 30 * time.Second,
+	}
+}
+
+// schemeTransport speaks HTTP/2 over TLS to the https targets and in
+// cleartext to the others.
+type schemeTransport struct {
+	cleartext *http2.Transport
+	tls       *http2.Transport
+}
+
+func (t schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.tls.RoundTrip(req)
+	}
+	return t.cleartext.RoundTrip(req)
+}
+
+func (t schemeTransport) CloseIdleConnections() {
+	t.cleartext.CloseIdleConnections()
+	t.tls.CloseIdleConnections()
+}
+
+// headerTimeoutError is returned when the response headers are not received
+// in time, it is a timeout as a net.Error.
+type headerTimeoutError struct{}
+
+func (headerTimeoutError) Error() string   { return "timeout awaiting response headers" }
+func (headerTimeoutError) Timeout() bool   { return true }
+func (headerTimeoutError) Temporary() bool { return true }
+
+// headerTimeoutTransport bounds the wait for the response headers, as the
+// ResponseHeaderTimeout of http.Transport which http2.Transport lacks.
+type headerTimeoutTransport struct {
+	upstreamRoundTripper
+	timeout time.Duration
+}
+
+func withHeaderTimeout(t upstreamRoundTripper, timeout time.Duration) upstreamRoundTripper {
+	if timeout <= 0 {
+		return t
+	}
+	return headerTimeoutTransport{upstreamRoundTripper: t, timeout: timeout}
+}
+
+func (t headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	resp, err := t.upstreamRoundTripper.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, headerTimeoutError{}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of its request once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -1,49 +1,115 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
-	"strings"
+	"strconv"
+	"time"
 
 	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/accesslog"
+	"github.com/amaurybrisou/gateway/src/apikey"
+	"github.com/amaurybrisou/gateway/src/cache"
+	"github.com/amaurybrisou/gateway/src/compression"
 	"github.com/amaurybrisou/gateway/src/database"
 	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/errorpage"
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/amaurybrisou/gateway/src/iprules"
+	"github.com/amaurybrisou/gateway/src/ratelimit"
+	"github.com/amaurybrisou/gateway/src/signature"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
+// ServiceByName returns the service named name, a zero service when there is
+// none.
+type ServiceByName func(ctx context.Context, name string) (models.Service, error)
+
 type Proxy struct {
-	db                  *database.Database
-	stripPrefix         string
-	notFoundRedirectURL string
-	noRoleRedirectURL   string
+	db          *database.Database
+	byName      ServiceByName
+	routes      *RouteTable
+	upstreams   *upstreams
+	streams     *Streams
+	mirrors     *Mirrors
+	cache       *cache.Cache
+	pages       *errorpage.Pages
+	limiter     *ratelimit.Limiter
+	ipRules     *iprules.DenyList
+	stripPrefix string
+	redirects   Redirects
 }
 
 type Config struct {
-	StripPrefix         string
-	NotFoundRedirectURL string
-	NoRoleRedirectURL   string
+	StripPrefix string
+	// Redirects is the policy of the requests not proxied.
+	Redirects Redirects
+	// StreamDrainTimeout bounds the wait for the streams to close on shutdown.
+	StreamDrainTimeout time.Duration
+	// MirrorWorkers send the mirrored requests, at most MirrorQueueSize
+	// requests wait for them.
+	MirrorWorkers   int
+	MirrorQueueSize int
+	// ErrorPages renders the errors answered by the gateway.
+	ErrorPages *errorpage.Pages
 }
 
-func New(db *database.Database, cfg Config) Proxy {
+func New(db *database.Database, health HealthState, cache *cache.Cache, cfg Config) Proxy {
+	routes := NewRouteTable(db.GetServices, db.ListenServiceChanges)
+	upstreams := newUpstreams(health)
+	routes.OnReload(upstreams.prune)
+
 	return Proxy{
-		db:                  db,
-		stripPrefix:         cfg.StripPrefix,
-		notFoundRedirectURL: cfg.NotFoundRedirectURL,
-		noRoleRedirectURL:   cfg.NoRoleRedirectURL,
+		db:          db,
+		byName:      db.GetServiceByName,
+		routes:      routes,
+		upstreams:   upstreams,
+		streams:     NewStreams(cfg.StreamDrainTimeout),
+		mirrors:     NewMirrors(cfg.MirrorWorkers, cfg.MirrorQueueSize),
+		cache:       cache,
+		pages:       cfg.ErrorPages,
+		limiter:     ratelimit.New(db),
+		ipRules:     iprules.NewDenyList(db.GetIPRules, db.ListenIPRuleChanges),
+		stripPrefix: cfg.StripPrefix,
+		redirects:   cfg.Redirects.WithDefaults(),
 	}
 }
 
+// Routes returns the in-memory route table used to resolve services.
+func (s Proxy) Routes() *RouteTable {
+	return s.routes
+}
+
+// Streams returns the tracker of the WebSocket and Server-Sent Events
+// connections.
+func (s Proxy) Streams() *Streams {
+	return s.streams
+}
+
+// IPRules returns the global deny list.
+func (s Proxy) IPRules() *iprules.DenyList {
+	return s.ipRules
+}
+
+// Mirrors returns the workers sending the mirrored traffic.
+func (s Proxy) Mirrors() *Mirrors {
+	return s.mirrors
+}
+
 func (s Proxy) PublicRoutes(w http.ResponseWriter, r *http.Request) {
+	stripIdentity(r.Header)
+
 	pathPrefix := chi.URLParam(r, "service_name")
 	if pathPrefix == "" {
-		http.Error(w, "service not found", http.StatusNotFound)
+		s.notFound(w, r)
 		return
 	}
 
@@ -51,10 +117,21 @@ func (s Proxy) PublicRoutes(w http.ResponseWriter, r *http.Request) {
 	log.Ctx(r.Context()).Debug().Any("prefix", pathPrefix).Any("url.path", r.URL.Path).Msg("proxy request received")
 
 	// Lookup the backend URL based on the path prefix
-	service, err := s.db.GetServiceByName(r.Context(), pathPrefix)
+	service, err := s.byName(r.Context(), pathPrefix)
 	if err != nil {
 		log.Ctx(r.Context()).Warn().Err(err).Msg("backend not found")
-		http.Redirect(w, r, s.notFoundRedirectURL, http.StatusPermanentRedirect)
+		s.notFound(w, r)
+		return
+	}
+	if service.ID == uuid.Nil {
+		log.Ctx(r.Context()).Debug().Str("service", pathPrefix).Msg("backend not found")
+		s.notFound(w, r)
+		return
+	}
+
+	// The public routes are reached anonymously.
+	policy, err := ratelimit.AnonymousPolicy(service, forwarded.ClientIP(r))
+	if !s.rateLimit(w, r, service, policy, err) {
 		return
 	}
 
@@ -63,48 +140,252 @@ func (s Proxy) PublicRoutes(w http.ResponseWriter, r *http.Request) {
 
 func (s Proxy) ProxyHandler(service models.Service, w http.ResponseWriter, r *http.Request) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		targetURL, err := url.Parse(service.Host)
-		if err != nil {
-			log.Ctx(r.Context()).Error().Err(err).Msg("Failed to parse backend URL")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Ctx(r.Context()).Debug().Any("domain", service.Domain).Any("host", r.Host).Send()
+		if s.canonicalDomain(w, r, service) {
 			return
 		}
 
-		log.Ctx(r.Context()).Debug().Any("domain", service.Domain).Any("host", r.Host).Send()
-		if service.Domain != r.Host && service.Domain != "" {
-			http.Redirect(w, r, fmt.Sprintf("https://%s%s", service.Domain, strings.TrimPrefix(r.URL.Path, service.Prefix)), http.StatusPermanentRedirect)
+		if s.ipBlocked(w, r, service) {
+			return
+		}
+
+		if s.maintenance(w, r, service) {
+			return
+		}
+
+		upstreamService := service
+		version, decision, split := pickVersion(service, w, r)
+		if split {
+			upstreamService = service.ForVersion(version)
+			accesslog.Annotate(r.Context(), "backend_version", version.Name)
+			accesslog.Annotate(r.Context(), "version_decision", decision)
+		}
+
+		pool, err := s.upstreams.get(upstreamService, version.Name)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Msg("Failed to build upstream pool")
+			s.writeError(w, r, &service, http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
 
+		pipeline := pool.pipeline
+
+		// The deadline is lifted once the upstream turns the request into a
+		// stream, gRPC calls carry their own.
+		grpc := isGRPCStream(service, r)
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		var deadline *time.Timer
+		if !grpc {
+			deadline = time.AfterFunc(pool.limits.Timeout.Duration(), func() { cancel(context.DeadlineExceeded) })
+			defer deadline.Stop()
+		}
+		r = r.WithContext(ctx)
+
+		var st *stream
+		defer func() {
+			if st != nil {
+				s.streams.close(st)
+			}
+		}()
+
+		if max := pool.limits.MaxRequestBodySize; max > 0 {
+			if r.ContentLength > max {
+				s.writeError(w, r, &service, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+
+		// The request body is sent before the upstream tells whether it
+		// answers with a stream, it is transformed unless it carries gRPC
+		// messages.
+		if !grpc {
+			if err := pipeline.Request(r); err != nil {
+				s.proxyError(w, r, service, err)
+				return
+			}
+		}
+
+		// Requests asking for a stream are neither mirrored, cached nor
+		// compressed, the ResponseWriter must be able to flush or hijack
+		// the connection.
+		wantsStream := StreamKind(r) != ""
+		var mirror *mirrorRequest
+		if !wantsStream {
+			mirror = s.mirrors.sample(service, r)
+		}
+
+		gatewayPath := r.URL.Path
+		director := func(req *http.Request) {
+			req.URL.Path = pool.rewriter.toUpstream(req.URL.Path)
+			req.URL.RawPath = ""
+			req.Header.Add("X-Request-Id", middleware.GetReqID(req.Context()))
+			forwarded.SetHeaders(req.Header, forwarded.FromRequest(req))
+			// The gateway API keys never reach the services, whether the
+			// service authenticated the request or not.
+			apikey.Strip(req.Header)
+			applyHeaderRules(req.Header, service.RequestHeaders)
+			req.Header.Del(BackendVersionHeader)
+			if split {
+				req.Header.Set(BackendVersionHeader, version.Name)
+			}
+			// Transformed responses must not arrive compressed.
+			if pipeline.HasResponse() {
+				req.Header.Del("Accept-Encoding")
+			}
+			sign(req, service)
+		}
+
 		proxy := &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				req.URL.Scheme = targetURL.Scheme
-				req.URL.Host = targetURL.Host
-				req.URL.Path = strings.TrimPrefix(req.URL.Path, service.Prefix)
-				req.Header.Add("X-Request-Id", middleware.GetReqID(req.Context()))
-				req.Header.Add("X-Forwarded-For", req.RemoteAddr)
-				req.Host = targetURL.Host
-				log.Ctx(r.Context()).Debug().Any("path", req.URL.Path).Any("host", req.Host).Msg("proxying to")
+			Director:  director,
+			Transport: upstreamTransport{pool: pool, base: pool.transport},
+			ModifyResponse: func(resp *http.Response) error {
+				mirror.observe(resp.StatusCode, nil)
+				pool.rewriter.rewriteResponse(resp, gatewayPath, pool.hosts)
+				applyHeaderRules(resp.Header, service.ResponseHeaders)
+
+				// Only the upgrades and the event streams the upstream
+				// actually answered escape the deadline, the limits and the
+				// transformations, the client asking for a stream is not
+				// enough.
+				kind := responseStreamKind(resp)
+				if grpc {
+					kind = streamGRPC
+				}
+				if kind != "" {
+					if deadline != nil && !deadline.Stop() {
+						return context.Cause(ctx)
+					}
+
+					var err error
+					if st, err = s.streams.open(ctx, func() { cancel(context.Canceled) }, service, kind); err != nil {
+						resp.Body.Close()
+						return err
+					}
+					resp.Body = st.body(resp.Body)
+					return nil
+				}
+
+				if err := limitResponse(resp, pool.limits.MaxResponseBodySize); err != nil {
+					return err
+				}
+				return pipeline.Response(resp)
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				mirror.observe(0, err)
+				s.proxyError(w, req, service, err)
 			},
 		}
 
-		proxy.ServeHTTP(w, r)
+		if wantsStream {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		compression.Handler(service.Compression.WithDefaults(), s.cache.Handler(service, version.Name, proxy)).ServeHTTP(w, r)
+		s.mirrors.send(mirror, r, director)
 	})
 }
 
+// proxyError answers the requests that could not be proxied with the status
+// matching err.
+func (s Proxy) proxyError(w http.ResponseWriter, r *http.Request, service models.Service, err error) {
+	var unavailable *UnavailableError
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrDraining):
+		log.Ctx(r.Context()).Warn().Err(err).Str("service", service.Name).Msg("stream refused")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(0)))
+		s.writeError(w, r, &service, http.StatusServiceUnavailable, "Service Unavailable")
+	case errors.As(err, &unavailable):
+		log.Ctx(r.Context()).Warn().Err(err).Str("service", service.Name).Msg("service unavailable")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(unavailable.RetryAfter)))
+		s.writeError(w, r, &service, http.StatusServiceUnavailable, "Service Unavailable")
+	case errors.As(err, &tooLarge):
+		log.Ctx(r.Context()).Warn().Err(err).Str("service", service.Name).Msg("request too large")
+		s.writeError(w, r, &service, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(context.Cause(r.Context()), context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		log.Ctx(r.Context()).Warn().Err(err).Str("service", service.Name).Msg("upstream timeout")
+		s.writeError(w, r, &service, http.StatusGatewayTimeout, "Gateway Timeout")
+	default:
+		log.Ctx(r.Context()).Error().Err(err).Str("service", service.Name).Msg("proxy error")
+		s.writeError(w, r, &service, http.StatusBadGateway, "Bad Gateway")
+	}
+}
+
+// maintenance answers r with a 503 when service is in maintenance, it
+// reports whether it did.
+func (s Proxy) maintenance(w http.ResponseWriter, r *http.Request, service models.Service) bool {
+	m := service.Maintenance
+	if m == nil || !m.Enabled {
+		return false
+	}
+
+	accesslog.Annotate(r.Context(), "maintenance", true)
+	if m.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(m.RetryAfter.Duration())))
+	}
+
+	message := m.Message
+	if message == "" {
+		message = "Service Unavailable"
+	}
+	s.writeError(w, r, &service, http.StatusServiceUnavailable, message)
+	return true
+}
+
+// ipBlocked answers 403 and returns true when the client of r is denied by
+// the global deny list or the ip rules of service.
+func (s Proxy) ipBlocked(w http.ResponseWriter, r *http.Request, service models.Service) bool {
+	clientIP := forwarded.ClientIP(r)
+	decision, err := iprules.Evaluate(s.ipRules.Set(), service.IPRules, clientIP)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("service", service.Name).Msg("evaluate ip rules")
+		s.writeError(w, r, &service, http.StatusInternalServerError, "Internal Server Error")
+		return true
+	}
+	if decision.Allowed {
+		return false
+	}
+
+	log.Ctx(r.Context()).Warn().
+		Str("request_id", middleware.GetReqID(r.Context())).
+		Str("service", service.Name).
+		Str("client_ip", clientIP).
+		Str("rule", decision.Rule).
+		Msg("client blocked by ip rules")
+	ipBlockedCounter.WithLabelValues(service.Name).Inc()
+	accesslog.Annotate(r.Context(), "ip_blocked", decision.Rule)
+	s.writeError(w, r, &service, http.StatusForbidden, "Forbidden")
+	return true
+}
+
 func (p Proxy) ServiceAccessHandler(authMiddleware func(next http.Handler) http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pathPrefix := "/" + chi.URLParam(r, "service_name")
-
 		log.Ctx(r.Context()).Debug().
 			Any("host", r.Host).
-			Any("prefix", pathPrefix).
+			Any("method", r.Method).
 			Any("url.path", r.URL.Path).Msg("proxy request received")
-		// Lookup the backend URL based on the path prefix
-		service, err := p.db.GetServiceByPrefixOrDomain(r.Context(), pathPrefix, r.Host)
+		stripIdentity(r.Header)
+
+		// Lookup the backend matching the host, path and matchers
+		service, err := p.routes.Lookup(r.Context(), r)
 		if err != nil {
 			log.Ctx(r.Context()).Warn().Err(err).Msg("backend not found")
-			http.Redirect(w, r, p.notFoundRedirectURL, http.StatusPermanentRedirect)
+			p.notFound(w, r)
+			return
+		}
+
+		// Blocked clients and services in maintenance are turned away
+		// before authenticating.
+		if p.ipBlocked(w, r, service) {
+			return
+		}
+		if p.maintenance(w, r, service) {
 			return
 		}
 
@@ -113,6 +394,10 @@ func (p Proxy) ServiceAccessHandler(authMiddleware func(next http.Handler) http.
 			authMiddleware(p.CheckRequiredRoles(service, p.ProxyHandler(service, w, r))).ServeHTTP(w, r)
 		} else {
 			// Service does not require authentication, continue to the next handler
+			policy, err := ratelimit.AnonymousPolicy(service, forwarded.ClientIP(r))
+			if !p.rateLimit(w, r, service, policy, err) {
+				return
+			}
 			p.ProxyHandler(service, w, r).ServeHTTP(w, r)
 		}
 	}
@@ -123,33 +408,47 @@ func (p Proxy) CheckRequiredRoles(service models.Service, next http.Handler) htt
 		userID, ok := r.Context().Value(ablibhttp.UserIDCtxKey).(uuid.UUID)
 		if !ok {
 			log.Ctx(r.Context()).Error().Err(errors.New("invalid user_id")).Send()
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			p.writeError(w, r, &service, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		// API keys restricted to other services are refused, the role is
+		// checked as for the cookies otherwise.
+		if key, ok := apikey.FromContext(r.Context()); ok && !key.Allows(service.ID) {
+			log.Ctx(r.Context()).Warn().Str("api_key", key.Prefix).Str("service", service.Name).Msg("api key not allowed")
+			p.writeError(w, r, &service, http.StatusForbidden, "api key not allowed for this service")
 			return
 		}
 
 		userRole, err := p.db.GetUserRole(r.Context(), userID, service.RequiredRoles[0])
 		if err != nil {
 			log.Ctx(r.Context()).Error().Err(err).Msg("determine user roles")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			p.writeError(w, r, &service, http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
 
 		if userRole.UserID == uuid.Nil {
-			http.Redirect(w, r, p.noRoleRedirectURL+"/"+service.Name, http.StatusTemporaryRedirect)
+			p.noRole(w, r, service)
+			return
+		}
+
+		policy, err := ratelimit.UserPolicy(service, userID, userRole.Metadata)
+		if !p.rateLimit(w, r, service, policy, err) {
 			return
 		}
 
 		m, err := json.Marshal(userRole.Metadata)
 		if err != nil {
 			log.Ctx(r.Context()).Error().Err(err).Msg("marshal metadata")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			p.writeError(w, r, &service, http.StatusInternalServerError, "Internal Server Error")
 			return
 		}
 
-		r.Header.Add("X-Plan-Metadata", string(m))
-
 		user := ablibhttp.User(r.Context())
-		r.Header.Add("X-Stripe-Customer-ID", user.GetExternalID())
+		r.Header.Set(signature.HeaderUserID, userID.String())
+		r.Header.Set(signature.HeaderUserRole, string(service.RequiredRoles[0]))
+		r.Header.Set(signature.HeaderPlan, string(m))
+		r.Header.Set(signature.HeaderCustomerID, user.GetExternalID())
 
 		next.ServeHTTP(w, r)
 	})
@@ -163,3 +462,51 @@ func (p Proxy) CheckRequiredRoles(service models.Service, next http.Handler) htt
 // 	}
 // 	return path
 // }
+
+// rateLimit counts r against policy, it answers 429 and returns false when
+// a limit is hit. policyErr, the error of the policy, is logged.
+func (s Proxy) rateLimit(w http.ResponseWriter, r *http.Request, service models.Service, policy ratelimit.Policy, policyErr error) bool {
+	if policyErr != nil {
+		log.Ctx(r.Context()).Warn().Err(policyErr).Str("service", service.Name).Msg("invalid rate limit")
+	}
+
+	allowed, retryAfter, err := s.limiter.Check(r.Context(), w.Header(), policy)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("service", service.Name).Send()
+	}
+	if allowed {
+		return true
+	}
+
+	rateLimitedCounter.WithLabelValues(service.Name).Inc()
+	accesslog.Annotate(r.Context(), "rate_limited", true)
+	w.Header().Set("Retry-After", strconv.Itoa(ratelimit.Seconds(retryAfter)))
+	s.writeError(w, r, &service, http.StatusTooManyRequests, "Too Many Requests")
+	return false
+}
+
+// stripIdentity removes the identity headers sent by the client, only the
+// gateway sets them.
+func stripIdentity(h http.Header) {
+	for _, name := range signature.IdentityHeaders {
+		h.Del(name)
+	}
+}
+
+// sign replaces the signature sent by the client with the one of the
+// gateway when service has a signing secret.
+func sign(req *http.Request, service models.Service) {
+	req.Header.Del(signature.HeaderSignature)
+	req.Header.Del(signature.HeaderTimestamp)
+	if service.Signing != nil && service.Signing.Secret != "" {
+		signature.Sign(req, []byte(service.Signing.Secret), time.Now())
+	}
+}
+
+// retryAfterSeconds rounds d up to the whole seconds of a Retry-After header.
+func retryAfterSeconds(d time.Duration) int {
+	if d < time.Second {
+		return 1
+	}
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,71 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/amaurybrisou/gateway/src/ratelimit"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second)).WithLimiter(ratelimit.New(nil))
+	service := models.Service{ID: uuid.New(), Name: "api"}
+	policy, err := ratelimit.AnonymousPolicy(models.Service{
+		ID:        service.ID,
+		RateLimit: &models.RateLimit{AnonymousRate: "1/h"},
+	}, "192.0.2.1")
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	require.True(t, p.RateLimit(w, httptest.NewRequest(http.MethodGet, "/", nil), service, policy))
+	require.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	require.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	require.False(t, p.RateLimit(w, req, service, policy))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "3600", w.Header().Get("Retry-After"))
+	require.JSONEq(t, `{"status":429,"error":"Too Many Requests","message":"Too Many Requests","request_id":""}`, w.Body.String())
+
+	// Unlimited policies let every request through.
+	w = httptest.NewRecorder()
+	require.True(t, p.RateLimit(w, httptest.NewRequest(http.MethodGet, "/", nil), service, ratelimit.Policy{Key: "ip:192.0.2.1"}))
+	require.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+func TestPublicRoutesRateLimit(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer u.Close()
+
+	service := models.Service{ID: uuid.New(), Name: "api", Host: u.URL, RateLimit: &models.RateLimit{AnonymousRate: "1/h"}}
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second)).
+		WithLimiter(ratelimit.New(nil)).
+		WithServiceByName(func(ctx context.Context, name string) (models.Service, error) { return service, nil })
+
+	details := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/details/api", nil)
+		r.Header.Set("Accept", "application/json")
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("service_name", "api")
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+		w := httptest.NewRecorder()
+		p.PublicRoutes(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, details().Code)
+	w := details()
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "3600", w.Header().Get("Retry-After"))
+}
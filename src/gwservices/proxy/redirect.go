@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/errorpage"
+	"github.com/amaurybrisou/gateway/src/forwarded"
+)
+
+// Redirects is the redirect policy of the requests the gateway does not
+// proxy. Browsers are redirected to a page explaining what happened, API
+// clients get the error itself as they cannot do anything with the page.
+//
+// Redirects are temporary by default, browsers cache the permanent ones
+// forever and a service missing for a while would stay broken for them.
+type Redirects struct {
+	// NotFoundURL is where browsers asking for an unknown service go,
+	// unknown services are answered with a 404 when empty.
+	NotFoundURL    string
+	NotFoundStatus int
+	// NoRoleURL, followed by the name of the service, is where the users
+	// missing the role of a service go, they are answered with a 403 when
+	// empty.
+	NoRoleURL    string
+	NoRoleStatus int
+	// DomainStatus redirects the requests of a service received on another
+	// host to its domain.
+	DomainStatus int
+}
+
+// WithDefaults returns r with the statuses missing or not redirecting
+// replaced by the defaults.
+func (r Redirects) WithDefaults() Redirects {
+	r.NotFoundStatus = redirectStatus(r.NotFoundStatus, http.StatusFound)
+	r.NoRoleStatus = redirectStatus(r.NoRoleStatus, http.StatusTemporaryRedirect)
+	r.DomainStatus = redirectStatus(r.DomainStatus, http.StatusTemporaryRedirect)
+	return r
+}
+
+func redirectStatus(status, fallback int) int {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return status
+	default:
+		return fallback
+	}
+}
+
+// notFound answers the requests of unknown services.
+func (s Proxy) notFound(w http.ResponseWriter, r *http.Request) {
+	if s.redirects.NotFoundURL != "" && errorpage.PrefersHTML(r) {
+		http.Redirect(w, r, s.redirects.NotFoundURL, s.redirects.NotFoundStatus)
+		return
+	}
+	s.writeError(w, r, nil, http.StatusNotFound, "service not found")
+}
+
+// noRole answers the requests of the users missing the role of service.
+func (s Proxy) noRole(w http.ResponseWriter, r *http.Request, service models.Service) {
+	if s.redirects.NoRoleURL != "" && errorpage.PrefersHTML(r) {
+		http.Redirect(w, r, s.redirects.NoRoleURL+"/"+service.Name, s.redirects.NoRoleStatus)
+		return
+	}
+	s.writeError(w, r, &service, http.StatusForbidden, "missing role "+string(service.RequiredRoles[0]))
+}
+
+// canonicalDomain redirects r to the domain of service when it was received
+// on another host, it reports whether it did. The scheme and the query of r
+// are kept.
+func (s Proxy) canonicalDomain(w http.ResponseWriter, r *http.Request, service models.Service) bool {
+	if service.Domain == "" {
+		return false
+	}
+
+	info := forwarded.FromRequest(r)
+	scheme := info.Proto
+	if canonicalHost(info.Host, scheme) == canonicalHost(service.Domain, scheme) {
+		return false
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, service.Prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	target := url.URL{
+		Scheme:   scheme,
+		Host:     service.Domain,
+		Path:     path,
+		RawQuery: r.URL.RawQuery,
+	}
+	http.Redirect(w, r, target.String(), s.redirects.DomainStatus)
+	return true
+}
+
+// canonicalHost returns host in lower case, without the trailing dot and the
+// default port of scheme.
+func canonicalHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+			host = h
+		} else {
+			return strings.TrimSuffix(h, ".") + ":" + port
+		}
+	}
+	return strings.TrimSuffix(host, ".")
+}
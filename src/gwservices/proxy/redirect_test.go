@@ -0,0 +1,203 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestRedirectDefaults(t *testing.T) {
+	r := proxy.Redirects{NotFoundStatus: http.StatusOK, NoRoleStatus: http.StatusSeeOther}.WithDefaults()
+
+	require.Equal(t, http.StatusFound, r.NotFoundStatus)
+	require.Equal(t, http.StatusSeeOther, r.NoRoleStatus)
+	require.Equal(t, http.StatusTemporaryRedirect, r.DomainStatus)
+}
+
+func TestNotFound(t *testing.T) {
+	redirects := proxy.Redirects{NotFoundURL: "/services"}
+
+	tests := []struct {
+		name        string
+		redirects   proxy.Redirects
+		accept      string
+		contentType string
+		status      int
+		location    string
+	}{
+		{name: "browser", redirects: redirects, accept: browserAccept, status: http.StatusFound, location: "/services"},
+		{name: "configured status", redirects: proxy.Redirects{NotFoundURL: "/services", NotFoundStatus: http.StatusPermanentRedirect}, accept: browserAccept, status: http.StatusPermanentRedirect, location: "/services"},
+		{name: "json client", redirects: redirects, accept: "application/json", status: http.StatusNotFound},
+		{name: "curl", redirects: redirects, accept: "*/*", status: http.StatusNotFound},
+		{name: "grpc", redirects: redirects, contentType: "application/grpc", status: http.StatusOK},
+		{name: "no url", accept: browserAccept, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			w := httptest.NewRecorder()
+			proxy.NewTestProxy(nil).WithRedirects(tt.redirects).NotFound(w, r)
+
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.location, w.Header().Get("Location"))
+			if tt.contentType != "" {
+				require.Equal(t, "12", w.Header().Get("Grpc-Status"))
+			}
+		})
+	}
+}
+
+func TestNoRole(t *testing.T) {
+	service := models.Service{Name: "api", RequiredRoles: []models.Role{"premium"}}
+
+	tests := []struct {
+		name      string
+		redirects proxy.Redirects
+		accept    string
+		status    int
+		location  string
+	}{
+		{name: "browser", redirects: proxy.Redirects{NoRoleURL: "/pricing"}, accept: browserAccept, status: http.StatusTemporaryRedirect, location: "/pricing/api"},
+		{name: "configured status", redirects: proxy.Redirects{NoRoleURL: "/pricing", NoRoleStatus: http.StatusSeeOther}, accept: browserAccept, status: http.StatusSeeOther, location: "/pricing/api"},
+		{name: "api client", redirects: proxy.Redirects{NoRoleURL: "/pricing"}, accept: "application/json", status: http.StatusForbidden},
+		{name: "no url", accept: browserAccept, status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api", nil)
+			r.Header.Set("Accept", tt.accept)
+
+			w := httptest.NewRecorder()
+			proxy.NewTestProxy(nil).WithRedirects(tt.redirects).NoRole(w, r, service)
+
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.location, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestCanonicalDomain(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer u.Close()
+
+	service := models.Service{Name: "api", Prefix: "/api", Domain: "api.example.com", Host: u.URL}
+
+	tests := []struct {
+		name      string
+		url       string
+		host      string
+		tls       bool
+		proto     string
+		trusted   bool
+		redirects proxy.Redirects
+		status    int
+		location  string
+	}{
+		{name: "same host", url: "/users", host: "api.example.com", status: http.StatusOK},
+		{name: "case and trailing dot", url: "/users", host: "API.example.com.", status: http.StatusOK},
+		{name: "default port", url: "/users", host: "api.example.com:443", tls: true, status: http.StatusOK},
+		{name: "other port", url: "/users", host: "api.example.com:8443", tls: true, status: http.StatusTemporaryRedirect, location: "https://api.example.com/users"},
+		{name: "http", url: "/api/users?page=2&sort=name", host: "gateway.example.com", status: http.StatusTemporaryRedirect, location: "http://api.example.com/users?page=2&sort=name"},
+		{name: "https", url: "/api/users?page=2", host: "gateway.example.com", tls: true, status: http.StatusTemporaryRedirect, location: "https://api.example.com/users?page=2"},
+		{name: "forwarded proto", url: "/api", host: "gateway.example.com", proto: "https", trusted: true, status: http.StatusTemporaryRedirect, location: "https://api.example.com/"},
+		{name: "untrusted forwarded proto", url: "/api", host: "gateway.example.com", proto: "https", status: http.StatusTemporaryRedirect, location: "http://api.example.com/"},
+		{name: "configured status", url: "/api/users", host: "gateway.example.com", redirects: proxy.Redirects{DomainStatus: http.StatusMovedPermanently}, status: http.StatusMovedPermanently, location: "http://api.example.com/users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			r.Host = tt.host
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+
+			var h http.Handler = proxy.NewTestProxy(proxy.NewStreams(time.Second)).WithRedirects(tt.redirects).ProxyHandler(service, nil, nil)
+			if tt.trusted {
+				r.Header.Set(forwarded.HeaderFor, "203.0.113.7")
+				proxies, err := forwarded.ParseProxies("192.0.2.0/24")
+				require.NoError(t, err)
+				h = proxies.Middleware(h)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, tt.location, w.Header().Get("Location"))
+		})
+	}
+
+	// Services without a domain are served on every host.
+	w := serve(t, models.Service{Host: u.URL}, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestPublicRoutes(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer u.Close()
+
+	api := models.Service{ID: uuid.New(), Name: "api", Host: u.URL}
+	byName := func(ctx context.Context, name string) (models.Service, error) {
+		switch name {
+		case "api":
+			return api, nil
+		case "broken":
+			return models.Service{}, errors.New("connection refused")
+		}
+		return models.Service{}, nil
+	}
+
+	tests := []struct {
+		name   string
+		param  string
+		status int
+	}{
+		{name: "service", param: "api", status: http.StatusTeapot},
+		{name: "unknown service", param: "unknown", status: http.StatusNotFound},
+		{name: "lookup error", param: "broken", status: http.StatusNotFound},
+		{name: "no name", param: "", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/details/"+tt.param, nil)
+			r.Header.Set("Accept", "application/json")
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("service_name", tt.param)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+			w := httptest.NewRecorder()
+			proxy.NewTestProxy(proxy.NewStreams(time.Second)).WithServiceByName(byName).PublicRoutes(w, r)
+
+			require.Equal(t, tt.status, w.Code)
+		})
+	}
+}
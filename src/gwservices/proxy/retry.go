@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+const (
+	// retryBodyLimit is the largest request body buffered to be replayed, larger
+	// requests are not retried.
+	retryBodyLimit = 1 << 20
+
+	// retryBudgetReserve retries are always allowed so services with little
+	// traffic can still retry.
+	retryBudgetReserve = 10
+)
+
+// idempotent reports whether r can be sent more than once without side effects.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryableStatus reports whether a response with status code is worth
+// retrying on another target.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the given retry, it doubles on each retry
+// up to MaxBackoff and is jittered to spread the retries of concurrent
+// requests.
+func backoff(p models.RetryPolicy, retry int) time.Duration {
+	d := p.Backoff.Duration()
+	for i := 1; i < retry && d < p.MaxBackoff.Duration(); i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff.Duration() {
+		d = p.MaxBackoff.Duration()
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) //nolint:gosec
+}
+
+// retryBudget allows a ratio of retries to requests. Every request deposits
+// ratio tokens and every retry withdraws one.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetReserve}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > retryBudgetReserve {
+		b.tokens = retryBudgetReserve
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
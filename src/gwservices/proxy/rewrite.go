@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+type rewriteRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func compileRewriteRules(rules []models.RewriteRule) ([]rewriteRule, error) {
+	compiled := make([]rewriteRule, len(rules))
+	for i, r := range rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule %q: %w", r.Match, err)
+		}
+		compiled[i] = rewriteRule{match: re, replace: r.Replace}
+	}
+	return compiled, nil
+}
+
+func applyRewriteRules(rules []rewriteRule, path string) (string, bool) {
+	for _, r := range rules {
+		if r.match.MatchString(path) {
+			return r.match.ReplaceAllString(path, r.replace), true
+		}
+	}
+	return path, false
+}
+
+// pathRewriter maps the gateway paths of a service to its upstream paths
+// and back.
+type pathRewriter struct {
+	mode          string
+	prefix        string
+	basePath      string
+	rules         []rewriteRule
+	responseRules []rewriteRule
+}
+
+func newPathRewriter(s models.Service) (*pathRewriter, error) {
+	rw := &pathRewriter{mode: models.RewriteStrip, prefix: strings.TrimSuffix(cleanPrefix(s.Prefix), "/")}
+	if s.Rewrite == nil {
+		return rw, nil
+	}
+
+	if s.Rewrite.Mode != "" {
+		rw.mode = s.Rewrite.Mode
+	}
+	rw.basePath = strings.TrimSuffix(s.Rewrite.BasePath, "/")
+
+	var err error
+	if rw.rules, err = compileRewriteRules(s.Rewrite.Rules); err != nil {
+		return nil, err
+	}
+	if rw.responseRules, err = compileRewriteRules(s.Rewrite.ResponseRules); err != nil {
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+// toUpstream returns the upstream path of the gateway path.
+func (rw *pathRewriter) toUpstream(path string) string {
+	switch rw.mode {
+	case models.RewriteKeep:
+		return path
+	case models.RewriteRegex:
+		path, _ = applyRewriteRules(rw.rules, path)
+		return path
+	}
+
+	rest, ok := trimPathPrefix(path, rw.prefix)
+	if !ok {
+		// Services routed by domain are not always requested under their
+		// prefix.
+		return path
+	}
+
+	if rw.mode == models.RewriteReplace {
+		return rw.basePath + rest
+	}
+	return rest
+}
+
+// toGateway maps back an upstream path found in a response to the request
+// made on gatewayPath.
+func (rw *pathRewriter) toGateway(gatewayPath, path string) string {
+	switch rw.mode {
+	case models.RewriteKeep:
+		return path
+	case models.RewriteRegex:
+		path, _ = applyRewriteRules(rw.responseRules, path)
+		return path
+	}
+
+	if _, ok := trimPathPrefix(gatewayPath, rw.prefix); !ok {
+		return path
+	}
+
+	if rw.mode == models.RewriteReplace {
+		rest, ok := trimPathPrefix(path, rw.basePath)
+		if !ok {
+			return path
+		}
+		path = rest
+	}
+
+	if rw.prefix == "" {
+		return path
+	}
+	if path == "/" {
+		return rw.prefix + "/"
+	}
+	return rw.prefix + path
+}
+
+// rewriteResponse maps the Location and the Set-Cookie paths of resp back to
+// the gateway, so redirects of the upstream stay under the service prefix.
+func (rw *pathRewriter) rewriteResponse(resp *http.Response, gatewayPath string, upstreamHosts []string) {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		resp.Header.Set("Location", rw.rewriteLocation(loc, gatewayPath, upstreamHosts))
+	}
+
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, c := range cookies {
+		cookies[i] = rw.rewriteCookiePath(c, gatewayPath)
+	}
+}
+
+func (rw *pathRewriter) rewriteLocation(loc, gatewayPath string, upstreamHosts []string) string {
+	u, err := url.Parse(loc)
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return loc
+	}
+
+	if u.Host != "" {
+		if !contains(upstreamHosts, u.Host) {
+			return loc
+		}
+		// Redirects to the upstream itself become relative to the gateway.
+		u.Scheme, u.Host, u.User = "", "", nil
+	}
+
+	u.Path = rw.toGateway(gatewayPath, u.Path)
+	u.RawPath = ""
+
+	return u.String()
+}
+
+func (rw *pathRewriter) rewriteCookiePath(cookie, gatewayPath string) string {
+	attrs := strings.Split(cookie, ";")
+	for i, attr := range attrs {
+		name, value, ok := strings.Cut(strings.TrimSpace(attr), "=")
+		if !ok || !strings.EqualFold(name, "path") || !strings.HasPrefix(value, "/") {
+			continue
+		}
+		// A cookie of the upstream root is scoped to the whole prefix, with or
+		// without its trailing slash.
+		path := rw.toGateway(gatewayPath, value)
+		if len(path) > 1 && (value == "/" || !strings.HasSuffix(value, "/")) {
+			path = strings.TrimSuffix(path, "/")
+		}
+		attrs[i] = " Path=" + path
+	}
+	return strings.Join(attrs, ";")
+}
+
+// trimPathPrefix removes prefix from path when it matches whole segments.
+func trimPathPrefix(path, prefix string) (string, bool) {
+	if prefix == "" {
+		return path, true
+	}
+
+	rest := strings.TrimPrefix(path, prefix)
+	switch {
+	case len(rest) == len(path):
+		return path, false
+	case rest == "":
+		return "/", true
+	case rest[0] == '/':
+		return rest, true
+	default:
+		return path, false
+	}
+}
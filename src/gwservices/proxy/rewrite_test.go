@@ -0,0 +1,115 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyRewrite(t *testing.T) {
+	// The upstream echoes the path it received, redirects to the redirect
+	// parameter and sets a cookie on the cookie parameter path.
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		if path := r.URL.Query().Get("cookie"); path != "" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: path, HttpOnly: true})
+		}
+		if loc := r.URL.Query().Get("redirect"); loc != "" {
+			http.Redirect(w, r, loc, http.StatusFound)
+		}
+	}))
+	defer u.Close()
+
+	tests := []struct {
+		name     string
+		rewrite  *models.Rewrite
+		path     string
+		upstream string
+		location string
+		cookie   string
+	}{
+		{
+			name:     "strip by default",
+			path:     "/api/users?redirect=/login&cookie=/",
+			upstream: "/users",
+			location: "/api/login",
+			cookie:   "session=1; Path=/api; HttpOnly",
+		},
+		{
+			name:     "strip prefix only",
+			path:     "/api?redirect=/&cookie=/account",
+			upstream: "/",
+			location: "/api/",
+			cookie:   "session=1; Path=/api/account; HttpOnly",
+		},
+		{
+			name:     "absolute upstream redirect",
+			path:     "/api/users?redirect=" + u.URL + "/login%3Fnext%3D1",
+			upstream: "/users",
+			location: "/api/login?next=1",
+		},
+		{
+			name:     "external redirect",
+			path:     "/api/users?redirect=https://accounts.example.com/login",
+			upstream: "/users",
+			location: "https://accounts.example.com/login",
+		},
+		{
+			name:     "keep",
+			rewrite:  &models.Rewrite{Mode: models.RewriteKeep},
+			path:     "/api/users?redirect=/api/login&cookie=/api",
+			upstream: "/api/users",
+			location: "/api/login",
+			cookie:   "session=1; Path=/api; HttpOnly",
+		},
+		{
+			name:     "replace",
+			rewrite:  &models.Rewrite{Mode: models.RewriteReplace, BasePath: "/v2/"},
+			path:     "/api/users?redirect=/v2/login&cookie=/v2",
+			upstream: "/v2/users",
+			location: "/api/login",
+			cookie:   "session=1; Path=/api; HttpOnly",
+		},
+		{
+			name:     "replace outside base path",
+			rewrite:  &models.Rewrite{Mode: models.RewriteReplace, BasePath: "/v2"},
+			path:     "/api/users?redirect=/static/logo.png",
+			upstream: "/v2/users",
+			location: "/static/logo.png",
+		},
+		{
+			name: "regex",
+			rewrite: &models.Rewrite{
+				Mode:          models.RewriteRegex,
+				Rules:         []models.RewriteRule{{Match: `^/api/users/(?P<id>\d+)$`, Replace: "/accounts/${id}/profile"}},
+				ResponseRules: []models.RewriteRule{{Match: `^/accounts/(\d+)/profile$`, Replace: "/api/users/$1"}},
+			},
+			path:     "/api/users/42?redirect=/accounts/7/profile",
+			upstream: "/accounts/42/profile",
+			location: "/api/users/7",
+		},
+		{
+			name: "regex without match",
+			rewrite: &models.Rewrite{
+				Mode:  models.RewriteRegex,
+				Rules: []models.RewriteRule{{Match: `^/api/users/(\d+)$`, Replace: "/accounts/$1"}},
+			},
+			path:     "/api/teams?redirect=/login",
+			upstream: "/api/teams",
+			location: "/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, models.Service{Prefix: "/api", Host: u.URL, Rewrite: tt.rewrite}, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			require.Equal(t, tt.upstream, w.Header().Get("X-Path"))
+			require.Equal(t, tt.location, w.Header().Get("Location"))
+			require.Equal(t, tt.cookie, w.Header().Get("Set-Cookie"))
+		})
+	}
+}
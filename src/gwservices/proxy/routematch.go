@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// RouteConflictError is returned when two services would receive the same
+// requests.
+type RouteConflictError struct {
+	Service string
+	Route   string
+}
+
+func (e *RouteConflictError) Error() string {
+	return fmt.Sprintf("%s is already routed to service %q with overlapping matchers", e.Route, e.Service)
+}
+
+// matchRequest reports whether r satisfies the method and header matchers
+// of s.
+func matchRequest(s *models.Service, r *http.Request) bool {
+	if len(s.Methods) > 0 && !containsMethod(s.Methods, r.Method) {
+		return false
+	}
+
+	for name, value := range s.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if value != "" && !contains(values, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortBySpecificity orders services sharing a route so the ones with the most
+// matchers are tried first.
+func sortBySpecificity(services []*models.Service) {
+	sort.SliceStable(services, func(i, j int) bool {
+		return specificity(services[i]) > specificity(services[j])
+	})
+}
+
+func specificity(s *models.Service) int {
+	n := len(s.Headers)
+	if len(s.Methods) > 0 {
+		n++
+	}
+	return n
+}
+
+// overlaps reports whether a request could satisfy the matchers of both a
+// and b.
+func overlaps(a, b *models.Service) bool {
+	if len(a.Methods) > 0 && len(b.Methods) > 0 {
+		shared := false
+		for _, m := range a.Methods {
+			if containsMethod(b.Methods, m) {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			return false
+		}
+	}
+
+	for name, value := range a.Headers {
+		for otherName, otherValue := range b.Headers {
+			if !strings.EqualFold(name, otherName) {
+				continue
+			}
+			if value != "" && otherValue != "" && value != otherValue {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
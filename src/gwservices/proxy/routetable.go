@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amaurybrisou/ablib"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrServiceNotFound = errors.New("service not found")
+
+// ServiceLoader returns every service the route table should know about.
+type ServiceLoader func(ctx context.Context) ([]*models.Service, error)
+
+// ChangeListener blocks until ctx is done, calling onChange every time the
+// services are modified, possibly by another gateway replica.
+type ChangeListener func(ctx context.Context, onChange func(ctx context.Context)) error
+
+// RouteTable keeps the services in memory, indexed by path prefix and domain.
+// Lookups read an immutable snapshot without locking, reloads build a new
+// snapshot and swap it atomically.
+type RouteTable struct {
+	snapshot atomic.Pointer[routes]
+	reloadMu sync.Mutex
+
+	load     ServiceLoader
+	listen   ChangeListener
+	onReload func(services []*models.Service)
+
+	retryInterval time.Duration
+	done          chan struct{}
+	stopOnce      sync.Once
+}
+
+func NewRouteTable(load ServiceLoader, listen ChangeListener) *RouteTable {
+	return &RouteTable{
+		load:          load,
+		listen:        listen,
+		retryInterval: 5 * time.Second,
+		done:          make(chan struct{}),
+	}
+}
+
+// OnReload registers f to be called with the services of every reload. It
+// must be called before the table is started.
+func (t *RouteTable) OnReload(f func(services []*models.Service)) {
+	t.onReload = f
+}
+
+// Reload fetches the services and replaces the current snapshot.
+func (t *RouteTable) Reload(ctx context.Context) error {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+
+	services, err := t.load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load services: %w", err)
+	}
+
+	t.snapshot.Store(buildRoutes(services))
+	if t.onReload != nil {
+		t.onReload(services)
+	}
+
+	log.Ctx(ctx).Debug().Int("services", len(services)).Msg("route table reloaded")
+
+	return nil
+}
+
+// Lookup returns the service the request is routed to. Services owning the
+// request host take precedence, then the service with the longest prefix
+// matching the request path. Services whose method or header matchers reject
+// the request are skipped.
+func (t *RouteTable) Lookup(ctx context.Context, r *http.Request) (models.Service, error) {
+	rt, err := t.current(ctx)
+	if err != nil {
+		return models.Service{}, err
+	}
+
+	for _, s := range rt.domains[r.Host] {
+		if matchRequest(s, r) {
+			return *s, nil
+		}
+	}
+
+	nodes := rt.prefixes.walk(r.URL.Path)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		for _, s := range nodes[i].services {
+			if matchRequest(s, r) {
+				return *s, nil
+			}
+		}
+	}
+
+	return models.Service{}, ErrServiceNotFound
+}
+
+// Conflict returns a *RouteConflictError when s would be routed the same
+// requests as an existing service. The service sharing its name is ignored
+// since creating it again updates it.
+func (t *RouteTable) Conflict(ctx context.Context, s models.Service) error {
+	rt, err := t.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range rt.services {
+		if other.Name == s.Name {
+			continue
+		}
+
+		if s.Domain != "" && s.Domain == other.Domain && overlaps(&s, other) {
+			return &RouteConflictError{Service: other.Name, Route: "domain " + s.Domain}
+		}
+
+		// Services without a prefix are routed by their domain only.
+		if s.Prefix == "" || other.Prefix == "" {
+			continue
+		}
+
+		if cleanPrefix(s.Prefix) == cleanPrefix(other.Prefix) && overlaps(&s, other) {
+			return &RouteConflictError{Service: other.Name, Route: "prefix " + cleanPrefix(s.Prefix)}
+		}
+	}
+
+	return nil
+}
+
+// current returns the active snapshot, loading it on first use so the table
+// works even when it has not been started with the core.
+func (t *RouteTable) current(ctx context.Context) (*routes, error) {
+	if rt := t.snapshot.Load(); rt != nil {
+		return rt, nil
+	}
+
+	if err := t.Reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return t.snapshot.Load(), nil
+}
+
+func (t *RouteTable) New(c *ablib.Core) {
+	c.AddStartFunc(t.Start)
+	c.AddStopFunc(t.Stop)
+}
+
+// Start loads the route table and keeps it in sync with the database
+// notifications until the core stops.
+func (t *RouteTable) Start(ctx context.Context) (<-chan struct{}, <-chan error) {
+	log.Ctx(ctx).Info().Msg("start route table")
+
+	errChan := make(chan error)
+	startedChan := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer close(errChan)
+		defer close(startedChan)
+		defer cancel()
+
+		if err := t.Reload(ctx); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("initial route table load")
+		}
+
+		startedChan <- struct{}{}
+
+		go func() {
+			select {
+			case <-t.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		t.listenLoop(ctx)
+		log.Ctx(ctx).Info().Msg("stop route table")
+	}()
+
+	return startedChan, errChan
+}
+
+func (t *RouteTable) listenLoop(ctx context.Context) {
+	if t.listen == nil {
+		<-ctx.Done()
+		return
+	}
+
+	onChange := func(ctx context.Context) {
+		if err := t.Reload(ctx); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("route table reload")
+		}
+	}
+
+	for {
+		err := t.listen(ctx, onChange)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Ctx(ctx).Error().Err(err).Msg("service change listener stopped, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.retryInterval):
+		}
+
+		// Changes may have been missed while the listener was down.
+		onChange(ctx)
+	}
+}
+
+func (t *RouteTable) Stop(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+type routes struct {
+	services []*models.Service
+	prefixes *prefixNode
+	domains  map[string][]*models.Service
+}
+
+func buildRoutes(services []*models.Service) *routes {
+	rt := &routes{
+		services: services,
+		prefixes: &prefixNode{},
+		domains:  make(map[string][]*models.Service, len(services)),
+	}
+
+	for _, s := range services {
+		if s.Prefix != "" {
+			rt.prefixes.insert(s.Prefix, s)
+		}
+		if s.Domain != "" {
+			rt.domains[s.Domain] = append(rt.domains[s.Domain], s)
+		}
+	}
+
+	for _, candidates := range rt.domains {
+		sortBySpecificity(candidates)
+	}
+	rt.prefixes.sort()
+
+	return rt
+}
+
+// prefixNode is a trie over the path segments of the service prefixes.
+type prefixNode struct {
+	children map[string]*prefixNode
+	services []*models.Service
+}
+
+func (n *prefixNode) insert(prefix string, s *models.Service) {
+	node := n
+	for _, segment := range splitPath(prefix) {
+		if node.children == nil {
+			node.children = make(map[string]*prefixNode)
+		}
+		child, ok := node.children[segment]
+		if !ok {
+			child = &prefixNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.services = append(node.services, s)
+}
+
+func (n *prefixNode) sort() {
+	sortBySpecificity(n.services)
+	for _, child := range n.children {
+		child.sort()
+	}
+}
+
+// walk returns the nodes holding services along path, shortest prefix first.
+func (n *prefixNode) walk(path string) []*prefixNode {
+	var nodes []*prefixNode
+
+	node := n
+	if len(node.services) > 0 {
+		nodes = append(nodes, node)
+	}
+
+	for _, segment := range splitPath(path) {
+		child, ok := node.children[segment]
+		if !ok {
+			break
+		}
+		node = child
+		if len(node.services) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func cleanPrefix(p string) string {
+	return "/" + strings.Join(splitPath(p), "/")
+}
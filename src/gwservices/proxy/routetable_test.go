@@ -0,0 +1,211 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/require"
+)
+
+func staticServices(services ...*models.Service) proxy.ServiceLoader {
+	return func(ctx context.Context) ([]*models.Service, error) {
+		return services, nil
+	}
+}
+
+func generateServices(n int) []*models.Service {
+	services := make([]*models.Service, n)
+	for i := range services {
+		services[i] = &models.Service{
+			ID:     uuid.New(),
+			Name:   fmt.Sprintf("service-%d", i),
+			Prefix: fmt.Sprintf("/service-%d", i),
+			Domain: fmt.Sprintf("service-%d.gateway.org", i),
+			Host:   fmt.Sprintf("http://service-%d:8080", i),
+		}
+	}
+	return services
+}
+
+func request(method, host, path string, headers ...string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.Host = host
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	api := &models.Service{ID: uuid.New(), Name: "api", Prefix: "/api"}
+	billing := &models.Service{ID: uuid.New(), Name: "billing", Prefix: "/api/v2/billing"}
+	billingWrite := &models.Service{
+		ID: uuid.New(), Name: "billing-write", Prefix: "/api/v2/billing",
+		Methods: []string{http.MethodPost}, Headers: map[string]string{"X-Tenant": ""},
+	}
+	certs := &models.Service{ID: uuid.New(), Name: "certs", Prefix: "/certs", Domain: "certs.gateway.org"}
+	beta := &models.Service{
+		ID: uuid.New(), Name: "beta", Prefix: "/beta", Domain: "certs.gateway.org",
+		Headers: map[string]string{"X-Channel": "beta"},
+	}
+
+	table := proxy.NewRouteTable(staticServices(api, billing, billingWrite, certs, beta), nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		request  *http.Request
+		expected *models.Service
+	}{
+		{"exact prefix", request(http.MethodGet, "localhost", "/api"), api},
+		{"nested path", request(http.MethodGet, "localhost", "/api/v1/users"), api},
+		{"longest prefix", request(http.MethodGet, "localhost", "/api/v2/billing/invoices"), billing},
+		{"method and header matchers", request(http.MethodPost, "localhost", "/api/v2/billing", "X-Tenant", "acme"), billingWrite},
+		{"missing header falls back", request(http.MethodPost, "localhost", "/api/v2/billing"), billing},
+		{"segment boundary", request(http.MethodGet, "localhost", "/apis"), nil},
+		{"domain", request(http.MethodGet, "certs.gateway.org", "/"), certs},
+		{"domain before prefix", request(http.MethodGet, "certs.gateway.org", "/api"), certs},
+		{"domain header matcher", request(http.MethodGet, "certs.gateway.org", "/", "X-Channel", "beta"), beta},
+		{"unknown", request(http.MethodGet, "localhost", "/unknown"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := table.Lookup(ctx, tt.request)
+			if tt.expected == nil {
+				require.ErrorIs(t, err, proxy.ErrServiceNotFound)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected.Name, s.Name)
+		})
+	}
+}
+
+func TestRouteTableConflict(t *testing.T) {
+	api := &models.Service{Name: "api", Prefix: "/api", Methods: []string{http.MethodGet}}
+	certs := &models.Service{Name: "certs", Prefix: "/certs", Domain: "certs.gateway.org", Headers: map[string]string{"X-Channel": "stable"}}
+
+	www := &models.Service{Name: "www", Domain: "www.gateway.org"}
+
+	table := proxy.NewRouteTable(staticServices(api, certs, www), nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		service  models.Service
+		conflict bool
+	}{
+		{"same name updates", models.Service{Name: "api", Prefix: "/api"}, false},
+		{"same prefix", models.Service{Name: "other", Prefix: "/api/"}, true},
+		{"same prefix other method", models.Service{Name: "other", Prefix: "/api", Methods: []string{http.MethodPost}}, false},
+		{"nested prefix", models.Service{Name: "other", Prefix: "/api/v2"}, false},
+		{"same domain", models.Service{Name: "other", Prefix: "/other", Domain: "certs.gateway.org"}, true},
+		{"same domain other header", models.Service{Name: "other", Prefix: "/other", Domain: "certs.gateway.org", Headers: map[string]string{"X-Channel": "beta"}}, false},
+		{"domain only other domain", models.Service{Name: "other", Domain: "other.gateway.org"}, false},
+		{"domain only same domain", models.Service{Name: "other", Domain: "www.gateway.org"}, true},
+		{"catch-all prefix", models.Service{Name: "other", Prefix: "/"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := table.Conflict(ctx, tt.service)
+			if !tt.conflict {
+				require.NoError(t, err)
+				return
+			}
+			var conflictErr *proxy.RouteConflictError
+			require.ErrorAs(t, err, &conflictErr)
+		})
+	}
+}
+
+func TestRouteTableReload(t *testing.T) {
+	services := []*models.Service{{ID: uuid.New(), Name: "hello", Prefix: "/hello"}}
+
+	table := proxy.NewRouteTable(func(ctx context.Context) ([]*models.Service, error) {
+		return services, nil
+	}, nil)
+	ctx := context.Background()
+
+	_, err := table.Lookup(ctx, request(http.MethodGet, "localhost", "/hello"))
+	require.NoError(t, err)
+
+	services = nil
+	require.NoError(t, table.Reload(ctx))
+
+	_, err = table.Lookup(ctx, request(http.MethodGet, "localhost", "/hello"))
+	require.ErrorIs(t, err, proxy.ErrServiceNotFound)
+}
+
+func TestRouteTableStopTwice(t *testing.T) {
+	table := proxy.NewRouteTable(staticServices(), nil)
+	ctx := context.Background()
+
+	require.NoError(t, table.Stop(ctx))
+	require.NotPanics(t, func() { table.Stop(ctx) }) //nolint
+}
+
+func BenchmarkRouteTableLookup(b *testing.B) {
+	table := proxy.NewRouteTable(staticServices(generateServices(1000)...), nil)
+	ctx := context.Background()
+	require.NoError(b, table.Reload(ctx))
+
+	requests := make([]*http.Request, 1000)
+	for i := range requests {
+		requests[i] = request(http.MethodGet, "localhost", fmt.Sprintf("/service-%d/resource", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := table.Lookup(ctx, requests[i%1000]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkDatabaseLookup measures the previous per-request query, pass
+// `BENCH_DATABASE_URL` pointing to a migrated database to run it.
+func BenchmarkDatabaseLookup(b *testing.B) {
+	connString := os.Getenv("BENCH_DATABASE_URL")
+	if connString == "" {
+		b.Skip("BENCH_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, connString)
+	require.NoError(b, err)
+	defer pool.Close()
+
+	db := database.New(pool)
+	for _, s := range generateServices(1000) {
+		_, err := db.CreateService(ctx, *s)
+		require.NoError(b, err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := db.GetServiceByPrefixOrDomain(ctx, fmt.Sprintf("/service-%d", i%1000), "localhost"); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/signature"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxySigning(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	verifier := signature.NewVerifier(secret, time.Minute)
+
+	var verifyErr error
+	var received http.Header
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyErr = verifier.Verify(r)
+		received = r.Header.Clone()
+	}))
+	defer u.Close()
+
+	service := models.Service{
+		Prefix:  "/api",
+		Host:    u.URL,
+		Signing: &models.Signing{Secret: secret},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users?page=2", nil)
+	req.Header.Set(signature.HeaderPlan, `{"tier":"pro"}`)
+	w := serve(t, service, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, verifyErr)
+
+	// Signatures sent by the client are dropped.
+	req = httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set(signature.HeaderSignature, "v1=00")
+	req.Header.Set(signature.HeaderTimestamp, "1")
+	service.Signing = nil
+	serve(t, service, req)
+	require.Empty(t, received.Get(signature.HeaderSignature))
+	require.Empty(t, received.Get(signature.HeaderTimestamp))
+	require.ErrorIs(t, verifyErr, signature.ErrMissing)
+}
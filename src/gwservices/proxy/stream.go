@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amaurybrisou/ablib"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrDraining is returned when a stream is opened while the gateway shuts
+// down.
+var ErrDraining = errors.New("gateway is draining streams")
+
+const (
+	streamSSE  = "sse"
+	streamGRPC = "grpc"
+)
+
+// StreamKind returns the kind of long-lived connection r asks for, either a
+// protocol upgrade such as "websocket", "sse" or "grpc", and an empty string
+// for regular requests. gRPC calls are streams as they can stream messages
+// both ways and carry their own deadline. The headers are set by the client,
+// the proxy only treats a request as a stream once the upstream answered it
+// as one, see responseStreamKind.
+func StreamKind(r *http.Request) string {
+	if IsGRPC(r) {
+		return streamGRPC
+	}
+
+	if upgrade := r.Header.Get("Upgrade"); upgrade != "" && headerHasToken(r.Header, "Connection", "upgrade") {
+		return strings.ToLower(upgrade)
+	}
+
+	if headerHasToken(r.Header, "Accept", "text/event-stream") {
+		return streamSSE
+	}
+
+	return ""
+}
+
+// responseStreamKind returns the kind of long-lived connection the upstream
+// answered resp with, either the protocol it switched to or "sse", and an
+// empty string for regular responses.
+func responseStreamKind(resp *http.Response) string {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if upgrade := resp.Header.Get("Upgrade"); upgrade != "" {
+			return strings.ToLower(upgrade)
+		}
+		return "upgrade"
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return streamSSE
+	}
+
+	return ""
+}
+
+// IsStream reports whether r opens a long-lived connection.
+func IsStream(r *http.Request) bool {
+	return StreamKind(r) != ""
+}
+
+// SkipStreams applies mw to every request but the streams, which must not be
+// cut off by a deadline nor hidden behind a ResponseWriter that cannot flush
+// or hijack the connection.
+func SkipStreams(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsStream(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if t, _, _ := strings.Cut(strings.TrimSpace(t), ";"); strings.EqualFold(t, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Streams tracks the long-lived connections going through the proxy so they
+// can be ended when idle, too old or when the gateway shuts down.
+type Streams struct {
+	drainTimeout time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	active   map[*stream]struct{}
+	wg       sync.WaitGroup
+}
+
+func NewStreams(drainTimeout time.Duration) *Streams {
+	return &Streams{
+		drainTimeout: drainTimeout,
+		active:       make(map[*stream]struct{}),
+	}
+}
+
+// open registers a stream of service carried by the request of ctx, cancel
+// ends the request when the stream is ended by the gateway. close must be
+// called once the stream is over.
+func (s *Streams) open(ctx context.Context, cancel context.CancelFunc, service models.Service, kind string) (*stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return nil, ErrDraining
+	}
+
+	limits := service.Streaming.WithDefaults()
+
+	st := &stream{
+		ctx:     ctx,
+		service: service.Name,
+		kind:    kind,
+		idle:    limits.IdleTimeout.Duration(),
+		cancel:  cancel,
+	}
+	st.idleTimer = time.AfterFunc(st.idle, func() { st.end("idle timeout") })
+	if limits.MaxLifetime > 0 {
+		st.lifetimeTimer = time.AfterFunc(limits.MaxLifetime.Duration(), func() { st.end("max lifetime") })
+	}
+
+	s.active[st] = struct{}{}
+	s.wg.Add(1)
+	activeStreamsGauge.WithLabelValues(st.service, st.kind).Inc()
+
+	return st, nil
+}
+
+func (s *Streams) close(st *stream) {
+	st.idleTimer.Stop()
+	if st.lifetimeTimer != nil {
+		st.lifetimeTimer.Stop()
+	}
+	st.cancel()
+
+	s.mu.Lock()
+	delete(s.active, st)
+	s.mu.Unlock()
+
+	activeStreamsGauge.WithLabelValues(st.service, st.kind).Dec()
+	s.wg.Done()
+}
+
+// Active returns the number of open streams.
+func (s *Streams) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
+
+// Drain refuses new streams, ends the open ones and waits for them to be
+// closed, at most for the drain timeout.
+func (s *Streams) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	for st := range s.active {
+		st.end("shutdown")
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	if s.drainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.drainTimeout)
+		defer cancel()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to drain %d streams: %w", s.Active(), ctx.Err())
+	}
+}
+
+func (s *Streams) New(core *ablib.Core) {
+	core.AddStartFunc(s.Start)
+	core.AddStopFunc(s.Stop)
+}
+
+func (s *Streams) Start(ctx context.Context) (<-chan struct{}, <-chan error) {
+	errChan := make(chan error)
+	startedChan := make(chan struct{})
+
+	go func() {
+		defer close(errChan)
+		defer close(startedChan)
+		startedChan <- struct{}{}
+	}()
+
+	return startedChan, errChan
+}
+
+func (s *Streams) Stop(ctx context.Context) error {
+	log.Ctx(ctx).Info().Int("streams", s.Active()).Msg("draining streams")
+	return s.Drain(ctx)
+}
+
+// stream is a long-lived connection of a service.
+type stream struct {
+	ctx     context.Context
+	service string
+	kind    string
+	idle    time.Duration
+	cancel  context.CancelFunc
+
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+	ended         atomic.Bool
+}
+
+// touch postpones the idle timeout after some traffic.
+func (st *stream) touch() {
+	if !st.ended.Load() {
+		st.idleTimer.Reset(st.idle)
+	}
+}
+
+// end cuts the stream off, the copy of its body then ends as if the
+// upstream closed it.
+func (st *stream) end(reason string) {
+	if !st.ended.CompareAndSwap(false, true) {
+		return
+	}
+
+	log.Ctx(st.ctx).Info().
+		Str("service", st.service).
+		Str("kind", st.kind).
+		Str("reason", reason).
+		Msg("stream ended")
+
+	st.cancel()
+}
+
+// body wraps the upstream response body of the stream to track its activity.
+// Upgraded connections keep their io.Writer for the reverse proxy to copy the
+// client traffic.
+func (st *stream) body(body io.ReadCloser) io.ReadCloser {
+	sb := streamBody{ReadCloser: body, stream: st}
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return streamReadWriteBody{streamBody: sb, w: rwc}
+	}
+	return sb
+}
+
+type streamBody struct {
+	io.ReadCloser
+	stream *stream
+}
+
+func (b streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.stream.touch()
+	}
+	if err != nil && b.stream.ended.Load() {
+		// Report the streams ended by the gateway as closed normally, so
+		// the response is terminated cleanly rather than aborted.
+		return n, io.EOF
+	}
+	return n, err
+}
+
+type streamReadWriteBody struct {
+	streamBody
+	w io.Writer
+}
+
+// Read reports the error of the closed connection as is, it makes the reverse
+// proxy close the client connection rather than wait for the client to close
+// its side.
+func (b streamReadWriteBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.stream.touch()
+	}
+	return n, err
+}
+
+func (b streamReadWriteBody) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	if n > 0 {
+		b.stream.touch()
+	}
+	return n, err
+}
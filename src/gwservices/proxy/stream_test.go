@@ -0,0 +1,173 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    string
+	}{
+		{"plain request", nil, ""},
+		{"websocket", []string{"Connection", "keep-alive, Upgrade", "Upgrade", "websocket"}, "websocket"},
+		{"upgrade without connection header", []string{"Upgrade", "websocket"}, ""},
+		{"server-sent events", []string{"Accept", "text/event-stream"}, "sse"},
+		{"accept list", []string{"Accept", "application/json, text/event-stream;q=0.9"}, "sse"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, proxy.StreamKind(request(http.MethodGet, "gw.test", "/", tt.headers...)))
+		})
+	}
+}
+
+// sseUpstream sends one event then holds the stream open until the client
+// goes away.
+func sseUpstream(t *testing.T) *httptest.Server {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func streamService(host string, limits *models.StreamLimits) models.Service {
+	return models.Service{ID: uuid.New(), Name: "stream", Host: host, Streaming: limits}
+}
+
+func openSSE(t *testing.T, url string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	u := sseUpstream(t)
+	streams := proxy.NewStreams(time.Second)
+	p := proxy.NewTestProxy(streams)
+
+	gw := httptest.NewServer(p.ProxyHandler(streamService(u.URL, &models.StreamLimits{
+		IdleTimeout: models.Duration(50 * time.Millisecond),
+	}), nil, nil))
+	defer gw.Close()
+
+	resp := openSSE(t, gw.URL)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "data: hello\n\n", string(body))
+	require.Eventually(t, func() bool { return streams.Active() == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestStreamMaxLifetime(t *testing.T) {
+	u := sseUpstream(t)
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second))
+
+	gw := httptest.NewServer(p.ProxyHandler(streamService(u.URL, &models.StreamLimits{
+		IdleTimeout: models.Duration(time.Minute),
+		MaxLifetime: models.Duration(50 * time.Millisecond),
+	}), nil, nil))
+	defer gw.Close()
+
+	start := time.Now()
+	body, err := io.ReadAll(openSSE(t, gw.URL).Body)
+	require.NoError(t, err)
+	require.Equal(t, "data: hello\n\n", string(body))
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestStreamDrain(t *testing.T) {
+	u := sseUpstream(t)
+	streams := proxy.NewStreams(time.Second)
+	p := proxy.NewTestProxy(streams)
+
+	gw := httptest.NewServer(p.ProxyHandler(streamService(u.URL, nil), nil, nil))
+	defer gw.Close()
+
+	resp := openSSE(t, gw.URL)
+	require.Equal(t, 1, streams.Active())
+
+	require.NoError(t, streams.Drain(context.Background()))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "data: hello\n\n", string(body))
+
+	resp = openSSE(t, gw.URL)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestStreamUpgrade(t *testing.T) {
+	// The upstream switches to an echo protocol.
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw) //nolint
+	}))
+	defer u.Close()
+
+	streams := proxy.NewStreams(time.Second)
+	p := proxy.NewTestProxy(streams)
+
+	gw := httptest.NewServer(p.ProxyHandler(streamService(u.URL, &models.StreamLimits{
+		IdleTimeout: models.Duration(100 * time.Millisecond),
+	}), nil, nil))
+	defer gw.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gw.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: gw.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, 1, streams.Active())
+
+	fmt.Fprint(conn, "ping")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	// Without traffic the connection is closed after the idle timeout.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = br.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+	require.Eventually(t, func() bool { return streams.Active() == 0 }, time.Second, 5*time.Millisecond)
+}
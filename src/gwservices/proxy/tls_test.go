@@ -0,0 +1,111 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSigned returns a PEM encoded self-signed client certificate and key.
+func selfSigned(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// tlsUpstream answers the server name requested by the client, clientCert
+// is accepted as a client certificate.
+func tlsUpstream(t *testing.T, clientCert []byte, clientAuth tls.ClientAuthType) (u *httptest.Server, ca string) {
+	t.Helper()
+
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(clientCert))
+
+	u = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName) //nolint
+	}))
+	u.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: clientAuth}
+	u.StartTLS()
+
+	// The test certificate is valid for example.com and 127.0.0.1.
+	return u, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: u.Certificate().Raw}))
+}
+
+func TestProxyUpstreamTLS(t *testing.T) {
+	clientCert, clientKey := selfSigned(t)
+	u, ca := tlsUpstream(t, clientCert, tls.VerifyClientCertIfGiven)
+	defer u.Close()
+
+	tests := []struct {
+		name   string
+		tls    *models.UpstreamTLS
+		status int
+		body   string
+	}{
+		{name: "unknown authority", status: http.StatusBadGateway},
+		{name: "custom ca", tls: &models.UpstreamTLS{CACert: ca}, status: http.StatusOK},
+		{name: "server name", tls: &models.UpstreamTLS{CACert: ca, ServerName: "example.com"}, status: http.StatusOK, body: "example.com"},
+		{name: "wrong server name", tls: &models.UpstreamTLS{CACert: ca, ServerName: "other.org"}, status: http.StatusBadGateway},
+		{name: "skip verify", tls: &models.UpstreamTLS{InsecureSkipVerify: true, ServerName: "other.org"}, status: http.StatusOK, body: "other.org"},
+		{
+			name:   "client certificate",
+			tls:    &models.UpstreamTLS{CACert: ca, ClientCert: string(clientCert), ClientKey: string(clientKey)},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, models.Service{Host: u.URL, TLS: tt.tls}, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusOK {
+				require.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("mutual tls required", func(t *testing.T) {
+		u, ca := tlsUpstream(t, clientCert, tls.RequireAndVerifyClientCert)
+		defer u.Close()
+
+		w := serve(t, models.Service{Host: u.URL, TLS: &models.UpstreamTLS{CACert: ca}}, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusBadGateway, w.Code)
+
+		w = serve(t, models.Service{Host: u.URL, TLS: &models.UpstreamTLS{
+			CACert:     ca,
+			ClientCert: string(clientCert),
+			ClientKey:  string(clientKey),
+		}}, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -0,0 +1,108 @@
+package proxy_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyTransform(t *testing.T) {
+	var received string
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body) //nolint
+		received = string(b)
+
+		w.Header().Set("Content-Type", "application/json")
+		body := io.Writer(w)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			body = gz
+		}
+		io.WriteString(body, `{"id":1,"internal":{"host":"db-1"}}`) //nolint
+	}))
+	defer u.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"a"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	w := serve(t, models.Service{
+		Host: u.URL,
+		Transform: &models.Transform{
+			Request:  []models.PatchRule{{Op: models.PatchAdd, Path: "/source", Value: json.RawMessage(`"gateway"`)}},
+			Response: []models.PatchRule{{Op: models.PatchRemove, Path: "/internal"}},
+		},
+	}, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"name":"a","source":"gateway"}`, received)
+	// The upstream compression is undone to patch the body.
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Equal(t, `{"id":1}`, w.Body.String())
+	require.Equal(t, "8", w.Header().Get("Content-Length"))
+}
+
+func TestProxyTransformStreamHeaders(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":1,"internal":{"host":"db-1"}}`) //nolint
+	}))
+	defer u.Close()
+
+	service := models.Service{
+		Host:      u.URL,
+		Transform: &models.Transform{Response: []models.PatchRule{{Op: models.PatchRemove, Path: "/internal"}}},
+	}
+
+	// Asking for a stream does not skip the transformation of a regular
+	// response.
+	for name, header := range map[string][2]string{
+		"event stream": {"Accept", "application/json, text/event-stream"},
+		"grpc":         {"Content-Type", "application/grpc"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(header[0], header[1])
+
+		w := serve(t, service, req)
+		require.Equal(t, http.StatusOK, w.Code, name)
+		require.Equal(t, `{"id":1}`, w.Body.String(), name)
+	}
+}
+
+func TestProxyTransformUpdate(t *testing.T) {
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":1,"internal":{"host":"db-1"}}`) //nolint
+	}))
+	defer u.Close()
+
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second))
+	service := models.Service{ID: uuid.New(), Host: u.URL}
+
+	get := func(service models.Service) string {
+		w := httptest.NewRecorder()
+		p.ProxyHandler(service, nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	require.Equal(t, `{"id":1,"internal":{"host":"db-1"}}`, get(service))
+
+	// The pipeline is built with the pool of the service, a new
+	// configuration replaces it.
+	service.Transform = &models.Transform{Response: []models.PatchRule{{Op: models.PatchRemove, Path: "/internal"}}}
+	require.Equal(t, `{"id":1}`, get(service))
+	require.Equal(t, 1, p.UpstreamPools())
+}
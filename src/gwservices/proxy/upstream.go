@@ -0,0 +1,471 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/transform"
+	"github.com/amaurybrisou/gateway/src/upstreamtls"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrNoHealthyTarget is returned when the health checks reject every
+	// target of a service.
+	ErrNoHealthyTarget = errors.New("no healthy target")
+	// ErrCircuitOpen is returned when the circuit breakers of every healthy
+	// target of a service are open.
+	ErrCircuitOpen = errors.New("circuit breaker open")
+)
+
+// UnavailableError is returned when a service cannot take requests for now,
+// clients may try again after RetryAfter.
+type UnavailableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// HealthState reports the outcome of the active health checks.
+type HealthState interface {
+	Healthy(serviceID uuid.UUID, targetURL string) bool
+}
+
+// target is one upstream instance of a service.
+type target struct {
+	raw     string
+	url     *url.URL
+	weight  int
+	breaker *circuitBreaker
+
+	active atomic.Int64
+}
+
+// upstreamPool holds the targets of a service and the state used to balance
+// the requests between them.
+type upstreamPool struct {
+	serviceID  uuid.UUID
+	service    string
+	key        string
+	targets    []*target
+	balancer   balancer
+	health     HealthState
+	retryAfter time.Duration
+	retry      models.RetryPolicy
+	budget     *retryBudget
+	limits     models.ServiceLimits
+	transport  upstreamRoundTripper
+	rewriter   *pathRewriter
+	hosts      []string
+	pipeline   *transform.Pipeline
+}
+
+func newUpstreamPool(s models.Service, key string, health HealthState, tlsConfig *tls.Config) (*upstreamPool, error) {
+	upstreams := s.Upstreams()
+	retry := s.RetryPolicy.WithDefaults()
+	breaker := s.CircuitBreaker.WithDefaults()
+	limits := s.Limits.WithDefaults()
+
+	p := &upstreamPool{
+		serviceID:  s.ID,
+		service:    s.Name,
+		key:        key,
+		targets:    make([]*target, len(upstreams)),
+		health:     health,
+		retryAfter: s.HealthCheck.WithDefaults().Interval.Duration(),
+		retry:      retry,
+		budget:     newRetryBudget(retry.Budget),
+		limits:     limits,
+		transport:  newProtocolTransport(limits, s.Protocol, tlsConfig),
+	}
+
+	rewriter, err := newPathRewriter(s)
+	if err != nil {
+		return nil, err
+	}
+	p.rewriter = rewriter
+
+	pipeline, err := transform.New(s.Transform)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transform: %w", err)
+	}
+	p.pipeline = pipeline
+
+	for i, u := range upstreams {
+		targetURL, err := url.Parse(u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", u.URL, err)
+		}
+		p.hosts = append(p.hosts, targetURL.Host)
+
+		weight := u.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		p.targets[i] = &target{
+			raw:     u.URL,
+			url:     targetURL,
+			weight:  weight,
+			breaker: newCircuitBreaker(breaker, p.breakerChanged(u.URL)),
+		}
+		breakerStateGauge.WithLabelValues(s.Name, u.URL).Set(float64(breakerClosed))
+	}
+
+	p.balancer = newBalancer(s.LoadBalancing, p.targets)
+
+	if s.TLS != nil && s.TLS.InsecureSkipVerify {
+		log.Warn().Str("service", s.Name).Msg("tls verification of the targets is disabled")
+	}
+
+	return p, nil
+}
+
+// pick returns the target r is sent to among the healthy targets whose
+// circuit breaker lets it through. Targets already tried by r are avoided
+// when there is another choice.
+func (p *upstreamPool) pick(r *http.Request, tried map[*target]bool) (*target, breakerTicket, error) {
+	now := time.Now()
+
+	healthy := make([]*target, 0, len(p.targets))
+	for _, t := range p.targets {
+		if p.health == nil || p.health.Healthy(p.serviceID, t.raw) {
+			healthy = append(healthy, t)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil, breakerTicket{}, &UnavailableError{Err: ErrNoHealthyTarget, RetryAfter: p.retryAfter}
+	}
+
+	var available, untried []*target
+	for _, t := range healthy {
+		if !t.breaker.ready(now) {
+			continue
+		}
+		available = append(available, t)
+		if !tried[t] {
+			untried = append(untried, t)
+		}
+	}
+	if len(untried) > 0 {
+		available = untried
+	}
+
+	for len(available) > 0 {
+		t := p.balancer.pick(r, available)
+		if ticket, ok := t.breaker.acquire(now); ok {
+			return t, ticket, nil
+		}
+
+		// The last probe slot of a half-open breaker was taken meanwhile.
+		for i, a := range available {
+			if a == t {
+				available = append(available[:i:i], available[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil, breakerTicket{}, &UnavailableError{Err: ErrCircuitOpen, RetryAfter: p.openFor(healthy, now)}
+}
+
+// openFor returns how long until the first breaker among targets half-opens.
+func (p *upstreamPool) openFor(targets []*target, now time.Time) time.Duration {
+	var d time.Duration
+	for _, t := range targets {
+		if o := t.breaker.openFor(now); d == 0 || (o > 0 && o < d) {
+			d = o
+		}
+	}
+	return d
+}
+
+func (p *upstreamPool) breakerChanged(targetURL string) func(breakerState) {
+	return func(s breakerState) {
+		breakerStateGauge.WithLabelValues(p.service, targetURL).Set(float64(s))
+		breakerTransitions.WithLabelValues(p.service, targetURL, s.String()).Inc()
+
+		log.Warn().
+			Str("service", p.service).
+			Str("target", targetURL).
+			Str("state", s.String()).
+			Msg("circuit breaker")
+	}
+}
+
+// release removes the metrics and the idle connections of a pool replaced
+// by a new configuration.
+func (p *upstreamPool) release() {
+	for _, t := range p.targets {
+		breakerStateGauge.DeleteLabelValues(p.service, t.raw)
+	}
+	p.transport.CloseIdleConnections()
+}
+
+// upstreams caches a pool per service, a pool is rebuilt when the proxy
+// settings of its service change.
+type upstreams struct {
+	mu     sync.RWMutex
+	pools  map[poolID]*upstreamPool
+	health HealthState
+	tls    *upstreamtls.Cache
+}
+
+// poolID identifies the pool of a service, or of one of its versions.
+type poolID struct {
+	service uuid.UUID
+	version string
+}
+
+func newUpstreams(health HealthState) *upstreams {
+	return &upstreams{pools: make(map[poolID]*upstreamPool), health: health, tls: upstreamtls.NewCache()}
+}
+
+// get returns the pool of s, version names the backend version s is routed
+// to, if any.
+func (u *upstreams) get(s models.Service, version string) (*upstreamPool, error) {
+	key, err := poolKey(s)
+	if err != nil {
+		return nil, err
+	}
+	id := poolID{service: s.ID, version: version}
+
+	u.mu.RLock()
+	p, ok := u.pools[id]
+	u.mu.RUnlock()
+	if ok && p.key == key {
+		return p, nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if p, ok := u.pools[id]; ok && p.key == key {
+		return p, nil
+	}
+
+	tlsConfig, err := u.tls.Get(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls config: %w", err)
+	}
+
+	if old, ok := u.pools[id]; ok {
+		old.release()
+	}
+
+	p, err = newUpstreamPool(s, key, u.health, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	u.pools[id] = p
+
+	return p, nil
+}
+
+// prune releases the pools of the services and versions missing from
+// services.
+func (u *upstreams) prune(services []*models.Service) {
+	live := make(map[poolID]struct{}, len(services))
+	for _, s := range services {
+		live[poolID{service: s.ID}] = struct{}{}
+		if s.Canary != nil {
+			for _, v := range s.Canary.Versions {
+				live[poolID{service: s.ID, version: v.Name}] = struct{}{}
+			}
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for id, p := range u.pools {
+		if _, ok := live[id]; !ok {
+			p.release()
+			delete(u.pools, id)
+		}
+	}
+}
+
+func poolKey(s models.Service) (string, error) {
+	b, err := json.Marshal(struct {
+		Targets        []models.Target
+		LoadBalancing  string
+		HealthCheck    *models.HealthCheck
+		RetryPolicy    *models.RetryPolicy
+		CircuitBreaker *models.CircuitBreaker
+		Limits         *models.ServiceLimits
+		Protocol       string
+		TLS            string
+		Prefix         string
+		Rewrite        *models.Rewrite
+		Transform      *models.Transform
+	}{s.Upstreams(), s.LoadBalancing, s.HealthCheck, s.RetryPolicy, s.CircuitBreaker, s.Limits, s.Protocol, upstreamtls.Fingerprint(s), s.Prefix, s.Rewrite, s.Transform})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal pool key: %w", err)
+	}
+	return string(b), nil
+}
+
+// upstreamTransport sends each request to a target of the pool, retries it
+// according to the retry policy of the service and reports the outcome to
+// the circuit breaker of the target.
+type upstreamTransport struct {
+	pool *upstreamPool
+	base http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.pool.budget.deposit()
+
+	attempts := 1
+	var body []byte
+	if t.pool.retry.MaxAttempts > 1 && idempotent(req) {
+		var ok bool
+		body, ok = replayableBody(req)
+		if ok {
+			attempts = t.pool.retry.MaxAttempts
+		}
+	}
+
+	tried := make(map[*target]bool, attempts)
+	for attempt := 1; ; attempt++ {
+		resp, err := t.send(req, body, tried)
+
+		var unavailable *UnavailableError
+		retry := attempt < attempts && !errors.As(err, &unavailable) && req.Context().Err() == nil &&
+			(err != nil || retryableStatus(resp.StatusCode))
+		if !retry || !t.pool.budget.withdraw() {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) //nolint
+			resp.Body.Close()
+		}
+
+		retriesCounter.WithLabelValues(t.pool.service).Inc()
+		log.Ctx(req.Context()).Debug().
+			Str("service", t.pool.service).
+			Int("attempt", attempt+1).
+			Msg("retrying upstream request")
+
+		timer := time.NewTimer(backoff(t.pool.retry, attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (t upstreamTransport) send(req *http.Request, body []byte, tried map[*target]bool) (*http.Response, error) {
+	target, ticket, err := t.pool.pick(req, tried)
+	if err != nil {
+		return nil, err
+	}
+	tried[target] = true
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = target.url.Scheme
+	out.URL.Host = target.url.Host
+	out.Host = target.url.Host
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	log.Ctx(req.Context()).Debug().
+		Any("path", out.URL.Path).
+		Any("host", out.Host).
+		Msg("proxying to")
+
+	target.active.Add(1)
+
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		target.active.Add(-1)
+		if errors.Is(context.Cause(req.Context()), context.Canceled) {
+			// The client hung up, the target is not to blame.
+			target.breaker.release(ticket)
+		} else {
+			target.breaker.record(ticket, false, time.Now())
+		}
+		return nil, err
+	}
+
+	target.breaker.record(ticket, !retryableStatus(resp.StatusCode), time.Now())
+
+	resp.Body = trackBody(resp.Body, func() { target.active.Add(-1) })
+
+	return resp, nil
+}
+
+// replayableBody buffers the body of req so it can be sent again, it reports
+// false when the body is too large or its size unknown.
+func replayableBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength < 0 || req.ContentLength > retryBodyLimit {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, retryBodyLimit))
+	req.Body.Close()
+	if err != nil {
+		return nil, false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, true
+}
+
+// trackBody calls done once the body is closed. Upgraded connections keep
+// their io.Writer so the reverse proxy can still hijack them.
+func trackBody(body io.ReadCloser, done func()) io.ReadCloser {
+	tb := trackedBody{ReadCloser: body, once: &sync.Once{}, done: done}
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return trackedReadWriteBody{trackedBody: tb, w: rwc}
+	}
+	return tb
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	once *sync.Once
+	done func()
+}
+
+func (b trackedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+type trackedReadWriteBody struct {
+	trackedBody
+	w io.Writer
+}
+
+func (b trackedReadWriteBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
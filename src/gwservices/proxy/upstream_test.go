@@ -0,0 +1,247 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type upstream struct {
+	*httptest.Server
+	hits   atomic.Int64
+	status atomic.Int64
+}
+
+func newUpstream(t *testing.T) *upstream {
+	u := &upstream{}
+	u.status.Store(http.StatusOK)
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		w.WriteHeader(int(u.status.Load()))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func send(t *testing.T, rt http.RoundTripper, ctx context.Context) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body) //nolint
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUpstreamRoundRobinWeights(t *testing.T) {
+	a, b := newUpstream(t), newUpstream(t)
+
+	rt, err := proxy.NewUpstreamTransport(models.Service{
+		LoadBalancing: models.LoadBalancingRoundRobin,
+		Targets:       []models.Target{{URL: a.URL, Weight: 1}, {URL: b.URL, Weight: 3}},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 8; i++ {
+		send(t, rt, context.Background())
+	}
+
+	require.Equal(t, int64(2), a.hits.Load())
+	require.Equal(t, int64(6), b.hits.Load())
+}
+
+func TestUpstreamConsistentHash(t *testing.T) {
+	a, b, c := newUpstream(t), newUpstream(t), newUpstream(t)
+
+	rt, err := proxy.NewUpstreamTransport(models.Service{
+		LoadBalancing: models.LoadBalancingConsistentHash,
+		Targets:       []models.Target{{URL: a.URL}, {URL: b.URL}, {URL: c.URL}},
+	})
+	require.NoError(t, err)
+
+	ctx := context.WithValue(context.Background(), ablibhttp.UserIDCtxKey, uuid.New())
+	for i := 0; i < 10; i++ {
+		send(t, rt, ctx)
+	}
+
+	hits := []int64{a.hits.Load(), b.hits.Load(), c.hits.Load()}
+	require.Contains(t, hits, int64(10))
+}
+
+func TestUpstreamPassiveEjection(t *testing.T) {
+	healthy, failing := newUpstream(t), newUpstream(t)
+	failing.status.Store(http.StatusBadGateway)
+
+	rt, err := proxy.NewUpstreamTransport(models.Service{
+		LoadBalancing: models.LoadBalancingLeastConnections,
+		Targets:       []models.Target{{URL: healthy.URL}, {URL: failing.URL}},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		send(t, rt, context.Background())
+	}
+
+	require.Equal(t, int64(3), failing.hits.Load())
+	require.Equal(t, int64(17), healthy.hits.Load())
+}
+
+type unhealthy struct{}
+
+func (unhealthy) Healthy(uuid.UUID, string) bool { return false }
+
+func TestUpstreamNoHealthyTarget(t *testing.T) {
+	a := newUpstream(t)
+
+	rt, err := proxy.NewUpstreamTransportWithHealth(models.Service{
+		Targets: []models.Target{{URL: a.URL, Weight: 1}},
+	}, unhealthy{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = rt.RoundTrip(req)
+	require.ErrorIs(t, err, proxy.ErrNoHealthyTarget)
+	require.Zero(t, a.hits.Load())
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	healthy, failing := newUpstream(t), newUpstream(t)
+	failing.status.Store(http.StatusServiceUnavailable)
+
+	rt, err := proxy.NewUpstreamTransport(models.Service{
+		Name:          "retry",
+		LoadBalancing: models.LoadBalancingRoundRobin,
+		Targets:       []models.Target{{URL: failing.URL}, {URL: healthy.URL}},
+		RetryPolicy: &models.RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     models.Duration(time.Millisecond),
+			MaxBackoff:  models.Duration(time.Millisecond),
+		},
+		CircuitBreaker: &models.CircuitBreaker{FailureThreshold: 100},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		require.Equal(t, http.StatusOK, send(t, rt, context.Background()))
+	}
+	require.Equal(t, int64(2), failing.hits.Load())
+
+	statuses := map[int]int{}
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		statuses[resp.StatusCode]++
+	}
+	require.Equal(t, map[int]int{http.StatusOK: 2, http.StatusServiceUnavailable: 2}, statuses)
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	u := newUpstream(t)
+	u.status.Store(http.StatusBadGateway)
+
+	rt, err := proxy.NewUpstreamTransport(models.Service{
+		Name:    "breaker",
+		Targets: []models.Target{{URL: u.URL}},
+		CircuitBreaker: &models.CircuitBreaker{
+			FailureThreshold: 2,
+			OpenDuration:     models.Duration(50 * time.Millisecond),
+		},
+	})
+	require.NoError(t, err)
+
+	send(t, rt, context.Background())
+	send(t, rt, context.Background())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = rt.RoundTrip(req)
+	require.ErrorIs(t, err, proxy.ErrCircuitOpen)
+	require.Equal(t, int64(2), u.hits.Load())
+
+	time.Sleep(60 * time.Millisecond)
+	u.status.Store(http.StatusOK)
+
+	require.Equal(t, http.StatusOK, send(t, rt, context.Background()))
+	require.Equal(t, http.StatusOK, send(t, rt, context.Background()))
+	require.Equal(t, int64(4), u.hits.Load())
+}
+
+func TestUpstreamCircuitBreakerClientCanceled(t *testing.T) {
+	var hits atomic.Int64
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+	}))
+	defer u.Close()
+
+	rt, err := proxy.NewUpstreamTransport(models.Service{
+		Name:           "canceled",
+		Targets:        []models.Target{{URL: u.URL}},
+		RetryPolicy:    &models.RetryPolicy{MaxAttempts: 1},
+		CircuitBreaker: &models.CircuitBreaker{FailureThreshold: 2},
+	})
+	require.NoError(t, err)
+
+	// Clients hanging up do not open the circuit.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+		require.ErrorIs(t, err, context.Canceled)
+	}
+	require.Equal(t, http.StatusOK, send(t, rt, context.Background()))
+
+	// Deadlines still count as failures.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+	_, err = rt.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.ErrorIs(t, err, proxy.ErrCircuitOpen)
+}
+
+func TestUpstreamPoolsPruned(t *testing.T) {
+	a, b := newUpstream(t), newUpstream(t)
+
+	api := &models.Service{ID: uuid.New(), Name: "api", Prefix: "/api", Host: a.URL, Canary: &models.Canary{
+		Versions: []models.Version{{Name: "stable", Weight: 9, Host: a.URL}, {Name: "beta", Weight: 1, Host: b.URL}},
+	}}
+	web := &models.Service{ID: uuid.New(), Name: "web", Prefix: "/web", Host: b.URL}
+	services := []*models.Service{api, web}
+
+	table := proxy.NewRouteTable(func(ctx context.Context) ([]*models.Service, error) {
+		return services, nil
+	}, nil)
+	p := proxy.NewTestProxy(proxy.NewStreams(time.Second)).WithRouteTable(table)
+
+	require.NoError(t, p.UpstreamPool(*web, ""))
+	for _, v := range api.Canary.Versions {
+		require.NoError(t, p.UpstreamPool(api.ForVersion(v), v.Name))
+	}
+	require.Equal(t, 3, p.UpstreamPools())
+
+	require.NoError(t, table.Reload(context.Background()))
+	require.Equal(t, 3, p.UpstreamPools())
+
+	// Removing a version or a service releases its pool.
+	api.Canary.Versions = api.Canary.Versions[:1]
+	services = []*models.Service{api}
+	require.NoError(t, table.Reload(context.Background()))
+	require.Equal(t, 1, p.UpstreamPools())
+}
@@ -2,28 +2,64 @@ package gwservices
 
 import (
 	"github.com/amaurybrisou/ablib/jwtlib"
-	"github.com/amaurybrisou/ablib/mailcli"
+	"github.com/amaurybrisou/gateway/src/apikey"
+	"github.com/amaurybrisou/gateway/src/cache"
 	"github.com/amaurybrisou/gateway/src/database"
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/amaurybrisou/gateway/src/gwservices/account"
 	"github.com/amaurybrisou/gateway/src/gwservices/gwservice"
+	"github.com/amaurybrisou/gateway/src/gwservices/identity"
 	"github.com/amaurybrisou/gateway/src/gwservices/payment"
 	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/amaurybrisou/gateway/src/health"
+	"github.com/amaurybrisou/gateway/src/mailer"
 )
 
 type Services struct {
-	jwt     *jwtlib.JWT
-	svc     gwservice.Service
-	proxy   proxy.Proxy
-	payment payment.Service
+	jwt       *jwtlib.JWT
+	account   account.Service
+	apiKeys   *apikey.Authenticator
+	forwarded *forwarded.Proxies
+	health    *health.Checker
+	svc       gwservice.Service
+	identity  identity.Service
+	proxy     proxy.Proxy
+	payment   payment.Service
 }
 
 func (s Services) Jwt() *jwtlib.JWT {
 	return s.jwt
 }
 
+// Account returns the account activation, the password recovery and the
+// email verification.
+func (s Services) Account() account.Service {
+	return s.account
+}
+
+// APIKeys returns the authenticator of the API keys.
+func (s Services) APIKeys() *apikey.Authenticator {
+	return s.apiKeys
+}
+
+// Forwarded returns the trusted proxies in front of the gateway.
+func (s Services) Forwarded() *forwarded.Proxies {
+	return s.forwarded
+}
+
+func (s Services) Health() *health.Checker {
+	return s.health
+}
+
 func (s Services) Service() gwservice.Service {
 	return s.svc
 }
 
+// Identity returns the logins with the identity providers.
+func (s Services) Identity() identity.Service {
+	return s.identity
+}
+
 func (s Services) Proxy() proxy.Proxy {
 	return s.proxy
 }
@@ -36,15 +72,36 @@ type ServiceConfig struct {
 	PaymentConfig payment.Config
 	JwtConfig     jwtlib.Config
 	ProxyConfig   proxy.Config
+	HealthConfig  health.Config
+	// IdentityConfig configures the identity providers and the session
+	// cookie.
+	IdentityConfig identity.Config
+	// AccountConfig configures the activation, password reset and email
+	// verification links.
+	AccountConfig account.Config
+	// Mail sends the activation, password reset and email verification
+	// links.
+	Mail mailer.Sender
+	// TrustedProxies are the proxies whose forwarding headers are trusted.
+	TrustedProxies *forwarded.Proxies
 }
 
-func NewServices(db *database.Database, mail *mailcli.MailClient, cfg ServiceConfig) Services {
+func NewServices(db *database.Database, store cache.Store, cfg ServiceConfig) Services {
 	jwt := jwtlib.New(cfg.JwtConfig)
+	acc := account.New(db, cfg.Mail, cfg.AccountConfig)
+	checker := health.New(db, cfg.HealthConfig)
+	c := cache.New(store)
+	p := proxy.New(db, checker, c, cfg.ProxyConfig)
 
 	return Services{
-		jwt:     jwt,
-		svc:     gwservice.New(db, jwt),
-		proxy:   proxy.New(db, cfg.ProxyConfig),
-		payment: payment.NewService(db, jwt, mail, cfg.PaymentConfig),
+		jwt:       jwt,
+		account:   acc,
+		apiKeys:   apikey.New(db),
+		forwarded: cfg.TrustedProxies,
+		health:    checker,
+		svc:       gwservice.New(db, jwt, p.Routes(), c, p.IPRules()),
+		identity:  identity.New(db, cfg.IdentityConfig),
+		proxy:     p,
+		payment:   payment.NewService(db, jwt, acc, cfg.PaymentConfig),
 	}
 }
@@ -0,0 +1,173 @@
+// Package health actively checks the targets of the services and keeps
+// track of the ones that can receive traffic.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/ablib"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/upstreamtls"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Store loads the services and records the outcome of the checks.
+type Store interface {
+	GetServices(ctx context.Context) ([]*models.Service, error)
+	UpdateServiceTargetStatus(ctx context.Context, serviceID uuid.UUID, targetURL, status string) error
+	AddServiceHealthEvent(ctx context.Context, e models.ServiceHealthEvent) error
+}
+
+type Config struct {
+	// SyncInterval is how often the list of services to check is refreshed.
+	SyncInterval time.Duration
+}
+
+type targetKey struct {
+	serviceID uuid.UUID
+	url       string
+}
+
+// Checker runs a prober per service target. Targets are considered healthy
+// until their first checks fail.
+type Checker struct {
+	store        Store
+	syncInterval time.Duration
+	done         chan struct{}
+	stopOnce     sync.Once
+
+	mu      sync.Mutex
+	probers map[targetKey]*prober
+	tls     *upstreamtls.Cache
+
+	// states is read by the proxy on every request.
+	states sync.Map
+}
+
+func New(store Store, cfg Config) *Checker {
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = 10 * time.Second
+	}
+
+	return &Checker{
+		store:        store,
+		syncInterval: cfg.SyncInterval,
+		done:         make(chan struct{}),
+		probers:      make(map[targetKey]*prober),
+		tls:          upstreamtls.NewCache(),
+	}
+}
+
+// Healthy reports whether the target of the service passes its checks.
+func (c *Checker) Healthy(serviceID uuid.UUID, targetURL string) bool {
+	v, ok := c.states.Load(targetKey{serviceID: serviceID, url: targetURL})
+	if !ok {
+		return true
+	}
+	return v.(*targetState).healthy.Load()
+}
+
+func (c *Checker) New(core *ablib.Core) {
+	core.AddStartFunc(c.Start)
+	core.AddStopFunc(c.Stop)
+}
+
+func (c *Checker) Start(ctx context.Context) (<-chan struct{}, <-chan error) {
+	log.Ctx(ctx).Info().Msg("start health checker")
+
+	errChan := make(chan error)
+	startedChan := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer close(errChan)
+		defer close(startedChan)
+		defer cancel()
+
+		t := time.NewTicker(c.syncInterval)
+		defer t.Stop()
+
+		c.sync(ctx)
+		startedChan <- struct{}{}
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Ctx(ctx).Info().Msg("stop health checker")
+				return
+			case <-c.done:
+				log.Ctx(ctx).Info().Msg("stop health checker")
+				return
+			case <-t.C:
+				c.sync(ctx)
+			}
+		}
+	}()
+
+	return startedChan, errChan
+}
+
+func (c *Checker) Stop(ctx context.Context) error {
+	c.stopOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// sync starts a prober for every new target, restarts the ones whose
+// configuration changed and stops the ones that were removed.
+func (c *Checker) sync(ctx context.Context) {
+	services, err := c.store.GetServices(ctx)
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("fetch services to check")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[targetKey]bool)
+	for _, s := range services {
+		cfg := s.HealthCheck.WithDefaults()
+		fingerprint := configFingerprint(cfg) + s.Protocol + upstreamtls.Fingerprint(*s)
+
+		tlsConfig, err := c.tls.Get(*s)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("service", s.Name).Msg("load service tls config")
+		}
+
+		for _, t := range s.AllUpstreams() {
+			key := targetKey{serviceID: s.ID, url: t.URL}
+			seen[key] = true
+
+			if p, ok := c.probers[key]; ok {
+				if p.fingerprint == fingerprint {
+					continue
+				}
+				p.stop()
+			}
+
+			v, _ := c.states.LoadOrStore(key, newTargetState())
+			p := newProber(s, t.URL, cfg, fingerprint, v.(*targetState), c.store, tlsConfig)
+			c.probers[key] = p
+			go p.run(ctx)
+		}
+	}
+
+	for key, p := range c.probers {
+		if seen[key] {
+			continue
+		}
+		p.stop()
+		delete(c.probers, key)
+		c.states.Delete(key)
+	}
+}
+
+func configFingerprint(cfg models.HealthCheck) string {
+	b, _ := json.Marshal(cfg) //nolint
+	return string(b)
+}
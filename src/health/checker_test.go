@@ -0,0 +1,112 @@
+package health_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/health"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type store struct {
+	services []*models.Service
+
+	mu     sync.Mutex
+	status map[string]string
+	events []models.ServiceHealthEvent
+}
+
+func (s *store) GetServices(context.Context) ([]*models.Service, error) {
+	return s.services, nil
+}
+
+func (s *store) UpdateServiceTargetStatus(_ context.Context, _ uuid.UUID, targetURL, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[targetURL] = status
+	return nil
+}
+
+func (s *store) AddServiceHealthEvent(_ context.Context, e models.ServiceHealthEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *store) statuses() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]string, len(s.events))
+	for i, e := range s.events {
+		statuses[i] = e.Status
+	}
+	return statuses
+}
+
+func TestCheckerThresholds(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/ready", r.URL.Path)
+		hits.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+
+	service := &models.Service{
+		ID:   uuid.New(),
+		Name: "hello",
+		Host: upstream.URL,
+		HealthCheck: &models.HealthCheck{
+			Path:               "/ready",
+			Interval:           models.Duration(10 * time.Millisecond),
+			Timeout:            models.Duration(time.Second),
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+	}
+	s := &store{services: []*models.Service{service}, status: map[string]string{}}
+
+	c := health.New(s, health.Config{SyncInterval: time.Hour})
+	started, _ := c.Start(context.Background())
+	<-started
+	defer c.Stop(context.Background()) //nolint
+
+	require.Eventually(t, func() bool { return hits.Load() > 0 }, time.Second, 5*time.Millisecond)
+	require.True(t, c.Healthy(service.ID, upstream.URL))
+
+	status.Store(http.StatusInternalServerError)
+	require.Eventually(t, func() bool { return !c.Healthy(service.ID, upstream.URL) }, time.Second, 5*time.Millisecond)
+
+	status.Store(http.StatusOK)
+	require.Eventually(t, func() bool { return c.Healthy(service.ID, upstream.URL) }, time.Second, 5*time.Millisecond)
+
+	require.Equal(t, []string{models.HealthStatusUnhealthy, models.HealthStatusHealthy}, s.statuses())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Equal(t, models.ServiceStatusOK, s.status[upstream.URL])
+}
+
+func TestCheckerUnknownTargetIsHealthy(t *testing.T) {
+	c := health.New(&store{status: map[string]string{}}, health.Config{})
+	require.True(t, c.Healthy(uuid.New(), "http://unknown"))
+}
+
+func TestCheckerStopTwice(t *testing.T) {
+	c := health.New(&store{status: map[string]string{}}, health.Config{})
+	ctx := context.Background()
+
+	require.NoError(t, c.Stop(ctx))
+	require.NotPanics(t, func() { c.Stop(ctx) }) //nolint
+}
@@ -0,0 +1,211 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+)
+
+// targetState is written by the prober of the target and read by the proxy.
+type targetState struct {
+	healthy atomic.Bool
+
+	// mu guards the counters, a prober being replaced may still be running
+	// its last check.
+	mu                  sync.Mutex
+	successes, failures int
+	checked             bool
+}
+
+func newTargetState() *targetState {
+	s := &targetState{}
+	s.healthy.Store(true)
+	return s
+}
+
+// record counts the outcome of a check and reports whether the target
+// crossed a threshold and changed status, and whether it was its first check.
+func (s *targetState) record(ok bool, cfg models.HealthCheck) (changed, first bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first = !s.checked
+	s.checked = true
+
+	return s.count(ok, cfg), first
+}
+
+func (s *targetState) count(ok bool, cfg models.HealthCheck) bool {
+	if ok {
+		s.successes++
+		s.failures = 0
+		if !s.healthy.Load() && s.successes >= cfg.HealthyThreshold {
+			s.healthy.Store(true)
+			return true
+		}
+		return false
+	}
+
+	s.failures++
+	s.successes = 0
+	if s.healthy.Load() && s.failures >= cfg.UnhealthyThreshold {
+		s.healthy.Store(false)
+		return true
+	}
+	return false
+}
+
+type prober struct {
+	serviceID   uuid.UUID
+	service     string
+	target      string
+	url         string
+	cfg         models.HealthCheck
+	fingerprint string
+
+	state  *targetState
+	store  Store
+	client *http.Client
+	done   chan struct{}
+}
+
+func newProber(s *models.Service, targetURL string, cfg models.HealthCheck, fingerprint string, state *targetState, store Store, tlsConfig *tls.Config) *prober {
+	return &prober{
+		serviceID:   s.ID,
+		service:     s.Name,
+		target:      targetURL,
+		url:         strings.TrimSuffix(targetURL, "/") + cfg.Path,
+		cfg:         cfg,
+		fingerprint: fingerprint,
+		state:       state,
+		store:       store,
+		client:      &http.Client{Timeout: cfg.Timeout.Duration(), Transport: probeTransport(s.Protocol, targetURL, tlsConfig)},
+		done:        make(chan struct{}),
+	}
+}
+
+// probeTransport returns the transport checking a target, services speaking
+// HTTP/2 in cleartext may not answer HTTP/1.1 at all.
+func probeTransport(protocol, targetURL string, tlsConfig *tls.Config) http.RoundTripper {
+	cleartext := strings.HasPrefix(targetURL, "http://")
+
+	switch {
+	case cleartext && (protocol == models.ProtocolH2C || protocol == models.ProtocolGRPC):
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+	case !cleartext && (protocol == models.ProtocolH2 || protocol == models.ProtocolGRPC):
+		return &http2.Transport{TLSClientConfig: tlsConfig.Clone()}
+	case tlsConfig != nil:
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig.Clone()
+		return t
+	default:
+		return nil
+	}
+}
+
+func (p *prober) stop() {
+	close(p.done)
+}
+
+func (p *prober) run(ctx context.Context) {
+	t := time.NewTicker(p.cfg.Interval.Duration())
+	defer t.Stop()
+
+	p.check(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.done:
+			return
+		case <-t.C:
+			p.check(ctx)
+		}
+	}
+}
+
+func (p *prober) check(ctx context.Context) {
+	ok, detail := p.probe(ctx)
+
+	changed, first := p.state.record(ok, p.cfg)
+	if !changed && !first {
+		return
+	}
+
+	status := models.HealthStatusHealthy
+	if !p.state.healthy.Load() {
+		status = models.HealthStatusUnhealthy
+	}
+
+	log.Ctx(ctx).Info().
+		Str("service", p.service).
+		Str("target", p.target).
+		Str("status", status).
+		Str("detail", detail).
+		Msg("target health")
+
+	targetStatus := detail
+	if status == models.HealthStatusHealthy {
+		targetStatus = models.ServiceStatusOK
+	}
+
+	if err := p.store.UpdateServiceTargetStatus(ctx, p.serviceID, p.target, targetStatus); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("update target status")
+	}
+
+	if !changed {
+		return
+	}
+
+	err := p.store.AddServiceHealthEvent(ctx, models.ServiceHealthEvent{
+		ServiceID: p.serviceID,
+		TargetURL: p.target,
+		Status:    status,
+		Detail:    detail,
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("record health event")
+	}
+}
+
+// probe returns whether the target answered with an expected status and a
+// description of the outcome.
+func (p *prober) probe(ctx context.Context) (bool, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096)) //nolint
+
+	for _, expected := range p.cfg.ExpectedStatuses {
+		if resp.StatusCode == expected {
+			return true, resp.Status
+		}
+	}
+
+	return false, fmt.Sprintf("unexpected status %s", resp.Status)
+}
@@ -0,0 +1,155 @@
+package iprules
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amaurybrisou/ablib"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Loader returns the rules of the global deny list.
+type Loader func(ctx context.Context) ([]models.IPRule, error)
+
+// ChangeListener blocks until ctx is done, calling onChange every time the
+// global deny list is modified, possibly by another gateway replica.
+type ChangeListener func(ctx context.Context, onChange func(ctx context.Context)) error
+
+// DenyList keeps the global deny list in memory. Lookups read an immutable
+// set without locking, reloads build a new set and swap it atomically.
+type DenyList struct {
+	set      atomic.Pointer[Set]
+	reloadMu sync.Mutex
+
+	load   Loader
+	listen ChangeListener
+
+	retryInterval time.Duration
+	done          chan struct{}
+	stopOnce      sync.Once
+}
+
+func NewDenyList(load Loader, listen ChangeListener) *DenyList {
+	return &DenyList{
+		load:          load,
+		listen:        listen,
+		retryInterval: 5 * time.Second,
+		done:          make(chan struct{}),
+	}
+}
+
+// Reload fetches the rules and replaces the current set. Rules that cannot
+// be parsed are skipped and logged, the others still apply.
+func (l *DenyList) Reload(ctx context.Context) error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+
+	rules, err := l.load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load ip rules: %w", err)
+	}
+
+	set := &Set{}
+	for _, rule := range rules {
+		p, err := ParseRule(rule.CIDR)
+		if err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("rule_id", rule.ID.String()).Msg("skip ip rule")
+			continue
+		}
+		set.prefixes = append(set.prefixes, p)
+	}
+	l.set.Store(set)
+
+	log.Ctx(ctx).Debug().Int("rules", set.Len()).Msg("ip deny list reloaded")
+
+	return nil
+}
+
+// Set returns the current deny list, nil until it is loaded.
+func (l *DenyList) Set() *Set {
+	if l == nil {
+		return nil
+	}
+	return l.set.Load()
+}
+
+func (l *DenyList) New(c *ablib.Core) {
+	c.AddStartFunc(l.Start)
+	c.AddStopFunc(l.Stop)
+}
+
+// Start loads the deny list and keeps it in sync with the database
+// notifications until the core stops.
+func (l *DenyList) Start(ctx context.Context) (<-chan struct{}, <-chan error) {
+	log.Ctx(ctx).Info().Msg("start ip deny list")
+
+	errChan := make(chan error)
+	startedChan := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		defer close(errChan)
+		defer close(startedChan)
+		defer cancel()
+
+		if err := l.Reload(ctx); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("initial ip deny list load")
+		}
+
+		startedChan <- struct{}{}
+
+		go func() {
+			select {
+			case <-l.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		l.listenLoop(ctx)
+		log.Ctx(ctx).Info().Msg("stop ip deny list")
+	}()
+
+	return startedChan, errChan
+}
+
+func (l *DenyList) listenLoop(ctx context.Context) {
+	if l.listen == nil {
+		<-ctx.Done()
+		return
+	}
+
+	onChange := func(ctx context.Context) {
+		if err := l.Reload(ctx); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("ip deny list reload")
+		}
+	}
+
+	for {
+		err := l.listen(ctx, onChange)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Ctx(ctx).Error().Err(err).Msg("ip rule change listener stopped, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.retryInterval):
+		}
+
+		// Changes may have been missed while the listener was down.
+		onChange(ctx)
+	}
+}
+
+func (l *DenyList) Stop(ctx context.Context) error {
+	l.stopOnce.Do(func() { close(l.done) })
+	return nil
+}
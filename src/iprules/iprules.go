@@ -0,0 +1,118 @@
+// Package iprules restricts the clients of the services by address: each
+// service allows and denies its own CIDRs, and a global deny list managed by
+// the admins applies to every service.
+package iprules
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// Set is a list of CIDRs, a nil set matches nothing.
+type Set struct {
+	prefixes []netip.Prefix
+}
+
+// Parse parses CIDRs and IP addresses, an address matching only itself.
+func Parse(rules []string) (*Set, error) {
+	s := &Set{prefixes: make([]netip.Prefix, 0, len(rules))}
+	for _, rule := range rules {
+		p, err := ParseRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		s.prefixes = append(s.prefixes, p)
+	}
+	return s, nil
+}
+
+// ParseRule parses a CIDR or an IP address.
+func ParseRule(rule string) (netip.Prefix, error) {
+	rule = strings.TrimSpace(rule)
+	if !strings.Contains(rule, "/") {
+		addr, err := netip.ParseAddr(rule)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid ip rule %q", rule)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(rule)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid ip rule %q: %w", rule, err)
+	}
+	return p.Masked(), nil
+}
+
+// Match returns the first CIDR of s containing addr.
+func (s *Set) Match(addr netip.Addr) (netip.Prefix, bool) {
+	if s == nil || !addr.IsValid() {
+		return netip.Prefix{}, false
+	}
+	for _, p := range s.prefixes {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Len returns the number of CIDRs of s.
+func (s *Set) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.prefixes)
+}
+
+// Decision tells whether a client is allowed and the rule deciding it.
+type Decision struct {
+	Allowed bool
+	// Rule is the rule blocking the client: "global deny <cidr>",
+	// "deny <cidr>" or "not allowed".
+	Rule string
+}
+
+// Evaluate checks the client address clientIP against the global deny list
+// and the rules of a service, in that order. The deny lists take precedence
+// over the allow list. Clients whose address cannot be parsed only reach
+// the services without an allow list.
+func Evaluate(global *Set, rules *models.IPRules, clientIP string) (Decision, error) {
+	addr, err := netip.ParseAddr(clientIP)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+
+	if p, ok := global.Match(addr); ok {
+		return Decision{Rule: "global deny " + p.String()}, nil
+	}
+
+	if rules == nil {
+		return Decision{Allowed: true}, nil
+	}
+
+	deny, err := Parse(rules.Deny)
+	if err != nil {
+		return Decision{}, err
+	}
+	if p, ok := deny.Match(addr); ok {
+		return Decision{Rule: "deny " + p.String()}, nil
+	}
+
+	if len(rules.Allow) == 0 {
+		return Decision{Allowed: true}, nil
+	}
+
+	allow, err := Parse(rules.Allow)
+	if err != nil {
+		return Decision{}, err
+	}
+	if _, ok := allow.Match(addr); ok {
+		return Decision{Allowed: true}, nil
+	}
+	return Decision{Rule: "not allowed"}, nil
+}
@@ -0,0 +1,113 @@
+package iprules_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/iprules"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.0/8":       "10.0.0.0/8",
+		"10.1.2.3/8":       "10.0.0.0/8",
+		" 192.0.2.7 ":      "192.0.2.7/32",
+		"::ffff:192.0.2.7": "192.0.2.7/32",
+		"2001:db8::/32":    "2001:db8::/32",
+		"2001:db8::1":      "2001:db8::1/128",
+	}
+	for in, want := range tests {
+		p, err := iprules.ParseRule(in)
+		require.NoError(t, err, in)
+		require.Equal(t, want, p.String(), in)
+	}
+
+	for _, in := range []string{"", "office", "10.0.0.0/33", "10.0.0/8"} {
+		_, err := iprules.ParseRule(in)
+		require.Error(t, err, in)
+	}
+
+	_, err := iprules.Parse([]string{"10.0.0.0/8", "nope"})
+	require.Error(t, err)
+}
+
+func TestEvaluate(t *testing.T) {
+	global, err := iprules.Parse([]string{"198.51.100.0/24"})
+	require.NoError(t, err)
+
+	office := &models.IPRules{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.66"},
+	}
+
+	tests := []struct {
+		name     string
+		rules    *models.IPRules
+		clientIP string
+		decision iprules.Decision
+	}{
+		{name: "no rules", clientIP: "203.0.113.7", decision: iprules.Decision{Allowed: true}},
+		{name: "global deny", clientIP: "198.51.100.3", decision: iprules.Decision{Rule: "global deny 198.51.100.0/24"}},
+		{name: "global deny before allow", rules: &models.IPRules{Allow: []string{"198.51.100.3"}}, clientIP: "198.51.100.3", decision: iprules.Decision{Rule: "global deny 198.51.100.0/24"}},
+		{name: "allowed", rules: office, clientIP: "192.0.2.10", decision: iprules.Decision{Allowed: true}},
+		{name: "allowed ipv6", rules: office, clientIP: "2001:db8::17", decision: iprules.Decision{Allowed: true}},
+		{name: "allowed mapped", rules: office, clientIP: "::ffff:192.0.2.10", decision: iprules.Decision{Allowed: true}},
+		{name: "deny before allow", rules: office, clientIP: "192.0.2.66", decision: iprules.Decision{Rule: "deny 192.0.2.66/32"}},
+		{name: "not allowed", rules: office, clientIP: "203.0.113.7", decision: iprules.Decision{Rule: "not allowed"}},
+		{name: "deny only", rules: &models.IPRules{Deny: []string{"203.0.113.0/24"}}, clientIP: "192.0.2.10", decision: iprules.Decision{Allowed: true}},
+		{name: "invalid address", rules: office, clientIP: "pipe", decision: iprules.Decision{Rule: "not allowed"}},
+		{name: "invalid address without allow", rules: &models.IPRules{Deny: []string{"203.0.113.0/24"}}, clientIP: "", decision: iprules.Decision{Allowed: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := iprules.Evaluate(global, tt.rules, tt.clientIP)
+			require.NoError(t, err)
+			require.Equal(t, tt.decision, decision)
+		})
+	}
+
+	_, err = iprules.Evaluate(nil, &models.IPRules{Deny: []string{"nope"}}, "192.0.2.1")
+	require.Error(t, err)
+}
+
+func TestDenyList(t *testing.T) {
+	rules := []models.IPRule{{ID: uuid.New(), CIDR: "198.51.100.0/24"}}
+	var loadErr error
+	l := iprules.NewDenyList(func(ctx context.Context) ([]models.IPRule, error) {
+		return rules, loadErr
+	}, nil)
+
+	require.Nil(t, l.Set())
+	require.Nil(t, (*iprules.DenyList)(nil).Set())
+
+	require.NoError(t, l.Reload(context.Background()))
+	_, ok := l.Set().Match(netip.MustParseAddr("198.51.100.3"))
+	require.True(t, ok)
+
+	// Invalid rules are skipped.
+	rules = []models.IPRule{{ID: uuid.New(), CIDR: "nope"}, {ID: uuid.New(), CIDR: "203.0.113.7"}}
+	require.NoError(t, l.Reload(context.Background()))
+	require.Equal(t, 1, l.Set().Len())
+	_, ok = l.Set().Match(netip.MustParseAddr("198.51.100.3"))
+	require.False(t, ok)
+
+	// The previous list is kept when the rules cannot be loaded.
+	loadErr = errors.New("connection refused")
+	require.Error(t, l.Reload(context.Background()))
+	_, ok = l.Set().Match(netip.MustParseAddr("203.0.113.7"))
+	require.True(t, ok)
+}
+
+func TestDenyListStopTwice(t *testing.T) {
+	l := iprules.NewDenyList(func(ctx context.Context) ([]models.IPRule, error) { return nil, nil }, nil)
+	ctx := context.Background()
+
+	require.NoError(t, l.Stop(ctx))
+	require.NotPanics(t, func() { l.Stop(ctx) }) //nolint
+}
@@ -0,0 +1,3 @@
+package mailer
+
+var Format = format
@@ -0,0 +1,86 @@
+// Package mailer sends the emails of the gateway to its users.
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"strings"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends emails.
+type Sender interface {
+	Send(m Message) error
+}
+
+// Config configures the SMTP server the emails are sent through.
+type Config struct {
+	From     string
+	Password string
+	Server   string
+	Port     int
+}
+
+// SMTP sends emails through an SMTP server, authenticating as the sender
+// when a password is configured.
+type SMTP struct {
+	addr string
+	from mail.Address
+	auth smtp.Auth
+}
+
+func NewSMTP(cfg Config) *SMTP {
+	s := &SMTP{
+		addr: fmt.Sprintf("%s:%d", cfg.Server, cfg.Port),
+		from: mail.Address{Address: cfg.From},
+	}
+	if cfg.Password != "" {
+		s.auth = smtp.PlainAuth("", cfg.From, cfg.Password, cfg.Server)
+	}
+	return s
+}
+
+func (s *SMTP) Send(m Message) error {
+	msg, err := format(s.from, m)
+	if err != nil {
+		return err
+	}
+
+	if err := smtp.SendMail(s.addr, s.auth, s.from.Address, []string{m.To}, msg); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
+
+// format builds the message sent to the server, refusing headers that would
+// inject other headers.
+func format(from mail.Address, m Message) ([]byte, error) {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", m.To, err)
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return nil, errors.New("invalid subject: contains a line break")
+	}
+
+	var b strings.Builder
+	b.WriteString("To: " + to.String() + "\r\n")
+	b.WriteString("From: " + from.String() + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", m.Subject) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return []byte(b.String()), nil
+}
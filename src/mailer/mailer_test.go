@@ -0,0 +1,29 @@
+package mailer_test
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/mailer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	from := mail.Address{Address: "gateway@gateway.org"}
+
+	msg, err := mailer.Format(from, mailer.Message{To: "ada@example.org", Subject: "Réinitialisation", Body: "Hello,\n\nbye"})
+	require.NoError(t, err)
+	require.Equal(t, "To: <ada@example.org>\r\n"+
+		"From: <gateway@gateway.org>\r\n"+
+		"Subject: =?utf-8?q?R=C3=A9initialisation?=\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Hello,\r\n\r\nbye", string(msg))
+
+	_, err = mailer.Format(from, mailer.Message{To: "ada@example.org\r\nBcc: eve@example.org", Subject: "hi"})
+	require.Error(t, err)
+
+	_, err = mailer.Format(from, mailer.Message{To: "ada@example.org", Subject: "hi\r\nBcc: eve@example.org"})
+	require.Error(t, err)
+}
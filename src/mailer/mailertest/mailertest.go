@@ -0,0 +1,46 @@
+// Package mailertest records the emails sent by the gateway in tests.
+package mailertest
+
+import (
+	"sync"
+
+	"github.com/amaurybrisou/gateway/src/mailer"
+)
+
+// Sender records the messages instead of sending them.
+type Sender struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+	// Err is returned by Send when set, the message is not recorded.
+	Err error
+}
+
+func (s *Sender) Send(m mailer.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return s.Err
+	}
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+// Messages returns the messages sent so far.
+func (s *Sender) Messages() []mailer.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]mailer.Message(nil), s.messages...)
+}
+
+// Last returns the last message sent, false when none was.
+func (s *Sender) Last() (mailer.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.messages) == 0 {
+		return mailer.Message{}, false
+	}
+	return s.messages[len(s.messages)-1], true
+}
@@ -0,0 +1,52 @@
+package oidc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// FromEnv reads the providers listed in the comma separated list names from
+// the OIDC_<NAME>_* variables of getenv: KIND (the name when it is google
+// or github, oidc otherwise), ISSUER, AUTH_URL, TOKEN_URL, USERINFO_URL,
+// CLIENT_ID, CLIENT_SECRET and SCOPES.
+func FromEnv(names string, getenv func(string) string) ([]models.OIDCProvider, error) {
+	var providers []models.OIDCProvider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		env := func(key string) string {
+			return strings.TrimSpace(getenv("OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_" + key))
+		}
+
+		p := models.OIDCProvider{
+			Name:         name,
+			Kind:         env("KIND"),
+			Issuer:       env("ISSUER"),
+			AuthURL:      env("AUTH_URL"),
+			TokenURL:     env("TOKEN_URL"),
+			UserInfoURL:  env("USERINFO_URL"),
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			Scopes:       strings.FieldsFunc(env("SCOPES"), func(r rune) bool { return r == ',' || r == ' ' }),
+		}
+		if p.Kind == "" {
+			switch name {
+			case models.OIDCKindGoogle, models.OIDCKindGitHub:
+				p.Kind = name
+			default:
+				p.Kind = models.OIDCKindOIDC
+			}
+		}
+
+		if err := Validate(p); err != nil {
+			return nil, fmt.Errorf("failed to read oidc provider from env: %w", err)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
@@ -0,0 +1,352 @@
+// Package oidc logs users in with OAuth 2.0 and OpenID Connect identity
+// providers, using the authorization code flow with PKCE.
+//
+// The identity of the user is read from the userinfo endpoint with the
+// access token received from the token endpoint, which is trusted through
+// TLS as allowed by OpenID Connect Core 3.1.3.7, so the ID token signature
+// is not verified. GitHub, which is not an OpenID Connect provider, is read
+// from its REST API.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// Endpoints of the providers with a preset.
+const (
+	GoogleIssuer      = "https://accounts.google.com"
+	GitHubAuthURL     = "https://github.com/login/oauth/authorize"
+	GitHubTokenURL    = "https://github.com/login/oauth/access_token"
+	GitHubUserInfoURL = "https://api.github.com/user"
+)
+
+// maxResponseSize bounds the responses read from the providers.
+const maxResponseSize = 1 << 20
+
+var nameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ErrEmailNotVerified is returned for the identities without a verified
+// email address, which cannot be linked to a user.
+var ErrEmailNotVerified = errors.New("email not verified")
+
+// Identity is the user authenticated by a provider.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// Validate checks the configuration of a provider.
+func Validate(p models.OIDCProvider) error {
+	if !nameRegexp.MatchString(p.Name) {
+		return fmt.Errorf("invalid oidc provider name %q", p.Name)
+	}
+	switch p.Kind {
+	case models.OIDCKindGoogle, models.OIDCKindGitHub:
+	case models.OIDCKindOIDC:
+		if p.Issuer == "" && (p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+			return fmt.Errorf("oidc provider %s needs an issuer or its endpoints", p.Name)
+		}
+	default:
+		return fmt.Errorf("unknown oidc provider kind %q", p.Kind)
+	}
+	if p.ClientID == "" {
+		return fmt.Errorf("oidc provider %s has no client_id", p.Name)
+	}
+	for _, u := range []string{p.Issuer, p.AuthURL, p.TokenURL, p.UserInfoURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("invalid oidc provider url %q", u)
+		}
+	}
+	return nil
+}
+
+// Provider is an identity provider ready to log users in.
+type Provider struct {
+	cfg    models.OIDCProvider
+	client *http.Client
+}
+
+// New returns the provider of cfg. The kinds with a preset fill the missing
+// endpoints and scopes, the OpenID Connect providers discover the missing
+// endpoints from their issuer.
+func New(ctx context.Context, cfg models.OIDCProvider, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	switch cfg.Kind {
+	case models.OIDCKindGoogle:
+		if cfg.Issuer == "" {
+			cfg.Issuer = GoogleIssuer
+		}
+	case models.OIDCKindGitHub:
+		cfg.AuthURL = orDefault(cfg.AuthURL, GitHubAuthURL)
+		cfg.TokenURL = orDefault(cfg.TokenURL, GitHubTokenURL)
+		cfg.UserInfoURL = orDefault(cfg.UserInfoURL, GitHubUserInfoURL)
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"read:user", "user:email"}
+		}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	p := &Provider{cfg: cfg, client: client}
+	if cfg.Kind != models.OIDCKindGitHub && (cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.UserInfoURL == "") {
+		if err := p.discover(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// discover fills the missing endpoints with the OpenID Connect discovery
+// document of the issuer.
+func (p *Provider) discover(ctx context.Context) error {
+	issuer := strings.TrimSuffix(p.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery request: %w", err)
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := p.do(req, &doc); err != nil {
+		return fmt.Errorf("failed to discover %s: %w", p.cfg.Name, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return fmt.Errorf("failed to discover %s: issuer %q does not match", p.cfg.Name, doc.Issuer)
+	}
+
+	p.cfg.AuthURL = orDefault(p.cfg.AuthURL, doc.AuthorizationEndpoint)
+	p.cfg.TokenURL = orDefault(p.cfg.TokenURL, doc.TokenEndpoint)
+	p.cfg.UserInfoURL = orDefault(p.cfg.UserInfoURL, doc.UserinfoEndpoint)
+	if p.cfg.AuthURL == "" || p.cfg.TokenURL == "" || p.cfg.UserInfoURL == "" {
+		return fmt.Errorf("failed to discover %s: missing endpoints", p.cfg.Name)
+	}
+	return nil
+}
+
+// AuthCodeURL returns the authorization URL the user is redirected to.
+func (p *Provider) AuthCodeURL(state, verifier, redirectURL string) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.cfg.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.cfg.AuthURL + sep + q.Encode()
+}
+
+// Exchange trades an authorization code for an access token.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, redirectURL string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.do(req, &token); err != nil {
+		return "", fmt.Errorf("failed to exchange code: %w", err)
+	}
+	// GitHub answers the errors with 200.
+	if token.Error != "" {
+		return "", fmt.Errorf("failed to exchange code: %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("failed to exchange code: no access token")
+	}
+	return token.AccessToken, nil
+}
+
+// Identity returns the user of an access token.
+func (p *Provider) Identity(ctx context.Context, accessToken string) (Identity, error) {
+	if p.cfg.Kind == models.OIDCKindGitHub {
+		return p.githubIdentity(ctx, accessToken)
+	}
+
+	var claims struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified any    `json:"email_verified"`
+		Name          string `json:"name"`
+		Picture       string `json:"picture"`
+	}
+	if err := p.get(ctx, p.cfg.UserInfoURL, accessToken, &claims); err != nil {
+		return Identity{}, fmt.Errorf("failed to get user info: %w", err)
+	}
+	if claims.Subject == "" {
+		return Identity{}, errors.New("failed to get user info: no subject")
+	}
+
+	return Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified(claims.EmailVerified),
+		Name:          claims.Name,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// verified reads email_verified, which some providers send as a string.
+func verified(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+func (p *Provider) githubIdentity(ctx context.Context, accessToken string) (Identity, error) {
+	var user struct {
+		ID        int64  `json:"id"`
+		Name      string `json:"name"`
+		Login     string `json:"login"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := p.get(ctx, p.cfg.UserInfoURL, accessToken, &user); err != nil {
+		return Identity{}, fmt.Errorf("failed to get github user: %w", err)
+	}
+	if user.ID == 0 {
+		return Identity{}, errors.New("failed to get github user: no id")
+	}
+
+	// The email of the profile may not be verified, the primary address
+	// of the account is used instead.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.get(ctx, strings.TrimSuffix(p.cfg.UserInfoURL, "/")+"/emails", accessToken, &emails); err != nil {
+		return Identity{}, fmt.Errorf("failed to get github emails: %w", err)
+	}
+
+	i := Identity{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    orDefault(user.Name, user.Login),
+		Picture: user.AvatarURL,
+	}
+	for _, e := range emails {
+		if e.Primary {
+			i.Email, i.EmailVerified = e.Email, e.Verified
+		}
+	}
+	return i, nil
+}
+
+func (p *Provider) get(ctx context.Context, u, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return p.do(req, v)
+}
+
+// do sends req and decodes its JSON response into v.
+func (p *Provider) do(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, truncate(body))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+func truncate(b []byte) string {
+	if len(b) > 200 {
+		b = b[:200]
+	}
+	return string(b)
+}
+
+// NewVerifier returns a random PKCE code verifier, also fit for a state.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate verifier: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 PKCE code challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
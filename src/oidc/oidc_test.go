@@ -0,0 +1,141 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/oidc"
+	"github.com/amaurybrisou/gateway/src/oidc/oidctest"
+	"github.com/stretchr/testify/require"
+)
+
+// authorize follows the authorization URL and returns the code.
+func authorize(t *testing.T, authURL string) (code, state string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestProvider(t *testing.T) {
+	server := oidctest.NewServer(oidctest.User{Subject: "u-1", Email: "ada@example.org", EmailVerified: true, Name: "Ada"})
+	defer server.Close()
+
+	p, err := oidc.New(context.Background(), server.Provider("corp"), nil)
+	require.NoError(t, err)
+
+	verifier, err := oidc.NewVerifier()
+	require.NoError(t, err)
+	authURL := p.AuthCodeURL("state-1", verifier, "http://gateway.test/auth/oidc/corp/callback")
+
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, "openid email profile", u.Query().Get("scope"))
+	require.Equal(t, oidc.Challenge(verifier), u.Query().Get("code_challenge"))
+
+	code, state := authorize(t, authURL)
+	require.Equal(t, "state-1", state)
+
+	// The code is bound to the verifier.
+	other, err := oidc.NewVerifier()
+	require.NoError(t, err)
+	_, err = p.Exchange(context.Background(), code, other, "http://gateway.test/auth/oidc/corp/callback")
+	require.Error(t, err)
+
+	code, _ = authorize(t, authURL)
+	token, err := p.Exchange(context.Background(), code, verifier, "http://gateway.test/auth/oidc/corp/callback")
+	require.NoError(t, err)
+
+	identity, err := p.Identity(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, oidc.Identity{Subject: "u-1", Email: "ada@example.org", EmailVerified: true, Name: "Ada"}, identity)
+
+	// Codes are single use.
+	_, err = p.Exchange(context.Background(), code, verifier, "http://gateway.test/auth/oidc/corp/callback")
+	require.Error(t, err)
+}
+
+func TestGitHubProvider(t *testing.T) {
+	server := oidctest.NewServer(oidctest.User{Subject: "42", Email: "ada@example.org", EmailVerified: true, Name: "ada"})
+	defer server.Close()
+
+	p, err := oidc.New(context.Background(), server.GitHubProvider("github"), nil)
+	require.NoError(t, err)
+
+	verifier, err := oidc.NewVerifier()
+	require.NoError(t, err)
+	authURL := p.AuthCodeURL("s", verifier, "http://gateway.test/cb")
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	require.Equal(t, "read:user user:email", u.Query().Get("scope"))
+
+	code, _ := authorize(t, authURL)
+	token, err := p.Exchange(context.Background(), code, verifier, "http://gateway.test/cb")
+	require.NoError(t, err)
+
+	identity, err := p.Identity(context.Background(), token)
+	require.NoError(t, err)
+	require.Equal(t, oidc.Identity{Subject: "42", Email: "ada@example.org", EmailVerified: true, Name: "ada"}, identity)
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	server := oidctest.NewServer(oidctest.User{})
+	defer server.Close()
+
+	cfg := server.Provider("corp")
+	cfg.Issuer = server.URL + "/tenant"
+	_, err := oidc.New(context.Background(), cfg, nil)
+	require.Error(t, err)
+}
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{
+		"OIDC_GOOGLE_CLIENT_ID":       "google-id",
+		"OIDC_GOOGLE_CLIENT_SECRET":   "google-secret",
+		"OIDC_CORP_SSO_CLIENT_ID":     "corp-id",
+		"OIDC_CORP_SSO_CLIENT_SECRET": "corp-secret",
+		"OIDC_CORP_SSO_ISSUER":        "https://sso.corp.example",
+		"OIDC_CORP_SSO_SCOPES":        "openid email groups",
+	}
+
+	providers, err := oidc.FromEnv("google, corp-sso", func(k string) string { return env[k] })
+	require.NoError(t, err)
+	require.Equal(t, []models.OIDCProvider{
+		{Name: "google", Kind: models.OIDCKindGoogle, ClientID: "google-id", ClientSecret: "google-secret", Scopes: []string{}},
+		{Name: "corp-sso", Kind: models.OIDCKindOIDC, Issuer: "https://sso.corp.example", ClientID: "corp-id", ClientSecret: "corp-secret", Scopes: []string{"openid", "email", "groups"}},
+	}, providers)
+
+	providers, err = oidc.FromEnv("", func(k string) string { return env[k] })
+	require.NoError(t, err)
+	require.Empty(t, providers)
+
+	// Generic providers need an issuer.
+	_, err = oidc.FromEnv("other", func(k string) string { return map[string]string{"OIDC_OTHER_CLIENT_ID": "id"}[k] })
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	valid := models.OIDCProvider{Name: "corp", Kind: models.OIDCKindOIDC, Issuer: "https://sso.corp.example", ClientID: "id"}
+	require.NoError(t, oidc.Validate(valid))
+
+	for name, edit := range map[string]func(p *models.OIDCProvider){
+		"name":      func(p *models.OIDCProvider) { p.Name = "Corp SSO" },
+		"kind":      func(p *models.OIDCProvider) { p.Kind = "saml" },
+		"client id": func(p *models.OIDCProvider) { p.ClientID = "" },
+		"issuer":    func(p *models.OIDCProvider) { p.Issuer = "" },
+		"url":       func(p *models.OIDCProvider) { p.Issuer = "ftp://sso.corp.example" },
+	} {
+		p := valid
+		edit(&p)
+		require.Error(t, oidc.Validate(p), name)
+	}
+}
@@ -0,0 +1,218 @@
+// Package oidctest runs an OpenID Connect provider in memory for the tests.
+//
+// Its authorization endpoint logs the configured user in right away and
+// redirects back with a code, so a test can follow the redirects of a whole
+// login without a browser.
+package oidctest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/oidc"
+)
+
+// Client credentials accepted by the server.
+const (
+	ClientID     = "test-client"
+	ClientSecret = "test-secret"
+)
+
+// User is the user logged in by the server.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Server is the mock provider, serving both the OpenID Connect endpoints
+// and the GitHub REST API.
+type Server struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	user  User
+	codes map[string]grant
+	// Tokens counts the codes exchanged.
+	Tokens int
+}
+
+type grant struct {
+	user        User
+	challenge   string
+	redirectURI string
+}
+
+// NewServer starts a provider logging user in, to be closed by the caller.
+func NewServer(user User) *Server {
+	s := &Server{user: user, codes: make(map[string]grant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/userinfo", s.userinfo)
+	mux.HandleFunc("/user", s.githubUser)
+	mux.HandleFunc("/user/emails", s.githubEmails)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetUser changes the user logged in by the next authorizations.
+func (s *Server) SetUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+// Provider returns the configuration of an OpenID Connect provider named
+// name using the server.
+func (s *Server) Provider(name string) models.OIDCProvider {
+	return models.OIDCProvider{
+		Name:         name,
+		Kind:         models.OIDCKindOIDC,
+		Issuer:       s.URL,
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+	}
+}
+
+// GitHubProvider returns the configuration of a GitHub provider named name
+// using the server.
+func (s *Server) GitHubProvider(name string) models.OIDCProvider {
+	return models.OIDCProvider{
+		Name:         name,
+		Kind:         models.OIDCKindGitHub,
+		AuthURL:      s.URL + "/authorize",
+		TokenURL:     s.URL + "/token",
+		UserInfoURL:  s.URL + "/user",
+		ClientID:     ClientID,
+		ClientSecret: ClientSecret,
+	}
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"userinfo_endpoint":      s.URL + "/userinfo",
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := random()
+	s.mu.Lock()
+	s.codes[code] = grant{user: s.user, challenge: q.Get("code_challenge"), redirectURI: redirectURI.String()}
+	s.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if r.PostForm.Get("client_id") != ClientID || r.PostForm.Get("client_secret") != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := r.PostForm.Get("code")
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	if !ok || g.redirectURI != r.PostForm.Get("redirect_uri") || oidc.Challenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := random()
+	s.codes["token:"+token] = g
+	s.Tokens++
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": token, "token_type": "Bearer"})
+}
+
+// authenticated returns the user of the bearer token of r.
+func (s *Server) authenticated(r *http.Request) (User, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || auth[:len(prefix)] != prefix {
+		return User{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.codes["token:"+auth[len(prefix):]]
+	return g.user, ok
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.authenticated(r)
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sub":            u.Subject,
+		"email":          u.Email,
+		"email_verified": u.EmailVerified,
+		"name":           u.Name,
+	})
+}
+
+func (s *Server) githubUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.authenticated(r)
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	id, _ := strconv.ParseInt(u.Subject, 10, 64)
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "login": u.Name, "name": u.Name})
+}
+
+func (s *Server) githubEmails(w http.ResponseWriter, r *http.Request) {
+	u, ok := s.authenticated(r)
+	if !ok {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, []map[string]any{
+		{"email": "noreply@users.github.example", "primary": false, "verified": true},
+		{"email": u.Email, "primary": true, "verified": u.EmailVerified},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) //nolint
+}
+
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,8 @@
+package ratelimit
+
+import "time"
+
+// SetNow replaces the clock of the limiter.
+func (l *Limiter) SetNow(now func() time.Time) {
+	l.now = now
+}
@@ -0,0 +1,153 @@
+// Package ratelimit bounds the requests of the clients of the gateway, per
+// client address, user, plan and service, with fixed window rate limits
+// counted in memory and monthly quotas counted in Postgres.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+)
+
+// Unlimited lifts the limit of a service in the metadata of a plan.
+const Unlimited = "unlimited"
+
+var units = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+}
+
+// Limit is a number of requests per period, the zero Limit is unlimited.
+type Limit struct {
+	Requests int64
+	Period   time.Duration
+}
+
+// ParseLimit parses "<requests>/<period>" limits such as "100/m", the
+// period being s, m, h, d or a duration such as 30s. A bare number is a
+// limit per second, an empty or unlimited value is the zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, Unlimited) {
+		return Limit{}, nil
+	}
+
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		period = "s"
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(requests), 10, 64)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: requests must be a positive number", s)
+	}
+
+	period = strings.TrimSpace(period)
+	d, ok := units[period]
+	if !ok {
+		if d, err = time.ParseDuration(period); err != nil || d < time.Second {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: period must be s, m, h, d or a duration of at least 1s", s)
+		}
+	}
+
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// IsZero reports whether l is unlimited.
+func (l Limit) IsZero() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+func (l Limit) String() string {
+	if l.IsZero() {
+		return Unlimited
+	}
+	for unit, d := range units {
+		if d == l.Period {
+			return fmt.Sprintf("%d/%s", l.Requests, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// ParseQuota parses a monthly quota, an empty or unlimited value is 0.
+func ParseQuota(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, Unlimited) {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid monthly quota %q: must be a positive number", s)
+	}
+	return n, nil
+}
+
+// Policy is the limits of the requests of a client to a service.
+type Policy struct {
+	// Key identifies the client and the service of the rate limit window.
+	Key  string
+	Rate Limit
+	// Quota is the monthly quota of UserID on ServiceID, none when zero.
+	Quota     int64
+	UserID    uuid.UUID
+	ServiceID uuid.UUID
+}
+
+// AnonymousPolicy returns the policy of the anonymous requests of the
+// client at clientIP to service.
+func AnonymousPolicy(service models.Service, clientIP string) (Policy, error) {
+	p := Policy{Key: "ip:" + clientIP + ":" + service.ID.String(), ServiceID: service.ID}
+	if service.RateLimit == nil {
+		return p, nil
+	}
+
+	var err error
+	p.Rate, err = ParseLimit(service.RateLimit.AnonymousRate)
+	return p, err
+}
+
+// UserPolicy returns the policy of userID on service, the metadata of the
+// plan of the user override the limits of the service. The limits of the
+// service are kept when the metadata are invalid, along with the error.
+func UserPolicy(service models.Service, userID uuid.UUID, metadata map[string]string) (Policy, error) {
+	p := Policy{Key: "user:" + userID.String() + ":" + service.ID.String(), UserID: userID, ServiceID: service.ID}
+
+	var errs []string
+	if service.RateLimit != nil {
+		rate, err := ParseLimit(service.RateLimit.Rate)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		p.Rate, p.Quota = rate, service.RateLimit.MonthlyQuota
+	}
+
+	if v, ok := metadata[models.MetadataRateLimit]; ok {
+		rate, err := ParseLimit(v)
+		if err != nil {
+			errs = append(errs, "plan "+err.Error())
+		} else {
+			p.Rate = rate
+		}
+	}
+	if v, ok := metadata[models.MetadataMonthlyQuota]; ok {
+		quota, err := ParseQuota(v)
+		if err != nil {
+			errs = append(errs, "plan "+err.Error())
+		} else {
+			p.Quota = quota
+		}
+	}
+
+	if len(errs) > 0 {
+		return p, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return p, nil
+}
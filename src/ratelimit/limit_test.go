@@ -0,0 +1,99 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/ratelimit"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in    string
+		limit ratelimit.Limit
+		err   bool
+	}{
+		{in: "100/m", limit: ratelimit.Limit{Requests: 100, Period: time.Minute}},
+		{in: "10/s", limit: ratelimit.Limit{Requests: 10, Period: time.Second}},
+		{in: " 1000 / h ", limit: ratelimit.Limit{Requests: 1000, Period: time.Hour}},
+		{in: "5000/d", limit: ratelimit.Limit{Requests: 5000, Period: 24 * time.Hour}},
+		{in: "20/30s", limit: ratelimit.Limit{Requests: 20, Period: 30 * time.Second}},
+		{in: "5", limit: ratelimit.Limit{Requests: 5, Period: time.Second}},
+		{in: ""},
+		{in: "unlimited"},
+		{in: "0/m", err: true},
+		{in: "-1/m", err: true},
+		{in: "ten/m", err: true},
+		{in: "10/week", err: true},
+		{in: "10/100ms", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			limit, err := ratelimit.ParseLimit(tt.in)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.limit, limit)
+		})
+	}
+
+	require.Equal(t, "100/m", ratelimit.Limit{Requests: 100, Period: time.Minute}.String())
+	require.Equal(t, "20/30s", ratelimit.Limit{Requests: 20, Period: 30 * time.Second}.String())
+	require.Equal(t, ratelimit.Unlimited, ratelimit.Limit{}.String())
+}
+
+func TestPolicies(t *testing.T) {
+	service := models.Service{
+		ID: uuid.New(),
+		RateLimit: &models.RateLimit{
+			Rate:          "60/m",
+			AnonymousRate: "10/m",
+			MonthlyQuota:  1000,
+		},
+	}
+	userID := uuid.New()
+
+	p, err := ratelimit.AnonymousPolicy(service, "203.0.113.7")
+	require.NoError(t, err)
+	require.Equal(t, "ip:203.0.113.7:"+service.ID.String(), p.Key)
+	require.Equal(t, ratelimit.Limit{Requests: 10, Period: time.Minute}, p.Rate)
+	require.Zero(t, p.Quota)
+
+	// The service limits apply to the plans without metadata.
+	p, err = ratelimit.UserPolicy(service, userID, nil)
+	require.NoError(t, err)
+	require.Equal(t, "user:"+userID.String()+":"+service.ID.String(), p.Key)
+	require.Equal(t, ratelimit.Limit{Requests: 60, Period: time.Minute}, p.Rate)
+	require.Equal(t, int64(1000), p.Quota)
+	require.Equal(t, userID, p.UserID)
+	require.Equal(t, service.ID, p.ServiceID)
+
+	// The plan overrides them.
+	p, err = ratelimit.UserPolicy(service, userID, map[string]string{"rate_limit": "100/m", "monthly_quota": "10000"})
+	require.NoError(t, err)
+	require.Equal(t, ratelimit.Limit{Requests: 100, Period: time.Minute}, p.Rate)
+	require.Equal(t, int64(10000), p.Quota)
+
+	p, err = ratelimit.UserPolicy(service, userID, map[string]string{"rate_limit": "unlimited", "monthly_quota": "unlimited"})
+	require.NoError(t, err)
+	require.True(t, p.Rate.IsZero())
+	require.Zero(t, p.Quota)
+
+	// Invalid metadata keep the limits of the service.
+	p, err = ratelimit.UserPolicy(service, userID, map[string]string{"rate_limit": "fast", "monthly_quota": "-3"})
+	require.Error(t, err)
+	require.Equal(t, ratelimit.Limit{Requests: 60, Period: time.Minute}, p.Rate)
+	require.Equal(t, int64(1000), p.Quota)
+
+	// Services without limits only apply the plans.
+	p, err = ratelimit.UserPolicy(models.Service{ID: service.ID}, userID, map[string]string{"rate_limit": "5/s"})
+	require.NoError(t, err)
+	require.Equal(t, ratelimit.Limit{Requests: 5, Period: time.Second}, p.Rate)
+	require.Zero(t, p.Quota)
+}
@@ -0,0 +1,201 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/forwarded"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// QuotaStore counts the requests of the monthly quotas, shared by the
+// replicas of the gateway.
+type QuotaStore interface {
+	// IncrementQuotaUsage counts a request unless quota requests were
+	// already counted in the month starting at period, it returns the
+	// requests counted and whether the quota was exhausted.
+	IncrementQuotaUsage(ctx context.Context, userID, serviceID uuid.UUID, period time.Time, quota int64) (int64, bool, error)
+}
+
+// sweepInterval is the interval between the removals of the ended windows.
+const sweepInterval = time.Minute
+
+// Limiter counts the requests of the rate limits in fixed windows starting
+// with the first request of each key. The windows are kept in memory, each
+// replica of the gateway counts its own requests.
+type Limiter struct {
+	quotas QuotaStore
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+type window struct {
+	end   time.Time
+	count int64
+}
+
+// New returns a limiter counting the quotas in quotas, quotas are not
+// enforced when nil.
+func New(quotas QuotaStore) *Limiter {
+	return &Limiter{
+		quotas:  quotas,
+		now:     time.Now,
+		windows: make(map[string]*window),
+	}
+}
+
+// result is the state of a limit after a request.
+type result struct {
+	limit     int64
+	remaining int64
+	reset     time.Duration
+	window    time.Duration
+	allowed   bool
+}
+
+// Check counts a request against p and writes the RateLimit headers of the
+// most restrictive limit to h. It returns whether the request is allowed
+// and, when it is not, when to retry. Requests are allowed when the quota
+// cannot be counted, the error is returned to be logged.
+func (l *Limiter) Check(ctx context.Context, h http.Header, p Policy) (bool, time.Duration, error) {
+	if l == nil {
+		return true, 0, nil
+	}
+
+	var results []result
+	if !p.Rate.IsZero() {
+		r := l.allow(p.Key, p.Rate)
+		results = append(results, r)
+		if !r.allowed {
+			writeHeaders(h, results)
+			return false, r.reset, nil
+		}
+	}
+
+	var err error
+	if p.Quota > 0 && p.UserID != uuid.Nil && l.quotas != nil {
+		var r result
+		if r, err = l.quota(ctx, p); err == nil {
+			results = append(results, r)
+		}
+	}
+
+	writeHeaders(h, results)
+	for _, r := range results {
+		if !r.allowed {
+			return false, r.reset, nil
+		}
+	}
+	return true, 0, err
+}
+
+// allow counts a request in the window of key.
+func (l *Limiter) allow(key string, limit Limit) result {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for k, w := range l.windows {
+			if !now.Before(w.end) {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.end) {
+		w = &window{end: now.Add(limit.Period)}
+		l.windows[key] = w
+	}
+
+	r := result{limit: limit.Requests, reset: w.end.Sub(now), window: limit.Period}
+	if w.count >= limit.Requests {
+		return r
+	}
+
+	w.count++
+	r.remaining = limit.Requests - w.count
+	r.allowed = true
+	return r
+}
+
+// quota counts a request in the calendar month quota of p.
+func (l *Limiter) quota(ctx context.Context, p Policy) (result, error) {
+	now := l.now().UTC()
+	period := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	next := period.AddDate(0, 1, 0)
+
+	used, exhausted, err := l.quotas.IncrementQuotaUsage(ctx, p.UserID, p.ServiceID, period, p.Quota)
+	if err != nil {
+		return result{}, fmt.Errorf("failed to count quota: %w", err)
+	}
+
+	r := result{limit: p.Quota, reset: next.Sub(now), window: next.Sub(period), allowed: !exhausted}
+	if !exhausted {
+		r.remaining = p.Quota - used
+	}
+	return r, nil
+}
+
+// Middleware limits the requests of each client address to limit.
+func (l *Limiter) Middleware(limit Limit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit.IsZero() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, retryAfter, err := l.Check(r.Context(), w.Header(), Policy{Key: "ip:" + forwarded.ClientIP(r), Rate: limit})
+			if err != nil {
+				log.Ctx(r.Context()).Err(err).Send()
+			}
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(Seconds(retryAfter)))
+				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeHeaders writes the RateLimit headers of the IETF draft: the policy
+// lists every limit, the other headers describe the one closest to be
+// exhausted.
+func writeHeaders(h http.Header, results []result) {
+	if len(results) == 0 {
+		return
+	}
+
+	closest := results[0]
+	policies := make([]string, 0, len(results))
+	for _, r := range results {
+		policies = append(policies, fmt.Sprintf("%d;w=%d", r.limit, Seconds(r.window)))
+		if (!r.allowed && closest.allowed) || (r.allowed == closest.allowed && r.remaining < closest.remaining) {
+			closest = r
+		}
+	}
+
+	h.Set("RateLimit-Limit", strconv.FormatInt(closest.limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(closest.remaining, 10))
+	h.Set("RateLimit-Reset", strconv.Itoa(Seconds(closest.reset)))
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// Seconds rounds d up to whole seconds.
+func Seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
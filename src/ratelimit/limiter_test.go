@@ -0,0 +1,167 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/ratelimit"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// quotas counts the quotas in memory as the database does.
+type quotas struct {
+	mu     sync.Mutex
+	used   map[string]int64
+	period time.Time
+	err    error
+}
+
+func (q *quotas) IncrementQuotaUsage(ctx context.Context, userID, serviceID uuid.UUID, period time.Time, quota int64) (int64, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return 0, false, q.err
+	}
+
+	q.period = period
+	key := userID.String() + serviceID.String() + period.String()
+	if q.used[key] >= quota {
+		return quota, true, nil
+	}
+	q.used[key]++
+	return q.used[key], false, nil
+}
+
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newLimiter(store ratelimit.QuotaStore) (*ratelimit.Limiter, *clock) {
+	c := &clock{now: time.Date(2023, time.August, 31, 23, 59, 0, 0, time.UTC)}
+	l := ratelimit.New(store)
+	l.SetNow(c.Now)
+	return l, c
+}
+
+func TestRateLimit(t *testing.T) {
+	l, c := newLimiter(nil)
+	p := ratelimit.Policy{Key: "user:a", Rate: ratelimit.Limit{Requests: 2, Period: time.Minute}}
+
+	for i, remaining := range []string{"1", "0"} {
+		h := http.Header{}
+		allowed, _, err := l.Check(context.Background(), h, p)
+		require.NoError(t, err)
+		require.True(t, allowed, i)
+		require.Equal(t, "2", h.Get("RateLimit-Limit"))
+		require.Equal(t, remaining, h.Get("RateLimit-Remaining"))
+		require.Equal(t, "60", h.Get("RateLimit-Reset"))
+		require.Equal(t, "2;w=60", h.Get("RateLimit-Policy"))
+	}
+
+	c.now = c.now.Add(20 * time.Second)
+	h := http.Header{}
+	allowed, retryAfter, err := l.Check(context.Background(), h, p)
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.Equal(t, 40*time.Second, retryAfter)
+	require.Equal(t, "0", h.Get("RateLimit-Remaining"))
+	require.Equal(t, "40", h.Get("RateLimit-Reset"))
+
+	// The other keys have their own window.
+	allowed, _, _ = l.Check(context.Background(), http.Header{}, ratelimit.Policy{Key: "user:b", Rate: p.Rate})
+	require.True(t, allowed)
+
+	// A new window starts once the previous one ended.
+	c.now = c.now.Add(40 * time.Second)
+	allowed, _, _ = l.Check(context.Background(), http.Header{}, p)
+	require.True(t, allowed)
+
+	// Unlimited policies set no header.
+	h = http.Header{}
+	allowed, _, _ = l.Check(context.Background(), h, ratelimit.Policy{Key: "user:a"})
+	require.True(t, allowed)
+	require.Empty(t, h)
+}
+
+func TestQuota(t *testing.T) {
+	store := &quotas{used: make(map[string]int64)}
+	l, c := newLimiter(store)
+	p := ratelimit.Policy{
+		Key:       "user:a",
+		Rate:      ratelimit.Limit{Requests: 100, Period: time.Minute},
+		Quota:     2,
+		UserID:    uuid.New(),
+		ServiceID: uuid.New(),
+	}
+
+	h := http.Header{}
+	allowed, _, err := l.Check(context.Background(), h, p)
+	require.NoError(t, err)
+	require.True(t, allowed)
+	require.Equal(t, time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC), store.period)
+	// The quota is the closest to be exhausted.
+	require.Equal(t, "2", h.Get("RateLimit-Limit"))
+	require.Equal(t, "1", h.Get("RateLimit-Remaining"))
+	require.Equal(t, "60", h.Get("RateLimit-Reset"))
+	require.Equal(t, "100;w=60, 2;w=2678400", h.Get("RateLimit-Policy"))
+
+	allowed, _, _ = l.Check(context.Background(), http.Header{}, p)
+	require.True(t, allowed)
+
+	allowed, retryAfter, err := l.Check(context.Background(), http.Header{}, p)
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.Equal(t, time.Minute, retryAfter)
+
+	// The quota is reset with the month.
+	c.now = c.now.Add(2 * time.Minute)
+	allowed, _, _ = l.Check(context.Background(), http.Header{}, p)
+	require.True(t, allowed)
+	require.Equal(t, time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC), store.period)
+
+	// Anonymous requests have no quota.
+	anonymous := p
+	anonymous.UserID = uuid.Nil
+	for i := 0; i < 3; i++ {
+		allowed, _, _ = l.Check(context.Background(), http.Header{}, anonymous)
+		require.True(t, allowed)
+	}
+
+	// Requests are allowed when the quota cannot be counted.
+	store.err = errors.New("connection refused")
+	allowed, _, err = l.Check(context.Background(), http.Header{}, p)
+	require.Error(t, err)
+	require.True(t, allowed)
+}
+
+func TestMiddleware(t *testing.T) {
+	l, _ := newLimiter(nil)
+	h := l.Middleware(ratelimit.Limit{Requests: 1, Period: time.Hour})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, serve("203.0.113.7:1000").Code)
+
+	w := serve("203.0.113.7:2000")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "3600", w.Header().Get("Retry-After"))
+
+	require.Equal(t, http.StatusOK, serve("203.0.113.8:1000").Code)
+
+	// A zero limit lets every request through.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	require.NotNil(t, l.Middleware(ratelimit.Limit{})(next))
+}
@@ -10,14 +10,20 @@ import (
 	"github.com/amaurybrisou/ablib"
 	ablibhttp "github.com/amaurybrisou/ablib/http"
 	ablibmodels "github.com/amaurybrisou/ablib/models"
+	"github.com/amaurybrisou/gateway/src/accesslog"
+	"github.com/amaurybrisou/gateway/src/compression"
 	"github.com/amaurybrisou/gateway/src/database"
+	"github.com/amaurybrisou/gateway/src/database/models"
 	"github.com/amaurybrisou/gateway/src/gwservices"
+	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/amaurybrisou/gateway/src/ratelimit"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/time/rate"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func Router(s gwservices.Services, db *database.Database) http.Handler {
@@ -35,17 +41,21 @@ func Router(s gwservices.Services, db *database.Database) http.Handler {
 		}).Handler)
 	}
 
-	r.Use(middleware.RealIP)
+	r.Use(s.Forwarded().Middleware)
 	r.Use(middleware.RequestID)
-	r.Use(ablibhttp.LoggerMiddleware(&log.Logger))
+	r.Use(accesslog.Middleware(&log.Logger))
 
-	r.Use(ablibhttp.NewRateLimitMiddleware(ablibhttp.WithRateLimit(
-		rate.Limit(ablib.LookupEnvFloat64("RATE_LIMIT", float64(5))),
-		ablib.LookupEnvInt("RATE_LIMIT_BURST", 10),
-	)).Middleware)
-	r.Use(ablibhttp.RequestMetric("gateway"))
+	// Each client address is limited on every route, the services add the
+	// limits of their users and plans.
+	globalLimit, err := ratelimit.ParseLimit(ablib.LookupEnv("RATE_LIMIT", "300/m"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("parsing rate limit")
+	}
+	r.Use(ratelimit.New(nil).Middleware(globalLimit))
+	// WebSocket and Server-Sent Events streams are long-lived and need a
+	// ResponseWriter able to hijack or flush the connection.
+	r.Use(proxy.SkipStreams(ablibhttp.RequestMetric("gateway")))
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(time.Second * 10))
 
 	// jwtAuthProvider := ablibhttp.NewJwtAuth(
 	// 	s.Jwt(),
@@ -57,11 +67,12 @@ func Router(s gwservices.Services, db *database.Database) http.Handler {
 	// 	},
 	// )
 
+	session := s.Identity().Session()
 	authProvider := ablibhttp.NewCookieAuthHandler(
-		ablib.LookupEnv("COOKIE_SCRET", "something-secret"),
-		ablib.LookupEnv("COOKIE_NAME", "cookie-name"),
-		ablib.LookupEnv("COOKIE_DOMAIN", "cookie-domain"),
-		ablib.LookupEnvInt("COOKIE_MAX_AGE", 3600),
+		session.Secret,
+		session.Name,
+		session.Domain,
+		session.MaxAge,
 		Repo{db: db},
 		s.Jwt(),
 	)
@@ -69,47 +80,79 @@ func Router(s gwservices.Services, db *database.Database) http.Handler {
 	// UNAUTHENTICATED
 	r.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Host != ablib.LookupEnv("DOMAIN", "localhost:8089") {
-			s.Proxy().ServiceAccessHandler(authProvider.Middleware).ServeHTTP(w, r)
+			s.Proxy().ServiceAccessHandler(s.APIKeys().Middleware(authProvider.Middleware)).ServeHTTP(w, r)
 			return
 		}
 		http.RedirectHandler("/home", http.StatusPermanentRedirect).ServeHTTP(w, r)
 	}))
 
-	r.Route("/home", func(r chi.Router) {
-		r.Handle("/*", http.StripPrefix("/home", http.FileServer(http.Dir(ablib.LookupEnv("FRONT_BUILD_PATH", "front/build")))))
-	})
-	r.Post("/login", authProvider.Login)
-
-	r.Post("/payment/webhook", s.Payment().StripeWebhook)
-	r.With(authProvider.NonAuthoritativeMiddleware).With(ablibhttp.JsonContentType()).Get("/services", s.Service().GetAllServicesHandler)
-	r.With(authProvider.NonAuthoritativeMiddleware).Get("/pricing/{service_name}", s.Service().ServicePricePage)
+	// The proxied routes apply the timeout of their service.
 	r.With(authProvider.NonAuthoritativeMiddleware).Get("/details/{service_name}", s.Proxy().PublicRoutes)
 
-	// AUTHENTICATED
-
-	r.Route("/auth", func(authenticatedRouter chi.Router) {
-		authenticatedRouter.Use(authProvider.Middleware)
-		authenticatedRouter.Use(ablibhttp.JsonContentType())
-
-		authenticatedRouter.Post("/update-password", s.Service().PasswordUpdateHandler)
-		authenticatedRouter.Get("/user", s.Service().GetUserHandler)
-		authenticatedRouter.Get("/logout", authProvider.Logout)
-		authenticatedRouter.Get("/refresh-token", authProvider.RefreshToken)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(time.Second * 10))
 
-		// authenticatedRouter.Get("/services", s.Service().GetAllServicesHandler)
-
-		authenticatedRouter.Route("/admin", func(adminRouter chi.Router) {
-			adminRouter.Use(ablibhttp.IsAdminMiddleware)
-
-			adminRouter.Post("/services", s.Service().CreateServiceHandler)
-			adminRouter.Delete("/services/{service_id}", s.Service().DeleteServiceHandler)
-			adminRouter.Get("/services", s.Service().GetAllServicesHandler)
-			adminRouter.Get("/version", Version)
+		r.Route("/home", func(r chi.Router) {
+			r.Use(compression.Middleware((*models.Compression)(nil).WithDefaults()))
+			r.Handle("/*", http.StripPrefix("/home", http.FileServer(http.Dir(ablib.LookupEnv("FRONT_BUILD_PATH", "front/build")))))
+		})
+		r.Post("/login", authProvider.Login)
+		r.Post("/password/forgot", s.Account().ForgotPasswordHandler)
+		r.Post("/password/reset", s.Account().ResetPasswordHandler)
+		r.Post("/email/verify", s.Account().VerifyEmailHandler)
+		r.Post("/account/activate", s.Account().ActivateHandler)
+
+		r.Post("/payment/webhook", s.Payment().StripeWebhook)
+		r.With(authProvider.NonAuthoritativeMiddleware).With(ablibhttp.JsonContentType()).Get("/services", s.Service().GetAllServicesHandler)
+		r.With(authProvider.NonAuthoritativeMiddleware).Get("/pricing/{service_name}", s.Service().ServicePricePage)
+
+		// AUTHENTICATED
+
+		r.Route("/auth", func(authRouter chi.Router) {
+			// The identity providers log the users in.
+			authRouter.Get("/oidc/{provider}/login", s.Identity().LoginHandler)
+			authRouter.Get("/oidc/{provider}/callback", s.Identity().CallbackHandler)
+
+			authRouter.Group(func(authenticatedRouter chi.Router) {
+				authenticatedRouter.Use(authProvider.Middleware)
+				authenticatedRouter.Use(ablibhttp.JsonContentType())
+
+				authenticatedRouter.Post("/update-password", s.Service().PasswordUpdateHandler)
+				authenticatedRouter.Post("/email-verification", s.Account().SendVerificationHandler)
+				authenticatedRouter.Get("/user", s.Service().GetUserHandler)
+				authenticatedRouter.Get("/logout", authProvider.Logout)
+				authenticatedRouter.Get("/refresh-token", authProvider.RefreshToken)
+
+				authenticatedRouter.Get("/api-keys", s.Service().GetAPIKeysHandler)
+				authenticatedRouter.Post("/api-keys", s.Service().CreateAPIKeyHandler)
+				authenticatedRouter.Delete("/api-keys/{key_id}", s.Service().DeleteAPIKeyHandler)
+
+				// authenticatedRouter.Get("/services", s.Service().GetAllServicesHandler)
+
+				authenticatedRouter.Route("/admin", func(adminRouter chi.Router) {
+					adminRouter.Use(ablibhttp.IsAdminMiddleware)
+
+					adminRouter.Post("/services", s.Service().CreateServiceHandler)
+					adminRouter.Delete("/services/{service_id}", s.Service().DeleteServiceHandler)
+					adminRouter.Get("/services/{service_id}/health", s.Service().GetServiceHealthHandler)
+					adminRouter.Delete("/services/{service_id}/cache", s.Service().PurgeServiceCacheHandler)
+					adminRouter.Put("/services/{service_id}/versions", s.Service().UpdateServiceVersionsHandler)
+					adminRouter.Put("/services/{service_id}/maintenance", s.Service().UpdateServiceMaintenanceHandler)
+					adminRouter.Get("/services", s.Service().GetAllServicesHandler)
+					adminRouter.Get("/ip-rules", s.Service().GetIPRulesHandler)
+					adminRouter.Post("/ip-rules", s.Service().CreateIPRuleHandler)
+					adminRouter.Delete("/ip-rules/{rule_id}", s.Service().DeleteIPRuleHandler)
+					adminRouter.Get("/oidc-providers", s.Identity().GetProvidersHandler)
+					adminRouter.Put("/oidc-providers/{provider}", s.Identity().PutProviderHandler)
+					adminRouter.Delete("/oidc-providers/{provider}", s.Identity().DeleteProviderHandler)
+					adminRouter.Get("/version", Version)
+				})
+			})
 		})
 	})
 
 	r.Route("/{service_name}", func(r chi.Router) {
-		r.HandleFunc("/*", s.Proxy().ServiceAccessHandler(authProvider.Middleware))
+		r.HandleFunc("/*", s.Proxy().ServiceAccessHandler(s.APIKeys().Middleware(authProvider.Middleware)))
 	})
 
 	walkFunc := func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
@@ -125,13 +168,23 @@ func Router(s gwservices.Services, db *database.Database) http.Handler {
 		fmt.Printf("Logging err: %s\n", err.Error())
 	}
 
-	return r
+	// gRPC clients speak HTTP/2 in cleartext with prior knowledge.
+	return h2c.NewHandler(r, &http2.Server{})
 }
 
 type Repo struct{ db *database.Database }
 
+// GetUserByEmail returns the user logging in with a password. The accounts
+// not activated yet get an empty user, refused as invalid credentials.
 func (r Repo) GetUserByEmail(ctx context.Context, email string) (ablibmodels.UserInterface, error) {
-	return r.db.GetUserByEmail(ctx, email)
+	user, err := r.db.GetUserByEmail(ctx, email)
+	if err != nil {
+		return user, err
+	}
+	if user.IsNew {
+		return models.User{}, nil
+	}
+	return user, nil
 }
 
 func (r Repo) GetUserByID(ctx context.Context, userIDString string) (ablibmodels.UserInterface, error) {
@@ -0,0 +1,89 @@
+// Package secrets encrypts the sensitive values stored in the database.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoKey is returned when a value is encrypted or decrypted without an
+// encryption key configured.
+var ErrNoKey = errors.New("no encryption key configured")
+
+// Cipher encrypts values with AES-256-GCM, the ciphertexts are base64
+// encoded with their nonce prepended.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a cipher keyed by the SHA-256 of key, a nil cipher is
+// returned for an empty key.
+func NewCipher(key string) (*Cipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns the ciphertext of plaintext, empty values are kept empty.
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if c == nil {
+		return "", ErrNoKey
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of a value returned by Encrypt.
+func (c *Cipher) Decrypt(ciphertext string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+	if c == nil {
+		return "", ErrNoKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("ciphertext too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,43 @@
+package secrets_test
+
+import (
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCipher(t *testing.T) {
+	c, err := secrets.NewCipher("key")
+	require.NoError(t, err)
+
+	ciphertext, err := c.Encrypt("secret")
+	require.NoError(t, err)
+	require.NotContains(t, ciphertext, "secret")
+
+	again, err := c.Encrypt("secret")
+	require.NoError(t, err)
+	require.NotEqual(t, ciphertext, again)
+
+	plaintext, err := c.Decrypt(ciphertext)
+	require.NoError(t, err)
+	require.Equal(t, "secret", plaintext)
+
+	other, err := secrets.NewCipher("other key")
+	require.NoError(t, err)
+	_, err = other.Decrypt(ciphertext)
+	require.Error(t, err)
+}
+
+func TestCipherWithoutKey(t *testing.T) {
+	c, err := secrets.NewCipher("")
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	v, err := c.Encrypt("")
+	require.NoError(t, err)
+	require.Empty(t, v)
+
+	_, err = c.Encrypt("secret")
+	require.ErrorIs(t, err, secrets.ErrNoKey)
+}
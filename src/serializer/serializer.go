@@ -8,21 +8,61 @@ import (
 )
 
 type PublicService struct {
-	ID                         uuid.UUID  `json:"id,omitempty"`
-	Name                       string     `json:"name,omitempty"`
-	Description                string     `json:"description,omitempty"`
-	Prefix                     string     `json:"prefix,omitempty"`
-	Domain                     string     `json:"domain,omitempty"`
-	Host                       string     `json:"host,omitempty"`
-	ImageURL                   *string    `json:"image_url,omitempty"`
-	Status                     string     `json:"status,omitempty"`
-	PricingTableKey            string     `json:"pricing_table_key,omitempty"`
-	PricingTablePublishableKey string     `json:"pricing_table_publishable_key,omitempty"`
-	CreatedAt                  time.Time  `json:"created_at,omitempty"`
-	UpdatedAt                  *time.Time `json:"updated_at,omitempty"`
-	DeletedAt                  *time.Time `json:"deleted_at,omitempty"`
-	HasAccess                  *bool      `json:"has_access,omitempty"`
-	IsFree                     bool       `json:"is_free,omitempty"`
+	ID                         uuid.UUID              `json:"id,omitempty"`
+	Name                       string                 `json:"name,omitempty"`
+	Description                string                 `json:"description,omitempty"`
+	Prefix                     string                 `json:"prefix,omitempty"`
+	Domain                     string                 `json:"domain,omitempty"`
+	Host                       string                 `json:"host,omitempty"`
+	Methods                    []string               `json:"methods,omitempty"`
+	Headers                    map[string]string      `json:"headers,omitempty"`
+	Targets                    []models.Target        `json:"targets,omitempty"`
+	LoadBalancing              string                 `json:"load_balancing,omitempty"`
+	Protocol                   string                 `json:"protocol,omitempty"`
+	TLS                        *PublicUpstreamTLS     `json:"tls,omitempty"`
+	Signing                    *PublicSigning         `json:"signing,omitempty"`
+	TargetStatus               map[string]string      `json:"target_status,omitempty"`
+	HealthCheck                *models.HealthCheck    `json:"health_check,omitempty"`
+	RetryPolicy                *models.RetryPolicy    `json:"retry_policy,omitempty"`
+	CircuitBreaker             *models.CircuitBreaker `json:"circuit_breaker,omitempty"`
+	Streaming                  *models.StreamLimits   `json:"streaming,omitempty"`
+	Rewrite                    *models.Rewrite        `json:"rewrite,omitempty"`
+	Limits                     *models.ServiceLimits  `json:"limits,omitempty"`
+	RequestHeaders             *models.HeaderRules    `json:"request_headers,omitempty"`
+	ResponseHeaders            *models.HeaderRules    `json:"response_headers,omitempty"`
+	Cache                      *models.CacheConfig    `json:"cache,omitempty"`
+	Mirror                     *models.Mirror         `json:"mirror,omitempty"`
+	Canary                     *models.Canary         `json:"canary,omitempty"`
+	Transform                  *models.Transform      `json:"transform,omitempty"`
+	Compression                *models.Compression    `json:"compression,omitempty"`
+	Maintenance                *models.Maintenance    `json:"maintenance,omitempty"`
+	RateLimit                  *models.RateLimit      `json:"rate_limit,omitempty"`
+	IPRules                    *models.IPRules        `json:"ip_rules,omitempty"`
+	ErrorPages                 map[string]string      `json:"error_pages,omitempty"`
+	ImageURL                   *string                `json:"image_url,omitempty"`
+	Status                     string                 `json:"status,omitempty"`
+	PricingTableKey            string                 `json:"pricing_table_key,omitempty"`
+	PricingTablePublishableKey string                 `json:"pricing_table_publishable_key,omitempty"`
+	CreatedAt                  time.Time              `json:"created_at,omitempty"`
+	UpdatedAt                  *time.Time             `json:"updated_at,omitempty"`
+	DeletedAt                  *time.Time             `json:"deleted_at,omitempty"`
+	HasAccess                  *bool                  `json:"has_access,omitempty"`
+	IsFree                     bool                   `json:"is_free,omitempty"`
+}
+
+// PublicUpstreamTLS tells which certificates a service has without
+// disclosing them.
+type PublicUpstreamTLS struct {
+	HasCACert          bool   `json:"has_ca_cert"`
+	HasClientCert      bool   `json:"has_client_cert"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// PublicSigning tells whether a service has a signing secret without
+// disclosing it.
+type PublicSigning struct {
+	HasSecret bool `json:"has_secret"`
 }
 
 type PublicUser struct {
@@ -43,13 +83,38 @@ func Service(service *models.Service, admin bool) *PublicService {
 			service.Status = "service is unreachable"
 		}
 	}
-	return &PublicService{
+	p := &PublicService{
 		ID:                         service.ID,
 		Name:                       service.Name,
 		Description:                service.Description,
 		Prefix:                     service.Prefix,
 		Domain:                     service.Domain,
 		Host:                       service.Host,
+		Methods:                    service.Methods,
+		Headers:                    service.Headers,
+		Targets:                    service.Targets,
+		LoadBalancing:              service.LoadBalancing,
+		Protocol:                   service.Protocol,
+		TLS:                        upstreamTLS(service.TLS),
+		Signing:                    signing(service.Signing),
+		TargetStatus:               service.TargetStatus,
+		HealthCheck:                service.HealthCheck,
+		RetryPolicy:                service.RetryPolicy,
+		CircuitBreaker:             service.CircuitBreaker,
+		Streaming:                  service.Streaming,
+		Rewrite:                    service.Rewrite,
+		Limits:                     service.Limits,
+		RequestHeaders:             service.RequestHeaders,
+		ResponseHeaders:            service.ResponseHeaders,
+		Cache:                      service.Cache,
+		Mirror:                     service.Mirror,
+		Canary:                     service.Canary,
+		Transform:                  service.Transform,
+		Compression:                service.Compression,
+		Maintenance:                service.Maintenance,
+		RateLimit:                  service.RateLimit,
+		IPRules:                    service.IPRules,
+		ErrorPages:                 service.ErrorPages,
 		ImageURL:                   service.ImageURL,
 		PricingTableKey:            service.PricingTableKey,
 		PricingTablePublishableKey: service.PricingTablePublishableKey,
@@ -60,6 +125,45 @@ func Service(service *models.Service, admin bool) *PublicService {
 		HasAccess:                  service.HasAccess,
 		IsFree:                     len(service.RequiredRoles) == 0,
 	}
+
+	if !admin {
+		// The header rules hold the credentials of the upstreams, the
+		// matchers, limits and transformations are internal as well.
+		p.Headers = nil
+		p.RequestHeaders = nil
+		p.ResponseHeaders = nil
+		p.Limits = nil
+		p.Transform = nil
+		// The targets, mirrors and canaries are internal addresses, the IP
+		// rules and rate limits tell how to get around them.
+		p.Targets = nil
+		p.TargetStatus = nil
+		p.Mirror = nil
+		p.Canary = nil
+		p.RateLimit = nil
+		p.IPRules = nil
+	}
+
+	return p
+}
+
+func upstreamTLS(t *models.UpstreamTLS) *PublicUpstreamTLS {
+	if t == nil {
+		return nil
+	}
+	return &PublicUpstreamTLS{
+		HasCACert:          t.CACert != "",
+		HasClientCert:      t.ClientCert != "",
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+}
+
+func signing(s *models.Signing) *PublicSigning {
+	if s == nil {
+		return nil
+	}
+	return &PublicSigning{HasSecret: s.Secret != ""}
 }
 
 func Services(services []*models.Service, admin bool) []*PublicService {
@@ -0,0 +1,64 @@
+package serializer_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/serializer"
+	"github.com/stretchr/testify/require"
+)
+
+func service() *models.Service {
+	return &models.Service{
+		Name:            "api",
+		Prefix:          "/api",
+		Status:          models.ServiceStatusOK,
+		Headers:         map[string]string{"X-Tenant": "internal"},
+		RequestHeaders:  &models.HeaderRules{Set: map[string]string{"Authorization": "Bearer upstream-secret"}},
+		ResponseHeaders: &models.HeaderRules{Set: map[string]string{"X-Api-Key": "upstream-secret"}},
+		Limits:          &models.ServiceLimits{MaxRequestBodySize: 1024},
+		Transform:       &models.Transform{},
+		Targets:         []models.Target{{URL: "http://10.0.0.1:8080", Weight: 1}},
+		TargetStatus:    map[string]string{"http://10.0.0.1:8080": models.HealthStatusHealthy},
+		Mirror:          &models.Mirror{Host: "http://shadow.internal"},
+		Canary:          &models.Canary{Versions: []models.Version{{Name: "v2", Host: "http://canary.internal", Weight: 10}}},
+		RateLimit:       &models.RateLimit{Rate: "100/m"},
+		IPRules:         &models.IPRules{Allow: []string{"192.0.2.0/24"}},
+	}
+}
+
+func TestServiceHidesInternals(t *testing.T) {
+	public := serializer.Service(service(), false)
+	require.Nil(t, public.Headers)
+	require.Nil(t, public.RequestHeaders)
+	require.Nil(t, public.ResponseHeaders)
+	require.Nil(t, public.Limits)
+	require.Nil(t, public.Transform)
+	require.Nil(t, public.Targets)
+	require.Nil(t, public.TargetStatus)
+	require.Nil(t, public.Mirror)
+	require.Nil(t, public.Canary)
+	require.Nil(t, public.RateLimit)
+	require.Nil(t, public.IPRules)
+
+	b, err := json.Marshal(public)
+	require.NoError(t, err)
+	for _, internal := range []string{"upstream-secret", "10.0.0.1", "shadow.internal", "canary.internal", "192.0.2.0/24"} {
+		require.NotContains(t, string(b), internal)
+	}
+	require.Contains(t, string(b), `"name":"api"`)
+
+	admin := serializer.Service(service(), true)
+	require.NotNil(t, admin.Headers)
+	require.NotNil(t, admin.RequestHeaders)
+	require.NotNil(t, admin.ResponseHeaders)
+	require.NotNil(t, admin.Limits)
+	require.NotNil(t, admin.Transform)
+	require.NotNil(t, admin.Targets)
+	require.NotNil(t, admin.TargetStatus)
+	require.NotNil(t, admin.Mirror)
+	require.NotNil(t, admin.Canary)
+	require.NotNil(t, admin.RateLimit)
+	require.NotNil(t, admin.IPRules)
+}
@@ -0,0 +1,81 @@
+package signature_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/gateway/src/signature"
+	"github.com/stretchr/testify/require"
+)
+
+const secret = "0123456789abcdef0123456789abcdef"
+
+func signed(t time.Time) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/users?page=2", nil)
+	r.Header.Set(signature.HeaderUserID, "5f1c0b8e-4a5e-4d0c-9a53-c7a1f3b2d001")
+	r.Header.Set(signature.HeaderUserRole, "premium")
+	r.Header.Set(signature.HeaderPlan, `{"tier":"pro"}`)
+	signature.Sign(r, []byte(secret), t)
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	v := signature.NewVerifier(secret, time.Minute)
+
+	tests := []struct {
+		name   string
+		edit   func(r *http.Request)
+		secret string
+		err    error
+	}{
+		{name: "valid"},
+		{name: "tampered header", edit: func(r *http.Request) { r.Header.Set(signature.HeaderPlan, `{"tier":"enterprise"}`) }, err: signature.ErrInvalid},
+		{name: "added header", edit: func(r *http.Request) { r.Header.Set(signature.HeaderCustomerID, "cus_1") }, err: signature.ErrInvalid},
+		{name: "removed header", edit: func(r *http.Request) { r.Header.Del(signature.HeaderUserRole) }, err: signature.ErrInvalid},
+		{name: "other path", edit: func(r *http.Request) { r.URL.Path = "/admin" }, err: signature.ErrInvalid},
+		{name: "other query", edit: func(r *http.Request) { r.URL.RawQuery = "page=3" }, err: signature.ErrInvalid},
+		{name: "other method", edit: func(r *http.Request) { r.Method = http.MethodDelete }, err: signature.ErrInvalid},
+		{name: "other timestamp", edit: func(r *http.Request) { r.Header.Set(signature.HeaderTimestamp, "1") }, err: signature.ErrExpired},
+		{name: "not hex", edit: func(r *http.Request) { r.Header.Set(signature.HeaderSignature, "v1=zz") }, err: signature.ErrInvalid},
+		{name: "unknown version", edit: func(r *http.Request) { r.Header.Set(signature.HeaderSignature, "v2=00") }, err: signature.ErrMissing},
+		{name: "missing", edit: func(r *http.Request) { r.Header.Del(signature.HeaderSignature) }, err: signature.ErrMissing},
+		{name: "wrong secret", secret: "another secret", err: signature.ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signed(time.Now())
+			if tt.edit != nil {
+				tt.edit(r)
+			}
+
+			verifier := v
+			if tt.secret != "" {
+				verifier = signature.NewVerifier(tt.secret, time.Minute)
+			}
+			require.ErrorIs(t, verifier.Verify(r), tt.err)
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	v := signature.NewVerifier(secret, time.Minute)
+
+	require.NoError(t, v.Verify(signed(time.Now().Add(-30*time.Second))))
+	require.ErrorIs(t, v.Verify(signed(time.Now().Add(-2*time.Minute))), signature.ErrExpired)
+	require.ErrorIs(t, v.Verify(signed(time.Now().Add(2*time.Minute))), signature.ErrExpired)
+}
+
+func TestMiddleware(t *testing.T) {
+	h := signature.NewVerifier(secret, time.Minute).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, signed(time.Now()))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
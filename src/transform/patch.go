@@ -0,0 +1,136 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+)
+
+// patchJSON applies rules to the JSON document body. It reports whether the
+// document changed and whether a rule took its value from a variable.
+func patchJSON(body []byte, rules []models.PatchRule, vars map[string]json.RawMessage) (out []byte, changed, personal bool, err error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false, false, err
+	}
+
+	for _, rule := range rules {
+		raw := rule.Value
+		if rule.Variable != "" {
+			var ok bool
+			if raw, ok = vars[rule.Variable]; !ok {
+				continue
+			}
+		}
+
+		var value any
+		if rule.Op != models.PatchRemove {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.UseNumber()
+			if err := dec.Decode(&value); err != nil {
+				continue
+			}
+		}
+
+		var applied bool
+		doc, applied = patch(doc, pointer(rule.Path), rule.Op, value)
+		if applied {
+			changed = true
+			personal = personal || rule.Variable != ""
+		}
+	}
+
+	if !changed {
+		return body, false, false, nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, false, false, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true, personal, nil
+}
+
+// pointer splits a JSON pointer into its unescaped reference tokens.
+func pointer(path string) []string {
+	tokens := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens
+}
+
+// patch applies op to the member of node at tokens and returns the node
+// holding the change. Missing objects on the way are created by add.
+func patch(node any, tokens []string, op string, value any) (any, bool) {
+	token, last := tokens[0], len(tokens) == 1
+
+	switch n := node.(type) {
+	case map[string]any:
+		if last {
+			_, exists := n[token]
+			switch {
+			case op == models.PatchAdd, op == models.PatchReplace && exists:
+				n[token] = value
+			case op == models.PatchRemove && exists:
+				delete(n, token)
+			default:
+				return n, false
+			}
+			return n, true
+		}
+
+		child, ok := n[token]
+		if !ok {
+			if op != models.PatchAdd {
+				return n, false
+			}
+			child = map[string]any{}
+		}
+
+		child, applied := patch(child, tokens[1:], op, value)
+		if applied {
+			n[token] = child
+		}
+		return n, applied
+
+	case []any:
+		if token == "-" && last && op == models.PatchAdd {
+			return append(n, value), true
+		}
+
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i > len(n) || (i == len(n) && !(last && op == models.PatchAdd)) {
+			return n, false
+		}
+
+		if !last {
+			child, applied := patch(n[i], tokens[1:], op, value)
+			n[i] = child
+			return n, applied
+		}
+
+		switch op {
+		case models.PatchAdd:
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+		case models.PatchReplace:
+			n[i] = value
+		case models.PatchRemove:
+			n = append(n[:i], n[i+1:]...)
+		}
+		return n, true
+	}
+
+	return node, false
+}
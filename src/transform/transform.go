@@ -0,0 +1,257 @@
+// Package transform edits the bodies of the requests and responses proxied
+// to a service, with the JSON patch rules of the service and the
+// transformers compiled in the gateway.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Transformer is a custom body transformation compiled in the gateway and
+// enabled per service by its registered name. Bodies are streamed through
+// it, whatever their content type, so it should not buffer them whole.
+type Transformer interface {
+	// TransformRequest returns the body sent to the service in place of
+	// body, the headers of r may be edited as well.
+	TransformRequest(r *http.Request, body io.Reader) (io.Reader, error)
+	// TransformResponse returns the body sent to the client in place of
+	// body, the headers of resp may be edited as well.
+	TransformResponse(resp *http.Response, body io.Reader) (io.Reader, error)
+}
+
+var (
+	mu           sync.RWMutex
+	transformers = make(map[string]Transformer)
+)
+
+// Register makes t available to the services under name. It is meant to be
+// called from an init function and panics when name is already taken.
+func Register(name string, t Transformer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := transformers[name]; ok {
+		panic("transform: transformer " + name + " registered twice")
+	}
+	transformers[name] = t
+}
+
+// Lookup returns the transformer registered under name.
+func Lookup(name string) (Transformer, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	t, ok := transformers[name]
+	return t, ok
+}
+
+// Pipeline applies the transformations of a service, a nil pipeline leaves
+// the bodies untouched.
+type Pipeline struct {
+	cfg          models.Transform
+	transformers []Transformer
+}
+
+// New returns the pipeline of the transformations t, nil when t is nil.
+func New(t *models.Transform) (*Pipeline, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	p := &Pipeline{cfg: t.WithDefaults()}
+	for _, name := range t.Transformers {
+		tr, ok := Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q", name)
+		}
+		p.transformers = append(p.transformers, tr)
+	}
+
+	return p, nil
+}
+
+// HasResponse reports whether the pipeline edits the responses.
+func (p *Pipeline) HasResponse() bool {
+	return p != nil && (len(p.cfg.Response) > 0 || len(p.transformers) > 0)
+}
+
+// Request replaces the body of r with its transformation.
+func (p *Pipeline) Request(r *http.Request) error {
+	if p == nil || (len(p.cfg.Request) == 0 && len(p.transformers) == 0) || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	body, patched, _, err := p.patch(r.Header, r.Body, p.cfg.Request, r)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range p.transformers {
+		if body, err = t.TransformRequest(r, body); err != nil {
+			return fmt.Errorf("failed to transform request: %w", err)
+		}
+	}
+
+	r.Body = readCloser{Reader: body, Closer: r.Body}
+	if patched != nil || len(p.transformers) > 0 {
+		r.ContentLength = length(patched, len(p.transformers) > 0)
+		r.Header.Del("Content-Length")
+	}
+
+	return nil
+}
+
+// Response replaces the body of resp with its transformation. Responses
+// patched with the values of a request are made private so they are not
+// shared by the caches.
+func (p *Pipeline) Response(resp *http.Response) error {
+	if !p.HasResponse() || resp.Body == nil || resp.Body == http.NoBody || !hasBody(resp) {
+		return nil
+	}
+
+	body, patched, personal, err := p.patch(resp.Header, resp.Body, p.cfg.Response, resp.Request)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range p.transformers {
+		if body, err = t.TransformResponse(resp, body); err != nil {
+			return fmt.Errorf("failed to transform response: %w", err)
+		}
+	}
+
+	resp.Body = readCloser{Reader: body, Closer: resp.Body}
+	if patched == nil && len(p.transformers) == 0 {
+		return nil
+	}
+
+	resp.ContentLength = length(patched, len(p.transformers) > 0)
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	} else {
+		resp.Header.Del("Content-Length")
+	}
+	resp.Header.Del("Etag")
+
+	if personal {
+		if cc := resp.Header.Get("Cache-Control"); cc != "" {
+			resp.Header.Set("Cache-Control", "private, "+cc)
+		} else {
+			resp.Header.Set("Cache-Control", "private")
+		}
+	}
+
+	return nil
+}
+
+// patch returns body with rules applied when it is a JSON document no
+// larger than the max body size, patched is nil when it is left unchanged.
+// personal reports whether a rule took its value from the request.
+func (p *Pipeline) patch(h http.Header, body io.Reader, rules []models.PatchRule, r *http.Request) (out io.Reader, patched []byte, personal bool, err error) {
+	if len(rules) == 0 || !isJSON(h) || !identity(h) {
+		return body, nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(body, p.cfg.MaxBodySize+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if int64(len(buf)) > p.cfg.MaxBodySize {
+		return io.MultiReader(bytes.NewReader(buf), body), nil, false, nil
+	}
+
+	var vars map[string]json.RawMessage
+	if r != nil {
+		vars = variables(r)
+	}
+
+	edited, changed, personal, err := patchJSON(buf, rules, vars)
+	if err != nil {
+		if r != nil {
+			log.Ctx(r.Context()).Debug().Err(err).Msg("invalid json body left untransformed")
+		}
+		return bytes.NewReader(buf), nil, false, nil
+	}
+	if !changed {
+		return bytes.NewReader(buf), nil, false, nil
+	}
+
+	return bytes.NewReader(edited), edited, personal, nil
+}
+
+// variables returns the values of r the rules can refer to.
+func variables(r *http.Request) map[string]json.RawMessage {
+	vars := make(map[string]json.RawMessage, 3)
+
+	if userID, ok := r.Context().Value(ablibhttp.UserIDCtxKey).(uuid.UUID); ok {
+		vars[models.VariableUserID] = quote(userID.String())
+	}
+	if plan := r.Header.Get("X-Plan-Metadata"); plan != "" && json.Valid([]byte(plan)) {
+		vars[models.VariablePlan] = json.RawMessage(plan)
+	}
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		vars[models.VariableRequestID] = quote(id)
+	}
+
+	return vars
+}
+
+func quote(s string) json.RawMessage {
+	b, _ := json.Marshal(s) //nolint
+	return b
+}
+
+// length returns the length of a transformed body, -1 when it is streamed.
+func length(patched []byte, streamed bool) int64 {
+	if streamed {
+		return -1
+	}
+	return int64(len(patched))
+}
+
+func isJSON(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// identity reports whether the body is not content encoded.
+func identity(h http.Header) bool {
+	encoding := h.Get("Content-Encoding")
+	return encoding == "" || strings.EqualFold(encoding, "identity")
+}
+
+func hasBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// readCloser reads the transformed body and closes the original one.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
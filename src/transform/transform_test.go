@@ -0,0 +1,185 @@
+package transform_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ablibhttp "github.com/amaurybrisou/ablib/http"
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/amaurybrisou/gateway/src/transform"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// upper streams the bodies in upper case.
+type upper struct{}
+
+func (upper) TransformRequest(r *http.Request, body io.Reader) (io.Reader, error) {
+	return upperReader{body}, nil
+}
+
+func (upper) TransformResponse(resp *http.Response, body io.Reader) (io.Reader, error) {
+	resp.Header.Set("X-Upper", "1")
+	return upperReader{body}, nil
+}
+
+type upperReader struct{ r io.Reader }
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
+
+func init() {
+	transform.Register("upper", upper{})
+}
+
+func rule(op, path, value string) models.PatchRule {
+	r := models.PatchRule{Op: op, Path: path}
+	if value != "" {
+		r.Value = json.RawMessage(value)
+	}
+	return r
+}
+
+func TestPatchRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []models.PatchRule
+		body  string
+		want  string
+	}{
+		{name: "add", rules: []models.PatchRule{rule(models.PatchAdd, "/b", `2`)}, body: `{"a":1}`, want: `{"a":1,"b":2}`},
+		{name: "add nested", rules: []models.PatchRule{rule(models.PatchAdd, "/meta/source", `"gateway"`)}, body: `{}`, want: `{"meta":{"source":"gateway"}}`},
+		{name: "add to array", rules: []models.PatchRule{rule(models.PatchAdd, "/list/-", `3`), rule(models.PatchAdd, "/list/0", `0`)}, body: `{"list":[1,2]}`, want: `{"list":[0,1,2,3]}`},
+		{name: "replace", rules: []models.PatchRule{rule(models.PatchReplace, "/a", `"x"`)}, body: `{"a":1}`, want: `{"a":"x"}`},
+		{name: "replace missing", rules: []models.PatchRule{rule(models.PatchReplace, "/b", `1`)}, body: `{"a":1}`, want: `{"a":1}`},
+		{name: "remove", rules: []models.PatchRule{rule(models.PatchRemove, "/secret", "")}, body: `{"a":1,"secret":"s"}`, want: `{"a":1}`},
+		{name: "remove from array", rules: []models.PatchRule{rule(models.PatchRemove, "/items/1/id", ""), rule(models.PatchRemove, "/items/0", "")}, body: `{"items":[{"id":1},{"id":2,"n":"b"}]}`, want: `{"items":[{"n":"b"}]}`},
+		{name: "escaped pointer", rules: []models.PatchRule{rule(models.PatchRemove, "/a~1b", "")}, body: `{"a/b":1,"c":2}`, want: `{"c":2}`},
+		{name: "large numbers", rules: []models.PatchRule{rule(models.PatchAdd, "/b", `true`)}, body: `{"a":12345678901234567890}`, want: `{"a":12345678901234567890,"b":true}`},
+		{name: "not json", rules: []models.PatchRule{rule(models.PatchAdd, "/b", `2`)}, body: `a=1`, want: `a=1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := transform.New(&models.Transform{Request: tt.rules})
+			require.NoError(t, err)
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json; charset=utf-8")
+			require.NoError(t, p.Request(r))
+
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(body))
+			require.Equal(t, int64(len(tt.want)), r.ContentLength)
+		})
+	}
+}
+
+func TestPatchVariables(t *testing.T) {
+	p, err := transform.New(&models.Transform{
+		Request: []models.PatchRule{
+			{Op: models.PatchAdd, Path: "/user_id", Variable: models.VariableUserID},
+			{Op: models.PatchAdd, Path: "/plan", Variable: models.VariablePlan},
+		},
+		Response: []models.PatchRule{
+			{Op: models.PatchAdd, Path: "/owner", Variable: models.VariableUserID},
+		},
+	})
+	require.NoError(t, err)
+
+	userID := uuid.New()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+	r = r.WithContext(context.WithValue(r.Context(), ablibhttp.UserIDCtxKey, userID))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Plan-Metadata", `{"tier":"pro"}`)
+
+	require.NoError(t, p.Request(r))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"user_id":"`+userID.String()+`","plan":{"tier":"pro"}}`, string(body))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+		Body:       io.NopCloser(strings.NewReader(`{"id":1}`)),
+		Request:    r,
+	}
+	require.NoError(t, p.Response(resp))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id":1,"owner":"`+userID.String()+`"}`, string(body))
+	require.Equal(t, "private, max-age=60", resp.Header.Get("Cache-Control"))
+	require.Empty(t, resp.Header.Get("Etag"))
+
+	// Rules are skipped for anonymous requests.
+	anonymous := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+	anonymous.Header.Set("Content-Type", "application/json")
+	require.NoError(t, p.Request(anonymous))
+	body, err = io.ReadAll(anonymous.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{}`, string(body))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	p, err := transform.New(&models.Transform{
+		Request:     []models.PatchRule{rule(models.PatchAdd, "/b", `2`)},
+		MaxBodySize: 8,
+	})
+	require.NoError(t, err)
+
+	body := `{"a":"larger than eight bytes"}`
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	require.NoError(t, p.Request(r))
+
+	got, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, string(got))
+}
+
+func TestTransformers(t *testing.T) {
+	_, err := transform.New(&models.Transform{Transformers: []string{"unknown"}})
+	require.Error(t, err)
+
+	p, err := transform.New(&models.Transform{
+		Response:     []models.PatchRule{rule(models.PatchRemove, "/secret", "")},
+		Transformers: []string{"upper"},
+	})
+	require.NoError(t, err)
+
+	// Bodies that are not JSON are streamed through the transformers only.
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"5"}},
+		ContentLength: 5,
+		Body:          io.NopCloser(strings.NewReader("hello")),
+	}
+	require.NoError(t, p.Response(resp))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(body))
+	require.Equal(t, int64(-1), resp.ContentLength)
+	require.Empty(t, resp.Header.Get("Content-Length"))
+	require.Equal(t, "1", resp.Header.Get("X-Upper"))
+
+	// JSON bodies are patched first.
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"name":"a","secret":"s"}`)),
+	}
+	require.NoError(t, p.Response(resp))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"NAME":"A"}`, string(body))
+}
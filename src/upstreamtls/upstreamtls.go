@@ -0,0 +1,101 @@
+// Package upstreamtls builds the TLS configuration of the connections to the
+// targets of a service.
+package upstreamtls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/amaurybrisou/gateway/src/database/models"
+	"github.com/google/uuid"
+)
+
+// Config returns the TLS configuration described by t, nil when t is nil.
+func Config(t *models.UpstreamTLS) (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify, //nolint:gosec
+	}
+
+	if t.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(t.CACert)) {
+			return nil, errors.New("invalid ca_cert: no certificate found")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Cache keeps the TLS configuration of each service until the service
+// settings change, so the certificates are only parsed once.
+type Cache struct {
+	mu      sync.Mutex
+	configs map[uuid.UUID]cached
+}
+
+type cached struct {
+	fingerprint string
+	cfg         *tls.Config
+}
+
+func NewCache() *Cache {
+	return &Cache{configs: make(map[uuid.UUID]cached)}
+}
+
+// Get returns the TLS configuration of s, nil when s has none. The returned
+// configuration is shared and must not be modified.
+func (c *Cache) Get(s models.Service) (*tls.Config, error) {
+	if s.TLS == nil {
+		c.mu.Lock()
+		delete(c.configs, s.ID)
+		c.mu.Unlock()
+		return nil, nil
+	}
+
+	fingerprint := Fingerprint(s)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.configs[s.ID]; ok && e.fingerprint == fingerprint {
+		return e.cfg, nil
+	}
+
+	cfg, err := Config(s.TLS)
+	if err != nil {
+		return nil, err
+	}
+	c.configs[s.ID] = cached{fingerprint: fingerprint, cfg: cfg}
+
+	return cfg, nil
+}
+
+// Fingerprint identifies the TLS settings of s, it changes along with them.
+func Fingerprint(s models.Service) string {
+	if s.TLS == nil {
+		return ""
+	}
+	b, _ := json.Marshal(s.TLS) //nolint
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum)
+}
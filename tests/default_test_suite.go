@@ -13,10 +13,14 @@ import (
 	"github.com/amaurybrisou/ablib"
 	"github.com/amaurybrisou/ablib/jwtlib"
 	"github.com/amaurybrisou/gateway/src"
+	"github.com/amaurybrisou/gateway/src/cache"
 	"github.com/amaurybrisou/gateway/src/database"
 	"github.com/amaurybrisou/gateway/src/gwservices"
+	"github.com/amaurybrisou/gateway/src/gwservices/account"
+	"github.com/amaurybrisou/gateway/src/gwservices/identity"
 	"github.com/amaurybrisou/gateway/src/gwservices/payment"
 	"github.com/amaurybrisou/gateway/src/gwservices/proxy"
+	"github.com/amaurybrisou/gateway/src/mailer/mailertest"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
@@ -29,8 +33,10 @@ type DefaultTestSuite struct {
 	suite.Suite
 	lcore *ablib.Core
 
-	Container  *Container
-	DB         *database.Database
+	Container *Container
+	DB        *database.Database
+	// Mail records the emails sent by the gateway.
+	Mail       *mailertest.Sender
 	connString string
 }
 
@@ -94,7 +100,9 @@ func (s *DefaultTestSuite) SetupSuite() {
 
 	domain := ablib.LookupEnv("DOMAIN", "http://localhost:50000")
 
-	services := gwservices.NewServices(s.DB, nil, gwservices.ServiceConfig{
+	s.Mail = &mailertest.Sender{}
+
+	services := gwservices.NewServices(s.DB, cache.NewMemoryStore(1<<20), gwservices.ServiceConfig{
 		PaymentConfig: payment.Config{
 			StripeKey:           ablib.LookupEnv("STRIPE_KEY", ""),
 			StripeSuccessURL:    ablib.LookupEnv("STRIPE_SUCCESS_URL", domain+"/login"),
@@ -107,10 +115,28 @@ func (s *DefaultTestSuite) SetupSuite() {
 			Audience:  ablib.LookupEnv("JWT_AUDIENCE", "insecure-key"),
 		},
 		ProxyConfig: proxy.Config{
-			StripPrefix:         "/auth",
-			NotFoundRedirectURL: "/services",
-			NoRoleRedirectURL:   "/pricing",
+			StripPrefix: "/auth",
+			Redirects: proxy.Redirects{
+				NotFoundURL: "/services",
+				NoRoleURL:   "/pricing",
+			},
+		},
+		IdentityConfig: identity.Config{
+			BaseURL: domain,
+			Session: identity.Session{
+				Secret: ablib.LookupEnv("COOKIE_SCRET", "something-secret"),
+				Name:   ablib.LookupEnv("COOKIE_NAME", "cookie-name"),
+				Domain: ablib.LookupEnv("COOKIE_DOMAIN", "cookie-domain"),
+				MaxAge: ablib.LookupEnvInt("COOKIE_MAX_AGE", 3600),
+			},
+		},
+		AccountConfig: account.Config{
+			Secret:      "test-token-secret",
+			ResetURL:    domain + "/home/reset-password",
+			VerifyURL:   domain + "/home/verify-email",
+			ActivateURL: domain + "/home/activate",
 		},
+		Mail: s.Mail,
 	})
 
 	r := src.Router(services, s.DB)
@@ -126,6 +152,7 @@ func (s *DefaultTestSuite) SetupSuite() {
 			50000,
 			r,
 		),
+		services.Proxy().Routes(),
 	)
 
 	s.lcore = lcore
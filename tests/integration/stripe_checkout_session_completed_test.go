@@ -38,6 +38,17 @@ func (s *gwTestSuite) TestStripeSubscriptionCreated() {
 
 	require.Equal(t, user.Role, service.RequiredRoles[0])
 	require.Nil(t, user.ExpiresAt)
+
+	// The account is pending until the customer follows the activation link.
+	created, err := s.DB.GetUserByID(context.Background(), user.UserID)
+	require.NoError(t, err)
+	require.True(t, created.IsNew)
+
+	m, ok := s.Mail.Last()
+	require.True(t, ok)
+	require.Equal(t, "amaury.brisou@puzzledge.org", m.To)
+	require.Equal(t, "Activate your account", m.Subject)
+	require.Contains(t, m.Body, "/home/activate?token=")
 	// require.Equal(t, map[string]string{"max_domains": "20"}, user.Metadata)
 
 	resp, err = s.PostWebhook("application/json", s.ReadFile("fixtures/customer.subscription.updated.json"))